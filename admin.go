@@ -0,0 +1,606 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/albrow/forms"
+	"github.com/gorilla/mux"
+)
+
+// AdminRoot is leading path of all admin API URL
+var AdminRoot = "/admin"
+
+type adminContextKey struct{}
+
+// adminPlayerColumns maps form field accepted by player update into column in
+// PLAYER table, columns must be in updatableColumns.
+var adminPlayerColumns = map[string]string{
+	"user_name":    "user_name",
+	"email":        "email",
+	"display_name": "display_name",
+	"ticket":       "ticket",
+	"password":     "pwdhash",
+}
+
+// adminGameInfoFlags and adminGameInfoValues are columns of GAME_INFO can be
+// modified through admin API, they must be in updatableColumns.
+var adminGameInfoFlags = []string{"is_aprilfools", "world_ranking_enabled", "is_byd_chapter_unlocked"}
+var adminGameInfoValues = []string{"max_stamina", "stamina_recover_tick", "core_exp"}
+
+// purchaseTables maps purchase type into table and column storing it.
+var purchaseTables = map[string]struct{ table, column string }{
+	"pack":   {"pack_purchase_info", "pack_name"},
+	"single": {"single_purchase_info", "song_id"},
+}
+
+// AdminResult is generic JSON value returned by admin API
+type AdminResult map[string]interface{}
+
+func (a *AdminResult) toJSON() string {
+	res, err := json.Marshal(a)
+	if err != nil {
+		stdLog.Error("Error occured while generating JSON", "err", err)
+		return ""
+	}
+
+	return string(res)
+}
+
+// setAdminRouting registers admin API under AdminRoot of router.
+func (s *Server) setAdminRouting(router *mux.Router) {
+	admin := router.PathPrefix(AdminRoot).Subrouter()
+	admin.Use(s.adminAuth, s.adminInvalidateStatic)
+
+	admin.Path("/players").Methods("GET").HandlerFunc(s.adminListPlayers)
+	admin.Path("/players").Methods("POST").HandlerFunc(s.adminCreatePlayer)
+	admin.Path("/players/{userID:[0-9]+}").Methods("GET").HandlerFunc(s.adminGetPlayer)
+	admin.Path("/players/{userID:[0-9]+}").Methods("POST").HandlerFunc(s.adminUpdatePlayer)
+	admin.Path("/players/{userID:[0-9]+}").Methods("DELETE").HandlerFunc(s.adminDeletePlayer)
+
+	admin.Path("/players/{userID:[0-9]+}/purchases").Methods("POST").HandlerFunc(s.adminAddPurchase)
+	admin.Path("/players/{userID:[0-9]+}/purchases/{type}/{itemID}").Methods("DELETE").HandlerFunc(s.adminRemovePurchase)
+
+	admin.Path("/players/{userID:[0-9]+}/characters").Methods("GET").HandlerFunc(s.adminGetCharacters)
+	admin.Path("/players/{userID:[0-9]+}/characters").Methods("POST").HandlerFunc(s.adminUnlockCharacter)
+	admin.Path("/players/{userID:[0-9]+}/characters/{partID:[0-9]+}").Methods("DELETE").HandlerFunc(s.adminRemoveCharacter)
+
+	admin.Path("/players/{userID:[0-9]+}/cores").Methods("POST").HandlerFunc(s.adminSetCore)
+	admin.Path("/players/{userID:[0-9]+}/cores/{coreID}").Methods("DELETE").HandlerFunc(s.adminRemoveCore)
+
+	admin.Path("/players/{userID:[0-9]+}/presents").Methods("POST").HandlerFunc(s.adminGivePresent)
+	admin.Path("/players/{userID:[0-9]+}/presents/{presentID}").Methods("DELETE").HandlerFunc(s.adminTakePresent)
+
+	admin.Path("/presents").Methods("GET").HandlerFunc(s.adminListPresents)
+	admin.Path("/presents").Methods("POST").HandlerFunc(s.adminSavePresent)
+	admin.Path("/presents/{presentID}").Methods("DELETE").HandlerFunc(s.adminDeletePresent)
+
+	admin.Path("/audit").Methods("GET").HandlerFunc(s.adminQueryAudit)
+
+	admin.Path("/game_info").Methods("GET").HandlerFunc(s.adminGetGameInfo)
+	admin.Path("/game_info").Methods("POST").HandlerFunc(s.adminUpdateGameInfo)
+
+	admin.Path("/cache").Methods("GET").HandlerFunc(s.adminCacheStats)
+}
+
+// adminAuth checks admin credentials with HTTP basic authentication and
+// records admin user name in request context.
+func (s *Server) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pwd, ok := r.BasicAuth()
+		config := s.cfg()
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(config.AdminUser)) == 1
+		pwdOK := subtle.ConstantTimeCompare([]byte(pwd), []byte(config.AdminPassword)) == 1
+		if !ok || !userOK || !pwdOK || config.AdminPassword == "" {
+			requestLog(r).Warn("Admin authentication failed", "remote_addr", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="zrc admin"`)
+			adminError(w, http.StatusUnauthorized, "authentication failed")
+			return
+		}
+		ctx := context.WithValue(r.Context(), adminContextKey{}, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// adminInvalidateStatic drops cached game data after every modifying request,
+// as admin API writes database directly.
+func (s *Server) adminInvalidateStatic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s.invalidateStatic()
+		}
+	})
+}
+
+func adminActor(r *http.Request) string {
+	actor, _ := r.Context().Value(adminContextKey{}).(string)
+	return actor
+}
+
+// logAdminAction records a successful modification made through admin API
+// into audit log.
+func (s *Server) logAdminAction(r *http.Request, userID int, action string, detail string) {
+	requestLog(r).Info("Admin action", "actor", adminActor(r), "action", action, "target_user", userID, "detail", detail)
+	s.writeAudit(
+		r, "admin:"+adminActor(r), userID,
+		auditAdminPrefix+strings.ReplaceAll(action, " ", "_"), detail,
+	)
+}
+
+func adminError(w http.ResponseWriter, status int, message string) {
+	res, _ := json.Marshal(map[string]interface{}{"success": false, "error": message})
+	http.Error(w, string(res), status)
+}
+
+func adminOK(w http.ResponseWriter, value ToJSON) {
+	container := Container{true, value, 0}
+	fmt.Fprint(w, container.toJSON())
+}
+
+// Form fields of admin API must hold a value of given type when present, so
+// that typed getters of forms.Data are safe to use.
+var (
+	adminIntFields = []string{
+		"limit", "offset", "part_id", "level", "amount", "expire_ts", "ticket",
+		"max_stamina", "stamina_recover_tick", "core_exp", "from", "to",
+	}
+	adminFloatFields = []string{"overdrive", "prog", "frag"}
+	adminBoolFields  = []string{
+		"uncapped", "is_aprilfools", "world_ranking_enabled", "is_byd_chapter_unlocked",
+	}
+)
+
+// adminForm parses and type checks request form, writing error response on
+// failure.
+func adminForm(w http.ResponseWriter, r *http.Request) (*forms.Data, bool) {
+	data, err := forms.Parse(r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, fmt.Sprintf("invalid form: %s", err))
+		return nil, false
+	}
+	val := data.Validator()
+	for _, field := range adminIntFields {
+		if data.KeyExists(field) {
+			val.TypeInt(field)
+		}
+	}
+	for _, field := range adminFloatFields {
+		if data.KeyExists(field) {
+			val.TypeFloat(field)
+		}
+	}
+	for _, field := range adminBoolFields {
+		if data.KeyExists(field) {
+			val.TypeBool(field)
+		}
+	}
+	if val.HasErrors() {
+		adminError(w, http.StatusBadRequest, strings.Join(val.Messages(), " "))
+		return nil, false
+	}
+	return data, true
+}
+
+// adminUserID reads user ID in URL and makes sure player exists.
+func (s *Server) adminUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, _ := strconv.Atoi(mux.Vars(r)["userID"])
+	if exists, err := s.store.PlayerExists(userID); err != nil {
+		requestLog(r).Error("Error occured while looking up player", "target_user", userID, "err", err)
+		adminError(w, http.StatusInternalServerError, "database error")
+		return 0, false
+	} else if !exists {
+		adminError(w, http.StatusNotFound, fmt.Sprintf("no player with user ID %d", userID))
+		return 0, false
+	}
+	return userID, true
+}
+
+// adminExec runs a modification returning number of rows affected, logs it as
+// admin action on success and writes response.
+func (s *Server) adminExec(w http.ResponseWriter, r *http.Request, userID int, action, detail string, modify func() (int64, error)) {
+	affected, err := modify()
+	if err != nil {
+		adminStoreError(w, r, action, err)
+		return
+	}
+	s.logAdminAction(r, userID, action, detail)
+	adminOK(w, &AdminResult{"affected": affected})
+}
+
+// adminStoreError writes response of failed store call, only arguments store
+// refused are told to client, other errors are logged.
+func adminStoreError(w http.ResponseWriter, r *http.Request, action string, err error) {
+	var invalid *invalidError
+	if errors.As(err, &invalid) {
+		adminError(w, http.StatusBadRequest, invalid.Error())
+		return
+	}
+	requestLog(r).Error("Error occured while "+action, "err", err)
+	adminError(w, http.StatusInternalServerError, "database error")
+}
+
+// Section: Players
+// ============================================================================
+
+func (s *Server) adminListPlayers(w http.ResponseWriter, r *http.Request) {
+	data, ok := adminForm(w, r)
+	if !ok {
+		return
+	}
+	limit := 50
+	if data.KeyExists("limit") {
+		limit = data.GetInt("limit")
+	}
+	players, err := s.store.ListPlayers(data.Get("query"), limit, data.GetInt("offset"))
+	if err != nil {
+		requestLog(r).Error("Error occured while listing players", "err", err)
+		adminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	adminOK(w, &AdminResult{"players": players})
+}
+
+func (s *Server) adminCreatePlayer(w http.ResponseWriter, r *http.Request) {
+	data, ok := adminForm(w, r)
+	if !ok {
+		return
+	}
+	val := data.Validator()
+	val.Require("user_name")
+	val.Require("password")
+	if val.HasErrors() {
+		adminError(w, http.StatusBadRequest, "user_name and password are required")
+		return
+	}
+
+	userID, userCode, err := s.store.CreatePlayer(
+		data.Get("user_name"), data.Get("email"),
+		fmt.Sprintf("%x", md5.Sum([]byte(data.Get("password")))),
+		time.Now().UnixNano()/int64(time.Millisecond),
+	)
+	if err != nil {
+		adminStoreError(w, r, "create player", err)
+		return
+	}
+	s.logAdminAction(r, userID, "create player", fmt.Sprintf("name=%q code=%09d", data.Get("user_name"), userCode))
+	adminOK(w, &AdminResult{"user_id": userID, "user_code": fmt.Sprintf("%09d", userCode)})
+}
+
+func (s *Server) adminGetPlayer(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.adminUserID(w, r)
+	if !ok {
+		return
+	}
+	info, err := s.getUserInfo(userID, r)
+	if err != nil {
+		requestLog(r).Error("Error occured while reading player info", "err", err)
+		adminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	adminOK(w, info)
+}
+
+func (s *Server) adminUpdatePlayer(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.adminUserID(w, r)
+	if !ok {
+		return
+	}
+	data, ok := adminForm(w, r)
+	if !ok {
+		return
+	}
+
+	fields := make([]string, 0, len(adminPlayerColumns))
+	for field := range adminPlayerColumns {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	values, changed := map[string]interface{}{}, []string{}
+	for _, field := range fields {
+		if !data.KeyExists(field) {
+			continue
+		}
+		column := adminPlayerColumns[field]
+		value := data.Get(field)
+		if field == "password" {
+			value = fmt.Sprintf("%x", md5.Sum([]byte(value)))
+			changed = append(changed, "password")
+		} else {
+			changed = append(changed, fmt.Sprintf("%s=%q", field, value))
+		}
+		values[column] = value
+	}
+	if len(values) == 0 {
+		adminError(w, http.StatusBadRequest, "nothing to update")
+		return
+	}
+	s.adminExec(w, r, userID, "update player", strings.Join(changed, " "), func() (int64, error) {
+		return s.store.UpdatePlayer(userID, values)
+	})
+}
+
+func (s *Server) adminDeletePlayer(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.adminUserID(w, r)
+	if !ok {
+		return
+	}
+	if err := s.store.DeletePlayer(userID); err != nil {
+		requestLog(r).Error("Error occured while deleting player", "target_user", userID, "err", err)
+		adminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	s.logAdminAction(r, userID, "delete player", "")
+	adminOK(w, &AdminResult{"user_id": userID})
+}
+
+// Section: Purchases, characters and cores
+// ============================================================================
+
+func (s *Server) adminAddPurchase(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.adminUserID(w, r)
+	if !ok {
+		return
+	}
+	data, ok := adminForm(w, r)
+	if !ok {
+		return
+	}
+	kind, itemID := data.Get("type"), data.Get("id")
+	if _, ok := purchaseTables[kind]; !ok || itemID == "" {
+		adminError(w, http.StatusBadRequest, "type must be pack or single, and id is required")
+		return
+	}
+	detail := fmt.Sprintf("%s=%q", kind, itemID)
+	s.adminExec(w, r, userID, "grant purchase", detail, func() (int64, error) {
+		return s.store.GrantPurchase(userID, kind, itemID)
+	})
+}
+
+func (s *Server) adminRemovePurchase(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.adminUserID(w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	kind, itemID := vars["type"], vars["itemID"]
+	if _, ok := purchaseTables[kind]; !ok {
+		adminError(w, http.StatusBadRequest, "type must be pack or single")
+		return
+	}
+	detail := fmt.Sprintf("%s=%q", kind, itemID)
+	s.adminExec(w, r, userID, "revoke purchase", detail, func() (int64, error) {
+		return s.store.RevokePurchase(userID, kind, itemID)
+	})
+}
+
+func (s *Server) adminGetCharacters(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.adminUserID(w, r)
+	if !ok {
+		return
+	}
+	stats, err := s.store.Characters(userID, -1)
+	if err != nil {
+		requestLog(r).Error("Error occured while reading characters", "err", err)
+		adminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	adminOK(w, &ToggleResult{userID, stats})
+}
+
+func (s *Server) adminUnlockCharacter(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.adminUserID(w, r)
+	if !ok {
+		return
+	}
+	data, ok := adminForm(w, r)
+	if !ok {
+		return
+	}
+	if !data.KeyExists("part_id") {
+		adminError(w, http.StatusBadRequest, "part_id is required")
+		return
+	}
+	partID, err := strconv.ParseInt(data.Get("part_id"), 10, 8)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, fmt.Sprintf("part_id must be in %d..%d", math.MinInt8, math.MaxInt8))
+		return
+	}
+	level := int64(1)
+	if data.KeyExists("level") {
+		if level, err = strconv.ParseInt(data.Get("level"), 10, 8); err != nil {
+			adminError(w, http.StatusBadRequest, fmt.Sprintf("level must be in %d..%d", math.MinInt8, math.MaxInt8))
+			return
+		}
+	}
+	stats := &CharacterStats{
+		PartID:     int8(partID),
+		Level:      int8(level),
+		IsUncapped: data.GetBool("uncapped"),
+		Overdrive:  data.GetFloat("overdrive"),
+		Prog:       data.GetFloat("prog"),
+		Frag:       data.GetFloat("frag"),
+	}
+	detail := fmt.Sprintf("part_id=%d level=%d uncapped=%v", stats.PartID, stats.Level, stats.IsUncapped)
+	s.adminExec(w, r, userID, "unlock character", detail, func() (int64, error) {
+		return s.store.UnlockCharacter(userID, stats)
+	})
+}
+
+func (s *Server) adminRemoveCharacter(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.adminUserID(w, r)
+	if !ok {
+		return
+	}
+	partID, _ := strconv.Atoi(mux.Vars(r)["partID"])
+	s.adminExec(w, r, userID, "remove character", fmt.Sprintf("part_id=%d", partID), func() (int64, error) {
+		return s.store.RemoveCharacter(userID, partID)
+	})
+}
+
+func (s *Server) adminSetCore(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.adminUserID(w, r)
+	if !ok {
+		return
+	}
+	data, ok := adminForm(w, r)
+	if !ok {
+		return
+	}
+	if data.Get("core_id") == "" || !data.KeyExists("amount") {
+		adminError(w, http.StatusBadRequest, "core_id and amount are required")
+		return
+	}
+	coreID, amount := data.Get("core_id"), data.GetInt("amount")
+	detail := fmt.Sprintf("core_id=%q amount=%d", coreID, amount)
+	s.adminExec(w, r, userID, "set core", detail, func() (int64, error) {
+		return s.store.SetCore(userID, coreID, amount)
+	})
+}
+
+func (s *Server) adminRemoveCore(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.adminUserID(w, r)
+	if !ok {
+		return
+	}
+	coreID := mux.Vars(r)["coreID"]
+	s.adminExec(w, r, userID, "remove core", fmt.Sprintf("core_id=%q", coreID), func() (int64, error) {
+		return s.store.RemoveCore(userID, coreID)
+	})
+}
+
+// Section: Presents
+// ============================================================================
+
+func (s *Server) adminListPresents(w http.ResponseWriter, r *http.Request) {
+	presents, err := s.store.AllPresents()
+	if err != nil {
+		requestLog(r).Error("Error occured while reading presents", "err", err)
+		adminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	adminOK(w, (*PresentContainer)(&presents))
+}
+
+func (s *Server) adminSavePresent(w http.ResponseWriter, r *http.Request) {
+	data, ok := adminForm(w, r)
+	if !ok {
+		return
+	}
+	items := []RewardItem{}
+	if data.Get("present_id") == "" || json.Unmarshal([]byte(data.Get("items")), &items) != nil {
+		adminError(w, http.StatusBadRequest, "present_id and items in JSON are required")
+		return
+	}
+	present := &Present{
+		PresentID:   data.Get("present_id"),
+		ExpireTs:    int64(data.GetInt("expire_ts")),
+		Description: data.Get("description"),
+		Items:       items,
+	}
+	content, _ := json.Marshal(items)
+	detail := fmt.Sprintf("present_id=%q expire_ts=%d items=%s", present.PresentID, present.ExpireTs, content)
+	s.adminExec(w, r, 0, "save present", detail, func() (int64, error) {
+		return s.store.SavePresent(present)
+	})
+}
+
+func (s *Server) adminDeletePresent(w http.ResponseWriter, r *http.Request) {
+	presentID := mux.Vars(r)["presentID"]
+	if err := s.store.DeletePresent(presentID); err != nil {
+		requestLog(r).Error("Error occured while deleting present", "present_id", presentID, "err", err)
+		adminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	s.logAdminAction(r, 0, "delete present", fmt.Sprintf("present_id=%q", presentID))
+	adminOK(w, &AdminResult{"present_id": presentID})
+}
+
+func (s *Server) adminGivePresent(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.adminUserID(w, r)
+	if !ok {
+		return
+	}
+	data, ok := adminForm(w, r)
+	if !ok {
+		return
+	}
+	presentID := data.Get("present_id")
+	s.adminExec(w, r, userID, "give present", fmt.Sprintf("present_id=%q", presentID), func() (int64, error) {
+		return s.store.GivePresent(userID, presentID)
+	})
+}
+
+func (s *Server) adminTakePresent(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.adminUserID(w, r)
+	if !ok {
+		return
+	}
+	presentID := mux.Vars(r)["presentID"]
+	s.adminExec(w, r, userID, "take present", fmt.Sprintf("present_id=%q", presentID), func() (int64, error) {
+		return s.store.TakePresent(userID, presentID)
+	})
+}
+
+// Section: Game info
+// ============================================================================
+
+func (s *Server) adminGetGameInfo(w http.ResponseWriter, r *http.Request) {
+	info, err := s.getGameInfo(0, r)
+	if err != nil {
+		requestLog(r).Error("Error occured while reading game info", "err", err)
+		adminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	isAprilFools, err := s.store.IsAprilFools()
+	if err != nil {
+		requestLog(r).Error("Error occured while reading april fools flag", "err", err)
+		adminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	adminOK(w, &AdminResult{"game_info": info, "is_aprilfools": isAprilFools})
+}
+
+func (s *Server) adminUpdateGameInfo(w http.ResponseWriter, r *http.Request) {
+	data, ok := adminForm(w, r)
+	if !ok {
+		return
+	}
+	values, changed := map[string]interface{}{}, []string{}
+	for _, column := range adminGameInfoFlags {
+		if data.KeyExists(column) {
+			values[column] = sqlBool(data.GetBool(column))
+			changed = append(changed, fmt.Sprintf("%s=%v", column, data.GetBool(column)))
+		}
+	}
+	for _, column := range adminGameInfoValues {
+		if data.KeyExists(column) {
+			values[column] = data.GetInt(column)
+			changed = append(changed, fmt.Sprintf("%s=%d", column, data.GetInt(column)))
+		}
+	}
+	if len(values) == 0 {
+		adminError(w, http.StatusBadRequest, "nothing to update")
+		return
+	}
+	s.adminExec(w, r, 0, "update game info", strings.Join(changed, " "), func() (int64, error) {
+		return s.store.UpdateGameInfo(values)
+	})
+}
+
+// Section: Cache
+// ============================================================================
+
+func (s *Server) adminCacheStats(w http.ResponseWriter, r *http.Request) {
+	adminOK(w, &AdminResult{"static": s.store.StaticCacheStats()})
+}
@@ -3,40 +3,37 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 
 	"github.com/albrow/forms"
 )
 
-func aggregateHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) aggregateHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		userID int
 		err    error
 	)
-	if NeedAuth {
-		userID, err = verifyBearerAuth(r.Header.Get("Authorization"))
+	if s.cfg().Auth {
+		userID, err = s.verifyBearerAuth(r.Header.Get("Authorization"))
 		if err != nil {
 			c := Container{false, nil, 203}
 			http.Error(w, c.toJSON(), http.StatusUnauthorized)
 			return
 		}
 	} else {
-		userID = staticUserID
+		userID = s.cfg().StaticUserID
 	}
+	setRequestUser(r, userID)
 	data, err := forms.Parse(r)
 	if err != nil {
-		log.Println(err)
+		requestLog(r).Error("Error occured while parsing form", "err", err)
 	}
 
 	val := data.Validator()
 	val.Require("calls")
 	if val.HasErrors() {
-		log.Printf("%s: Form passed lacks of necessary key(s).", r.URL.Path)
-		for k, v := range val.ErrorMap() {
-			log.Printf("%s: %s\n", k, v)
-		}
+		requestLog(r).Warn("Form passed lacks of necessary key(s)", "errors", val.ErrorMap())
 		return
 	}
 
@@ -46,16 +43,16 @@ func aggregateHandler(w http.ResponseWriter, r *http.Request) {
 	json.Unmarshal([]byte(data.Get("calls")), &calls)
 	for _, call := range calls {
 		endPoint := strings.Split(call.EndPoint, "?")[0]
-		handler, ok := InsideHandler[endPoint]
+		handler, ok := s.insideHandlers[endPoint]
 		if !ok {
-			log.Println("Unknow request endpoint ", call.EndPoint)
+			requestLog(r).Warn("Unknown aggregate request endpoint", "endpoint", call.EndPoint)
 			results = append(results, AggResult{call.ID, &EmptyList{}})
 			continue
 		}
 		tojson, err := handler(userID, r)
 		if err != nil {
 			container.Success = false
-			log.Println(err)
+			requestLog(r).Error("Error occured while handling aggregate call", "endpoint", endPoint, "err", err)
 			break
 		}
 		results = append(results, AggResult{call.ID, tojson})
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Size of game data seeded for aggregate benchmark, the player owns every map
+// and partner.
+const (
+	benchMaps     = 100
+	benchPartners = 60
+	benchPacks    = 30
+)
+
+// aggregateCalls are the calls game client makes through aggregate request
+// on start up.
+const aggregateCalls = `[
+	{"id":0,"endpoint":"/user/me"},
+	{"id":1,"endpoint":"/purchase/bundle/pack"},
+	{"id":2,"endpoint":"/serve/download/me/song?url=false"},
+	{"id":3,"endpoint":"/game/info"},
+	{"id":4,"endpoint":"/present/me"},
+	{"id":5,"endpoint":"/world/map/me"}
+]`
+
+// seedAggregateBench fills store with benchMaps maps along with their
+// affinity and rewards, benchPartners partners and benchPacks packs, and gives
+// player 1 progress on every map and every partner.
+func seedAggregateBench(b *testing.B, st Store) {
+	b.Helper()
+	err := st.EditRows(func(tx RowTx) error {
+		insert := func(table string, row map[string]interface{}) {
+			if err := tx.InsertRow(table, row); err != nil {
+				b.Fatalf("seeding %s: %v", table, err)
+			}
+		}
+		for i := 2; i < benchPartners; i++ {
+			insert("partner", map[string]interface{}{"part_id": i, "part_name": fmt.Sprintf("partner%d", i), "skill_id": ""})
+			insert("part_stats", map[string]interface{}{"user_id": 1, "part_id": i, "overdrive": 50, "prog": 50, "frag": 50})
+		}
+		for i := 0; i < benchPartners; i += 3 {
+			insert("part_voice", map[string]interface{}{"part_id": i})
+		}
+		for i := 0; i < benchMaps; i++ {
+			mapID := fmt.Sprintf("map%d", i)
+			insert("world_map", map[string]interface{}{"map_id": mapID, "chapter": i % 5, "step_count": 20})
+			for j := 0; j < 3; j++ {
+				insert("map_affinity", map[string]interface{}{"map_id": mapID, "part_id": (i + j) % benchPartners, "multiplier": 1.5})
+			}
+			for j := 0; j < 10; j++ {
+				insert("map_reward", map[string]interface{}{"map_id": mapID, "position": j * 2, "item_type": "fragment", "amount": 100})
+			}
+			insert("player_map_prog", map[string]interface{}{"user_id": 1, "map_id": mapID, "curr_position": i % 20})
+		}
+		for i := 0; i < benchPacks; i++ {
+			pack := fmt.Sprintf("pack%d", i)
+			insert("pack", map[string]interface{}{"pack_name": pack, "price": 300})
+			for j := 0; j < 10; j++ {
+				songID := fmt.Sprintf("%s_song%d", pack, j)
+				insert("song", map[string]interface{}{"song_id": songID, "pack_name": pack, "remote_dl": 1})
+				insert("chart_info", map[string]interface{}{"song_id": songID, "difficulty": 2, "rating": 9.0, "remote_dl": 1})
+				insert("pack_item", map[string]interface{}{"pack_name": pack, "item_id": songID, "item_type": "single", "is_available": 1})
+			}
+			insert("pack_purchase_info", map[string]interface{}{"user_id": 1, "pack_name": pack})
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatalf("seeding store: %v", err)
+	}
+}
+
+// BenchmarkAggregate measures aggregate request latency for a player owning
+// every map and partner, with static game data cached and with it read from
+// database on every request.
+func BenchmarkAggregate(b *testing.B) {
+	s := newTestServer(b, nil)
+	seedAggregateBench(b, s.store)
+	form := url.Values{"calls": {aggregateCalls}}
+
+	w := serve(s, http.MethodGet, s.cfg().APIRoot+"/compose/aggregate", form, nil)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.HasPrefix(body, `{"success":true`) {
+		b.Fatalf("aggregate request failed: status %d, body %s", w.Code, body)
+	}
+	for _, want := range []string{`"map_id":"map99"`, `"name":"partner59"`, `"name":"pack29"`} {
+		if !strings.Contains(body, want) {
+			b.Fatalf("aggregate response lacks %s", want)
+		}
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			serve(s, http.MethodGet, s.cfg().APIRoot+"/compose/aggregate", form, nil)
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.invalidateStatic()
+			serve(s, http.MethodGet, s.cfg().APIRoot+"/compose/aggregate", form, nil)
+		}
+	})
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archiveFormat and archiveVersion identify player archives, version is
+// bumped whenever archive layout changes incompatibly.
+const (
+	archiveFormat  = "zrc-player-archive"
+	archiveVersion = 1
+)
+
+// archiveTables are tables holding per-player rows keyed by USER_ID, in order
+// they have to be inserted on import.
+var archiveTables = []string{
+	"part_stats", "core_possess_info",
+	"pack_purchase_info", "single_purchase_info",
+	"world_unlock", "world_song_unlock", "player_map_prog",
+	"score", "best_score", "recent_score", "data_backup", "player_present",
+}
+
+// archiveReferences are columns of archived tables pointing to static game
+// data, checked before importing an archive. Kind is what RowTx.KnownIDs
+// takes.
+var archiveReferences = map[string]struct{ column, kind string }{
+	"part_stats":           {"part_id", "partner"},
+	"core_possess_info":    {"core_id", "core"},
+	"pack_purchase_info":   {"pack_name", "pack"},
+	"single_purchase_info": {"song_id", "song"},
+	"player_present":       {"present_id", "present"},
+}
+
+// PlayerArchive is a portable copy of all data of one player.
+type PlayerArchive struct {
+	Format        string                  `json:"format"`
+	Version       int                     `json:"version"`
+	SchemaVersion int                     `json:"schema_version"`
+	ExportedAt    int64                   `json:"exported_at"`
+	Player        archiveRow              `json:"player"`
+	Tables        map[string][]archiveRow `json:"tables"`
+}
+
+func (a *PlayerArchive) toJSON() string {
+	res, err := json.Marshal(a)
+	if err != nil {
+		stdLog.Error("Error occured while generating JSON", "err", err)
+		return ""
+	}
+
+	return string(res)
+}
+
+// archiveRow maps column name to value of a row.
+type archiveRow map[string]interface{}
+
+func init() {
+	subCommands["export"] = exportCommand
+	subCommands["import-player"] = importPlayerCommand
+}
+
+// Section: Export
+// ============================================================================
+
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		userID int
+		err    error
+	)
+	if s.cfg().Auth {
+		userID, err = s.verifyBearerAuth(r.Header.Get("Authorization"))
+		if err != nil {
+			c := Container{false, nil, 203}
+			http.Error(w, c.toJSON(), http.StatusUnauthorized)
+			return
+		}
+	} else {
+		userID = s.cfg().StaticUserID
+	}
+	setRequestUser(r, userID)
+
+	archive, err := s.exportPlayer(userID)
+	if err != nil {
+		requestLog(r).Error("Error occured while exporting data", "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
+	}
+	// Password hash is only kept in archives exported by admin with export
+	// command, player imported without it has to get a new password.
+	delete(archive.Player, "pwdhash")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(
+		"Content-Disposition",
+		fmt.Sprintf(`attachment; filename="player-%v.json"`, archive.Player["user_code"]),
+	)
+	fmt.Fprint(w, archive.toJSON())
+}
+
+func exportCommand(args []string) error {
+	commandLine := flag.NewFlagSet(args[0], flag.ExitOnError)
+	user := commandLine.String("user", "", "User name, email or user code of player to export.")
+	output := commandLine.String("out", "", "Output file, defaults to stdout.")
+	config, err := parseCommandFlags(commandLine, args[1:])
+	if err != nil {
+		return err
+	}
+
+	if *user == "" {
+		return errors.New("-user is required")
+	}
+	s, err := openCommandDB(config)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	userID, err := s.store.FindPlayer(*user)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no player matches `%s`", *user)
+	} else if err != nil {
+		return err
+	}
+	archive, err := s.exportPlayer(userID)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(archive, "", "\t")
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(content)
+		return err
+	}
+	return ioutil.WriteFile(*output, content, 0600)
+}
+
+// exportPlayer collects player row and all rows of archiveTables belongs to
+// user into an archive.
+func (s *Server) exportPlayer(userID int) (*PlayerArchive, error) {
+	archive := &PlayerArchive{
+		Format:        archiveFormat,
+		Version:       archiveVersion,
+		SchemaVersion: latestSchemaVersion(s.cfg().Storage),
+		ExportedAt:    time.Now().Unix(),
+		Tables:        map[string][]archiveRow{},
+	}
+	err := s.store.EditRows(func(tx RowTx) error {
+		where := map[string]interface{}{"user_id": userID}
+		players, err := tx.SelectRows("player", nil, where)
+		if err != nil {
+			return err
+		} else if len(players) == 0 {
+			return fmt.Errorf("no player with user ID %d", userID)
+		}
+		archive.Player = players[0]
+
+		for _, table := range archiveTables {
+			rows, err := tx.SelectRows(table, nil, where)
+			if err != nil {
+				return fmt.Errorf("error occured while exporting table %s: %w", strings.ToUpper(table), err)
+			}
+			archive.Tables[table] = make([]archiveRow, len(rows))
+			for i, row := range rows {
+				archive.Tables[table][i] = row
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// Section: Import
+// ============================================================================
+
+func importPlayerCommand(args []string) error {
+	commandLine := flag.NewFlagSet(args[0], flag.ExitOnError)
+	input := commandLine.String("in", "", "Player archive file to import.")
+	rename := commandLine.String("rename", "", "Import player under this user name instead.")
+	config, err := parseCommandFlags(commandLine, args[1:])
+	if err != nil {
+		return err
+	}
+
+	if *input == "" {
+		return errors.New("-in is required")
+	}
+	archive, err := readPlayerArchive(*input)
+	if err != nil {
+		return err
+	}
+	if *rename != "" {
+		archive.Player["user_name"] = *rename
+	}
+	s, err := openCommandDB(config)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	userID, userCode, err := s.importPlayer(archive)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported player `%v` as user ID %d, user code %09d.\n", archive.Player["user_name"], userID, userCode)
+	return nil
+}
+
+func readPlayerArchive(fileName string) (*PlayerArchive, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	archive := new(PlayerArchive)
+	if err = decoder.Decode(archive); err != nil {
+		return nil, fmt.Errorf("error occured while parsing `%s`: %w", fileName, err)
+	}
+	if archive.Format != archiveFormat {
+		return nil, fmt.Errorf("`%s` is not a player archive", fileName)
+	} else if archive.Version > archiveVersion {
+		return nil, fmt.Errorf("archive version %d is newer than supported version %d", archive.Version, archiveVersion)
+	} else if archive.Player == nil {
+		return nil, fmt.Errorf("archive `%s` contains no player", fileName)
+	}
+	return archive, nil
+}
+
+// importPlayer inserts archive as a new player, user ID is always remapped
+// and user code is kept unless it's taken. Conflicting user name or email
+// and references to unknown game data abort the import.
+func (s *Server) importPlayer(archive *PlayerArchive) (int, int64, error) {
+	if err := upgradeArchive(archive, latestSchemaVersion(s.cfg().Storage)); err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		userID   int
+		userCode int64
+	)
+	err := s.store.EditRows(func(tx RowTx) error {
+		if err := checkArchiveConflicts(tx, archive); err != nil {
+			return err
+		}
+
+		player := archiveRow{}
+		for column, value := range archive.Player {
+			player[column] = archiveValue(value)
+		}
+		delete(player, "user_id")
+
+		userCode, _ = archiveInt(player["user_code"])
+		taken, err := tx.SelectRows("player", []string{"user_id"}, map[string]interface{}{"user_code": userCode})
+		if err != nil {
+			return err
+		}
+		if len(taken) > 0 || userCode <= 0 {
+			if userCode, err = tx.NewUserCode(); err != nil {
+				return err
+			}
+		}
+		player["user_code"] = userCode
+
+		if userID, err = tx.InsertPlayer(player); err != nil {
+			return fmt.Errorf("error occured while inserting player: %w", err)
+		}
+		for _, table := range archiveTables {
+			for _, row := range archive.Tables[table] {
+				values := map[string]interface{}{}
+				for column, value := range row {
+					values[column] = archiveValue(value)
+				}
+				values["user_id"] = userID
+				if err := tx.InsertRow(table, values); err != nil {
+					return fmt.Errorf("error occured while importing table %s: %w", strings.ToUpper(table), err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return userID, userCode, nil
+}
+
+// archiveUpgrades convert archived rows exported at the schema version before
+// key into what that version expects. Every version must be listed, nil for
+// those that don't change archived tables, so that archives are never imported
+// across a schema change nobody has written conversion for.
+var archiveUpgrades = map[int]func(archive *PlayerArchive) error{
+	2: nil,
+	3: nil,
+	4: nil,
+	5: upgradeArchiveFlags,
+	6: upgradeArchiveBackups,
+}
+
+// upgradeArchive converts archive of an older schema version up to latest.
+func upgradeArchive(archive *PlayerArchive, latest int) error {
+	if archive.SchemaVersion <= 0 || archive.SchemaVersion > latest {
+		return fmt.Errorf("archive schema version %d is unknown, supported versions are 1 to %d", archive.SchemaVersion, latest)
+	}
+	for version := archive.SchemaVersion + 1; version <= latest; version++ {
+		upgrade, ok := archiveUpgrades[version]
+		if !ok {
+			return fmt.Errorf("archive schema version %d can't be converted to version %d", archive.SchemaVersion, version)
+		}
+		if upgrade != nil {
+			if err := upgrade(archive); err != nil {
+				return fmt.Errorf("error occured while converting archive to schema version %d: %w", version, err)
+			}
+		}
+	}
+	archive.SchemaVersion = latest
+	return nil
+}
+
+// upgradeArchiveFlags turns flags from text into 1 and 0, as
+// 0005_boolean_flags does.
+func upgradeArchiveFlags(archive *PlayerArchive) error {
+	for _, t := range booleanFlags {
+		rows := archive.Tables[t.table]
+		if t.table == "player" {
+			rows = []archiveRow{archive.Player}
+		}
+		for _, row := range rows {
+			for _, flag := range t.flags {
+				if _, ok := row[flag]; !ok {
+					continue
+				}
+				if row[flag] == "t" {
+					row[flag] = 1
+				} else {
+					row[flag] = 0
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// upgradeArchiveBackups turns backups of the layout before versioning into
+// version 1, as 0006_backup_versions does.
+func upgradeArchiveBackups(archive *PlayerArchive) error {
+	backups := []archiveRow{}
+	for _, row := range archive.Tables["data_backup"] {
+		if _, ok := row["version"]; ok {
+			backups = append(backups, row)
+			continue
+		}
+		data, _ := row["backup_data"].(string)
+		if strings.TrimSpace(data) == "" {
+			continue
+		}
+		content, createdAt, err := convertOldBackup(data)
+		if err != nil {
+			return fmt.Errorf("backup is broken: %w", err)
+		}
+		backups = append(backups, archiveRow{"version": 1, "created_at": createdAt, "backup_data": content})
+	}
+	if archive.Tables["data_backup"] != nil {
+		archive.Tables["data_backup"] = backups
+	}
+	return nil
+}
+
+// checkArchiveConflicts reports every reason archive can't be imported as is.
+func checkArchiveConflicts(tx RowTx, archive *PlayerArchive) error {
+	conflicts := []string{}
+
+	name, _ := archive.Player["user_name"].(string)
+	email, _ := archive.Player["email"].(string)
+	if taken, err := tx.PlayerTaken(name, email); err != nil {
+		return err
+	} else if taken {
+		conflicts = append(conflicts, fmt.Sprintf("user name `%s` or email `%s` is already taken", name, email))
+	}
+
+	for table, ref := range archiveReferences {
+		known, err := tx.KnownIDs(ref.kind)
+		if err != nil {
+			return err
+		}
+		for _, row := range archive.Tables[table] {
+			value := importValueText(row[ref.column])
+			if !known[value] {
+				conflicts = append(conflicts, fmt.Sprintf("%s references unknown %s `%s`", table, ref.column, value))
+			}
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return errors.New("archive conflicts with database:\n\t" + strings.Join(conflicts, "\n\t"))
+	}
+	return nil
+}
+
+// archiveValue converts JSON decoded value back to database value.
+func archiveValue(v interface{}) interface{} {
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		f, _ := n.Float64()
+		return f
+	}
+	return v
+}
+
+func archiveInt(v interface{}) (int64, bool) {
+	switch v := archiveValue(v).(type) {
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
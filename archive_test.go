@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestImportOldArchive imports an archive exported at schema version 4, whose
+// flags are text and backup is of the layout before versioning.
+func TestImportOldArchive(t *testing.T) {
+	s := newTestServer(t, nil)
+	fileName := filepath.Join(t.TempDir(), "player.json")
+	content := `{
+		"format": "zrc-player-archive", "version": 1, "schema_version": 4,
+		"player": {
+			"user_id": 7, "user_name": "old", "user_code": 123456789,
+			"is_hide_rating": "t", "is_skill_sealed": "", "is_locked_name_duplicated": null
+		},
+		"tables": {
+			"part_stats": [{"user_id": 7, "part_id": 1, "is_uncapped": "t", "is_uncapped_override": ""}],
+			"data_backup": [
+				{"user_id": 7, "backup_data": "\"version\":{\"val\":1},\"createdAt\":1600000000"},
+				{"user_id": 7, "backup_data": ""}
+			]
+		}
+	}`
+	if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := readPlayerArchive(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, userCode, err := s.importPlayer(archive)
+	if err != nil {
+		t.Fatalf("importPlayer: %v", err)
+	}
+	if userCode != 123456789 {
+		t.Errorf("user code %d, want 123456789", userCode)
+	}
+
+	checks := []struct {
+		table string
+		want  string
+	}{
+		{"player", "is_hide_rating=1 is_locked_name_duplicated=0 is_skill_sealed=0"},
+		{"part_stats", "is_uncapped=1 is_uncapped_override=0"},
+		{"data_backup", `backup_data={"version":{"val":1},"createdAt":1600000000} created_at=1600000000 version=1`},
+	}
+	columns := map[string][]string{
+		"player":      {"is_hide_rating", "is_locked_name_duplicated", "is_skill_sealed"},
+		"part_stats":  {"is_uncapped", "is_uncapped_override"},
+		"data_backup": {"backup_data", "created_at", "version"},
+	}
+	err = s.store.EditRows(func(tx RowTx) error {
+		for _, c := range checks {
+			rows, err := tx.SelectRows(c.table, columns[c.table], map[string]interface{}{"user_id": userID})
+			if err != nil {
+				return err
+			}
+			got := []string{}
+			for _, row := range rows {
+				values := []string{}
+				for _, column := range columns[c.table] {
+					values = append(values, fmt.Sprintf("%s=%s", column, importValueText(row[column])))
+				}
+				got = append(got, strings.Join(values, " "))
+			}
+			if strings.Join(got, "; ") != c.want {
+				t.Errorf("%s rows = %q, want %q", c.table, got, c.want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradeArchive(t *testing.T) {
+	cases := []struct {
+		version, latest int
+		err             string
+	}{
+		{6, 6, ""},
+		{1, 6, ""},
+		{0, 6, "unknown"},
+		{7, 6, "unknown"},
+		{6, 7, "can't be converted"},
+	}
+	for _, c := range cases {
+		archive := &PlayerArchive{SchemaVersion: c.version, Player: archiveRow{}}
+		err := upgradeArchive(archive, c.latest)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("upgradeArchive(%d, %d): %v", c.version, c.latest, err)
+		case c.err == "" && archive.SchemaVersion != c.latest:
+			t.Errorf("upgradeArchive(%d, %d) left schema version %d", c.version, c.latest, archive.SchemaVersion)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("upgradeArchive(%d, %d) returned %v, want error containing %q", c.version, c.latest, err, c.err)
+		}
+	}
+}
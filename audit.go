@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Audit action types. Admin actions are recorded as `admin.<action>`.
+const (
+	auditLogin           = "login"
+	auditLoginFailed     = "login_failed"
+	auditScoreUpload     = "score_upload"
+	auditBackupUpload    = "backup_upload"
+	auditSettingChange   = "setting_change"
+	auditCharacterChange = "character_change"
+	auditAdminPrefix     = "admin."
+)
+
+// AuditEntry is a row of audit log
+type AuditEntry struct {
+	LogID      int64  `json:"log_id"`
+	CreatedAt  int64  `json:"created_at"`
+	Actor      string `json:"actor"`
+	UserID     *int64 `json:"user_id"`
+	Action     string `json:"action"`
+	Detail     string `json:"detail"`
+	RemoteAddr string `json:"remote_addr"`
+	Device     string `json:"device"`
+}
+
+// playerActor names a player as actor of audit log entry.
+func playerActor(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// writeAudit appends an entry to audit log, userID of 0 means action isn't
+// about a specific player. Failing to write audit log never fails the request
+// being audited.
+func (s *Server) writeAudit(r *http.Request, actor string, userID int, action string, detail string) {
+	entry := &AuditEntry{
+		CreatedAt:  time.Now().Unix(),
+		Actor:      actor,
+		Action:     action,
+		Detail:     detail,
+		RemoteAddr: r.RemoteAddr,
+		Device:     r.Header.Get("DeviceId"),
+	}
+	if userID != 0 {
+		user := int64(userID)
+		entry.UserID = &user
+	}
+	if entry.Device == "" {
+		entry.Device = r.Header.Get("User-Agent")
+	}
+	if err := s.store.WriteAudit(entry); err != nil {
+		requestLog(r).Error("Error occured while writing audit log", "action", action, "actor", actor, "err", err)
+	}
+}
+
+// startAuditRetention periodically removes audit log entries older than
+// retention days in config until server is closed.
+func (s *Server) startAuditRetention() {
+	clean := func() {
+		days := s.cfg().AuditRetention
+		if days <= 0 {
+			return
+		}
+		before := time.Now().Add(-time.Duration(days) * 24 * time.Hour).Unix()
+		if count, err := s.store.CleanAudit(before); err != nil {
+			s.log.Error("Error occured while cleaning audit log", "err", err)
+		} else if count > 0 {
+			s.log.Info("Removed expired audit log entries", "count", count)
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		clean()
+		for {
+			select {
+			case <-ticker.C:
+				clean()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// adminQueryAudit lists audit log entries filtered by user_id, action and
+// time range [from, to) in unix seconds, newest first.
+func (s *Server) adminQueryAudit(w http.ResponseWriter, r *http.Request) {
+	data, ok := adminForm(w, r)
+	if !ok {
+		return
+	}
+	filter := AuditFilter{Action: data.Get("action"), Limit: 100, Offset: data.GetInt("offset")}
+	if data.KeyExists("user_id") {
+		id, err := strconv.Atoi(data.Get("user_id"))
+		if err != nil {
+			adminError(w, http.StatusBadRequest, "user_id must be an integer")
+			return
+		}
+		filter.UserID = &id
+	}
+	if data.KeyExists("from") {
+		from := int64(data.GetInt("from"))
+		filter.From = &from
+	}
+	if data.KeyExists("to") {
+		to := int64(data.GetInt("to"))
+		filter.To = &to
+	}
+	if data.KeyExists("limit") {
+		filter.Limit = data.GetInt("limit")
+	}
+
+	entries, err := s.store.QueryAudit(filter)
+	if err != nil {
+		requestLog(r).Error("Error occured while querying audit log", "err", err)
+		adminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	adminOK(w, &AdminResult{"entries": entries})
+}
@@ -7,7 +7,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -15,50 +14,51 @@ import (
 	"github.com/dgrijalva/jwt-go"
 )
 
-// ExpiresTime of JWT token
-var ExpiresTime int64
-
-// SigningKey is secret key used for signing JWT token
-var SigningKey = "Welcome to my personal arcserver"
-
-func init() {
-	duration, _ := time.ParseDuration("240h")
-	ExpiresTime = int64(duration.Seconds())
-}
-
-func loginHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
 	authToken := r.Header.Get("Authorization")
 	user, pwd, err := verifyBasicAuth(authToken)
 	if err != nil {
-		log.Println(err)
+		requestLog(r).Warn("Malformed login request", "err", err)
 		return
 	}
-	hash := fmt.Sprintf("%x", md5.Sum([]byte(pwd)))
-	var (
-		userID  int
-		pwdHash string
-	)
-	err = db.QueryRow(sqlStmtQueryLoginInfo, user).Scan(&userID, &pwdHash)
-	if err == sql.ErrNoRows || hash != pwdHash {
+	userID, ok, err := s.checkPassword(user, pwd)
+	if err != nil {
+		requestLog(r).Error("Error occured while checking password", "err", err)
+		return
+	} else if !ok {
+		s.writeAudit(r, "anonymous", 0, auditLoginFailed, fmt.Sprintf("name=%q", user))
 		http.Error(
 			w, `{"success": false, "error_code": 104}`,
 			http.StatusForbidden,
 		)
 		return
-	} else if err != nil {
-		log.Println(err)
-		return
 	}
 
-	token := LoginToken{genJWT(userID), "Bearer", true, 0}
+	setRequestUser(r, userID)
+	s.writeAudit(r, playerActor(userID), userID, auditLogin, "")
+	token := LoginToken{s.genJWT(userID), "Bearer", true, 0}
 	if res, err := json.Marshal(token); err != nil {
-		log.Println("Error occured while generating JSON for login token.")
-		log.Println(err)
+		requestLog(r).Error("Error occured while generating JSON for login token", "err", err)
 	} else {
 		w.Write(res)
 	}
 }
 
+// checkPassword looks up user by name and tells whether password matches.
+func (s *Server) checkPassword(user string, pwd string) (int, bool, error) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte(pwd)))
+	userID, pwdHash, err := s.store.LoginInfo(user)
+	if err == sql.ErrNoRows {
+		s.metrics.countLogin(false)
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	ok := hash == pwdHash
+	s.metrics.countLogin(ok)
+	return userID, ok, nil
+}
+
 func verifyBasicAuth(authToken string) (string, string, error) {
 	if !strings.HasPrefix(authToken, "Basic ") {
 		return "", "", fmt.Errorf("invalid token string: `%s`", authToken)
@@ -66,7 +66,7 @@ func verifyBasicAuth(authToken string) (string, string, error) {
 	authToken = authToken[6:]
 	tDec, err := base64.StdEncoding.DecodeString(authToken)
 	if err != nil {
-		log.Println(err)
+		stdLog.Warn("Error occured while decoding basic auth token", "err", err)
 	}
 	parts := strings.Split(string(tDec), ":")
 	if len(parts) != 2 {
@@ -76,37 +76,38 @@ func verifyBasicAuth(authToken string) (string, string, error) {
 	return user, pwd, nil
 }
 
-func genJWT(userID int) string {
+func (s *Server) genJWT(userID int) string {
 	claims := userClaims{
 		userID,
 		jwt.StandardClaims{
-			ExpiresAt: time.Now().Unix() + ExpiresTime,
+			ExpiresAt: time.Now().Add(s.cfg().TokenExpires).Unix(),
 			Issuer:    "Zrcaea",
 		},
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(SigningKey))
+	signedToken, err := token.SignedString([]byte(s.cfg().SigningKey))
 	if err != nil {
-		log.Println(err)
+		s.log.Error("Error occured while signing token", "err", err)
 		return ""
 	}
 	return signedToken
 }
 
-func verifyBearerAuth(authToken string) (int, error) {
+func (s *Server) verifyBearerAuth(authToken string) (int, error) {
 	if !strings.HasPrefix(authToken, "Bearer ") {
 		return 0, fmt.Errorf("invalid token string: `%s`", authToken)
 	}
 	authToken = authToken[7:]
+	signingKey := []byte(s.cfg().SigningKey)
 	token, err := jwt.ParseWithClaims(
 		authToken,
 		&userClaims{},
 		func(token *jwt.Token) (interface{}, error) {
-			return []byte(SigningKey), nil
+			return signingKey, nil
 		},
 	)
 	if err != nil {
-		log.Printf("Failed on verifying token `%s`\n", authToken)
+		s.log.Debug("Failed on verifying token", "err", err)
 		return 0, err
 	}
 	claims, ok := token.Claims.(*userClaims)
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// backupScore is an entry in `scores` section of a cloud save. clear_type is
+// kept as pointer so entries without it can fall back to clear lamp.
+type backupScore struct {
+	ScoreRecord
+	ClearType *int8 `json:"clear_type"`
+}
+
+// backupClearLamp is an entry in `clearlamps` section of a cloud save.
+type backupClearLamp struct {
+	SongID     string `json:"song_id"`
+	Difficulty int8   `json:"difficulty"`
+	ClearType  int8   `json:"clear_type"`
+}
+
+// mergeResult counts records processed while merging backup scores.
+type mergeResult struct {
+	Merged  int
+	Skipped int
+}
+
+// parseBackupScores turns `scores` and `clearlamps` sections of backup into
+// score records, clear lamps fill clear type for entries don't carry one.
+func parseBackupScores(backup BackupData) ([]*ScoreRecord, error) {
+	var (
+		scores []backupScore
+		lamps  []backupClearLamp
+	)
+	if err := json.Unmarshal(backup["scores"], &scores); err != nil {
+		return nil, fmt.Errorf("error occured while parsing scores section of backup: %w", err)
+	}
+	if content, ok := backup["clearlamps"]; ok {
+		if err := json.Unmarshal(content, &lamps); err != nil {
+			return nil, fmt.Errorf("error occured while parsing clearlamps section of backup: %w", err)
+		}
+	}
+
+	lampMap := map[string]int8{}
+	for _, lamp := range lamps {
+		lampMap[fmt.Sprintf("%s%d", lamp.SongID, lamp.Difficulty)] = lamp.ClearType
+	}
+
+	records := []*ScoreRecord{}
+	for i := range scores {
+		record := scores[i].ScoreRecord
+		if scores[i].ClearType != nil {
+			record.ClearType = *scores[i].ClearType
+		} else if clearType, ok := lampMap[fmt.Sprintf("%s%d", record.SongID, record.Difficulty)]; ok {
+			record.ClearType = clearType
+		}
+		// newer clients record play time in milliseconds.
+		if record.TimePlayed > 1e11 {
+			record.TimePlayed /= 1000
+		}
+		records = append(records, &record)
+	}
+	return records, nil
+}
+
+// mergeBackupScores inserts plays in backup that server doesn't have yet into
+// SCORE table with their original play time, then updates best scores and
+// player rating accordingly. Recent scores are left untouched.
+func (s *Server) mergeBackupScores(userID int, backup BackupData) (mergeResult, error) {
+	result := mergeResult{}
+	records, err := parseBackupScores(backup)
+	if err != nil {
+		return result, err
+	}
+
+	candidates := []*ScoreRecord{}
+	for _, record := range records {
+		if record.SongID == "" || record.TimePlayed <= 0 {
+			result.Skipped++
+			continue
+		}
+		if err := record.scoreToRating(s.store); err != nil {
+			s.log.Warn("Skip backup score", "song_id", record.SongID, "user_id", userID, "err", err)
+			result.Skipped++
+			continue
+		}
+		candidates = append(candidates, record)
+	}
+
+	err = s.store.UpdateScores(func(tx ScoreTx) error {
+		for _, record := range candidates {
+			if exists, err := tx.ScoreExists(userID, record.TimePlayed); err != nil {
+				return fmt.Errorf("error occured while looking up existing score: %w", err)
+			} else if exists {
+				result.Skipped++
+				continue
+			}
+			if err := insertScoreRecord(tx, userID, record); err != nil {
+				return err
+			}
+			if err := updateBestScore(tx, userID, record); err != nil {
+				return err
+			}
+			result.Merged++
+		}
+
+		if result.Merged > 0 {
+			if _, err := updatePlayerRating(tx, userID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return result, err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// subCommands are offline tasks that run against database instead of starting
+// server, selected by the first command line argument.
+var subCommands = map[string]func(args []string) error{}
+
+// runSubCommand runs sub command named by args[1], returns false when args
+// doesn't name one and server should be started as usual.
+func runSubCommand(args []string) bool {
+	if len(args) < 2 {
+		return false
+	}
+	command, ok := subCommands[args[1]]
+	if !ok {
+		return false
+	}
+	if err := command(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", args[1], err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// subCommandNames lists available sub commands for usage message.
+func subCommandNames() string {
+	names := []string{}
+	for name := range subCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parseCommandFlags parses args of a sub command, whose own flags are
+// defined on commandLine, along with every config option taken by server.
+func parseCommandFlags(commandLine *flag.FlagSet, args []string) (*Config, error) {
+	configFile := addConfigFlags(commandLine)
+	commandLine.Parse(args)
+	return resolveConfig(commandLine, *configFile)
+}
+
+// openCommandDB creates server with config for sub commands, database schema
+// is brought up to date.
+func openCommandDB(config *Config) (*Server, error) {
+	if err := stdLog.configure(config.LogFormat, config.LogLevel); err != nil {
+		return nil, err
+	}
+	return NewServer(config)
+}
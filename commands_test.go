@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseCommandFlags(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, []byte(`{"log_level": "warn", "db": "from-file.db"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configEnvPrefix+"STORAGE", "postgres")
+
+	commandLine := flag.NewFlagSet("export", flag.ContinueOnError)
+	user := commandLine.String("user", "", "")
+	config, err := parseCommandFlags(commandLine, []string{
+		"-config", configFile, "-user", "alice", "-db", "host=localhost dbname=zrc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *user != "alice" {
+		t.Errorf("command flag user = %q, want alice", *user)
+	}
+	if config.LogLevel != "warn" || config.Storage != "postgres" || config.DB != "host=localhost dbname=zrc" {
+		t.Errorf("config log level %q, storage %q, db %q", config.LogLevel, config.Storage, config.DB)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configEnvPrefix prefixes environment variables overriding config options,
+// e.g. ZRC_ADMIN_PASSWORD overrides `admin-password`.
+const configEnvPrefix = "ZRC_"
+
+// Config is effective server configuration. Each option is resolved from, in
+// ascending order of precedence: built-in default, config file, environment
+// variable and command line flag.
+type Config struct {
+	Auth              bool
+	Port              int
+	Host              string
+	Root              string
+	Storage           string
+	DB                string
+	PublicURL         string
+	TLSCert           string
+	TLSKey            string
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+	APIRoot           string
+	StaticUserID      int
+	SigningKey        string
+	TokenExpires      time.Duration
+	DlExpires         time.Duration
+	DlConcurrent      int
+	DlRate            int64
+	AdminUser         string
+	AdminPassword     string
+	AdminPort         string
+	MetricsPort       string
+	AuditRetention    int
+	BackupHistory     int
+	BackupMaxSize     int64
+	LogFormat         string
+	LogLevel          string
+	Dev               bool
+	ScoreCardTemplate string
+	ScorePageTemplate string
+}
+
+// configOption binds a Config field to its name, which is used as flag name,
+// config file key (with `-` replaced by `_`) and environment variable suffix.
+type configOption struct {
+	name   string
+	usage  string
+	secret bool
+	value  interface{}
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:              8080,
+		Host:              "127.0.0.1",
+		Storage:           "sqlite",
+		DB:                "ZrcaeaDB.db",
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      10 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		ShutdownTimeout:   30 * time.Second,
+		APIRoot:           "/zrcaeasv",
+		StaticUserID:      1,
+		SigningKey:        "Welcome to my personal arcserver",
+		TokenExpires:      240 * time.Hour,
+		DlExpires:         15 * time.Minute,
+		DlConcurrent:      4,
+		AdminUser:         "admin",
+		AuditRetention:    180,
+		BackupHistory:     5,
+		BackupMaxSize:     2 << 10,
+		LogFormat:         "logfmt",
+		LogLevel:          "info",
+		ScoreCardTemplate: path.Join("static", "score_lookup", "card_template.html"),
+		ScorePageTemplate: path.Join("static", "score_lookup", "page_template.html"),
+	}
+}
+
+func (c *Config) options() []configOption {
+	return []configOption{
+		{"auth", "Sitch on/off authentication", false, &c.Auth},
+		{"port", "Port number for server.", false, &c.Port},
+		{"host", "Host name for server.", false, &c.Host},
+		{"root", "Root path of server documents.", false, &c.Root},
+		{"storage", "Database backend, sqlite or postgres.", false, &c.Storage},
+		{"db", "SQLite DB file, or PostgreSQL connection string when storage is postgres. Give PostgreSQL password through PGPASSWORD.", false, &c.DB},
+		{"public-url", "Public base URL of server used in generated links, e.g. https://example.com/arc. Defaults to host and port.", false, &c.PublicURL},
+		{"tls-cert", "Certificate file for serving HTTPS.", false, &c.TLSCert},
+		{"tls-key", "Private key file for serving HTTPS.", false, &c.TLSKey},
+		{"read-timeout", "Max duration for reading a request.", false, &c.ReadTimeout},
+		{"write-timeout", "Max duration for writing a response, covering song downloads.", false, &c.WriteTimeout},
+		{"idle-timeout", "Max duration a keep-alive connection stays idle.", false, &c.IdleTimeout},
+		{"shutdown-timeout", "Max duration to wait for in-flight requests on shutdown.", false, &c.ShutdownTimeout},
+		{"api-root", "Leading path of all game API URLs.", false, &c.APIRoot},
+		{"static-user-id", "User ID every request acts as when authentication is off.", false, &c.StaticUserID},
+		{"signing-key", "Secret key for signing login tokens.", true, &c.SigningKey},
+		{"token-expires", "Lifetime of login tokens.", false, &c.TokenExpires},
+		{"dl-expires", "Lifetime of song download links.", false, &c.DlExpires},
+		{"dl-concurrent", "Max number of concurrent song downloads per user, 0 for no limit.", false, &c.DlConcurrent},
+		{"dl-rate", "Bandwidth cap for a single song download in KiB/s, 0 for no limit.", false, &c.DlRate},
+		{"admin-user", "User name for admin API.", false, &c.AdminUser},
+		{"admin-password", "Password for admin API, admin API is disabled when empty.", true, &c.AdminPassword},
+		{"admin-port", "Serve admin API on this port instead of server port.", false, &c.AdminPort},
+		{"metrics-port", "Serve Prometheus metrics at /metrics on this port instead of server port.", false, &c.MetricsPort},
+		{"audit-retention", "Days audit log entries are kept, 0 for keeping forever.", false, &c.AuditRetention},
+		{"backup-history", "Number of backup versions kept for each user, 0 for keeping all.", false, &c.BackupHistory},
+		{"backup-max-size", "Size limit of uploaded backup in KiB.", false, &c.BackupMaxSize},
+		{"log-format", "Format of log entries, logfmt or json.", false, &c.LogFormat},
+		{"log-level", "Lowest level of log entries written, debug, info, warn or error.", false, &c.LogLevel},
+		{"dev", "Development mode, webpage templates are reloaded when changed.", false, &c.Dev},
+		{"score-card-template", "Template file of a score card on score lookup page.", false, &c.ScoreCardTemplate},
+		{"score-page-template", "Template file of score lookup page.", false, &c.ScorePageTemplate},
+	}
+}
+
+// configRun is what server should do after loading configuration.
+type configRun struct {
+	migrateOnly bool
+	printConfig bool
+}
+
+// loadConfig resolves configuration from command line args, config file and
+// environment.
+func loadConfig(args []string) (*Config, configRun, error) {
+	var run configRun
+	commandLine := flag.NewFlagSet(args[0], flag.ExitOnError)
+	commandLine.Usage = func() {
+		fmt.Fprintf(commandLine.Output(), "Usage: %s [command] [flags]\n", args[0])
+		fmt.Fprintf(commandLine.Output(), "Commands: %s\n", subCommandNames())
+		fmt.Fprintf(commandLine.Output(), "Every flag can also be set in config file, or by environment variable %s<FLAG_NAME>.\n", configEnvPrefix)
+		commandLine.PrintDefaults()
+	}
+	configFile := addConfigFlags(commandLine)
+	commandLine.BoolVar(&run.migrateOnly, "migrate-only", false, "Apply database migrations and exit.")
+	commandLine.BoolVar(&run.printConfig, "print-config", false, "Print effective configuration with secrets redacted and exit.")
+	commandLine.Parse(args[1:])
+
+	config, err := resolveConfig(commandLine, *configFile)
+	return config, run, err
+}
+
+// addConfigFlags defines `config` flag and a flag for every option on
+// commandLine, so that sub commands take the same options as server. Returned
+// value is name of config file given.
+func addConfigFlags(commandLine *flag.FlagSet) *string {
+	configFile := commandLine.String("config", os.Getenv(configEnvPrefix+"CONFIG"), "JSON config file to read.")
+	flagValues := defaultConfig()
+	for _, opt := range flagValues.options() {
+		switch v := opt.value.(type) {
+		case *bool:
+			commandLine.BoolVar(v, opt.name, *v, opt.usage)
+		case *int:
+			commandLine.IntVar(v, opt.name, *v, opt.usage)
+		case *int64:
+			commandLine.Int64Var(v, opt.name, *v, opt.usage)
+		case *string:
+			commandLine.StringVar(v, opt.name, *v, opt.usage)
+		case *time.Duration:
+			commandLine.DurationVar(v, opt.name, *v, opt.usage)
+		}
+	}
+	return configFile
+}
+
+// resolveConfig reads config file and environment on top of defaults, then
+// applies option flags set on parsed commandLine.
+func resolveConfig(commandLine *flag.FlagSet, configFile string) (*Config, error) {
+	config := defaultConfig()
+	if configFile != "" {
+		if err := config.readFile(configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.readEnv(); err != nil {
+		return nil, err
+	}
+
+	options := map[string]configOption{}
+	for _, opt := range config.options() {
+		options[opt.name] = opt
+	}
+	var err error
+	commandLine.Visit(func(f *flag.Flag) {
+		if opt, ok := options[f.Name]; ok && err == nil {
+			err = setConfigOption(opt, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return config, config.validate()
+}
+
+// readFile reads options from JSON config file, unknown keys are rejected so
+// that typos don't go unnoticed.
+func (c *Config) readFile(fileName string) error {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return fmt.Errorf("can't read config file: %w", err)
+	}
+	values := map[string]json.RawMessage{}
+	if err := json.Unmarshal(content, &values); err != nil {
+		return fmt.Errorf("invalid config file `%s`: %w", fileName, err)
+	}
+
+	options := map[string]configOption{}
+	for _, opt := range c.options() {
+		options[strings.ReplaceAll(opt.name, "-", "_")] = opt
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		opt, ok := options[key]
+		if !ok {
+			return fmt.Errorf("config file `%s`: unknown option `%s`", fileName, key)
+		}
+		raw := bytes.TrimSpace(values[key])
+		if d, ok := opt.value.(*time.Duration); ok {
+			// durations are written as strings like "15m"
+			var s string
+			if err = json.Unmarshal(raw, &s); err == nil {
+				*d, err = time.ParseDuration(s)
+			}
+		} else {
+			err = json.Unmarshal(raw, opt.value)
+		}
+		if err != nil {
+			return fmt.Errorf("config file `%s`: invalid value %s for option `%s`: %s", fileName, raw, key, err)
+		}
+	}
+	return nil
+}
+
+// readEnv overrides options set by environment variables.
+func (c *Config) readEnv() error {
+	for _, opt := range c.options() {
+		name := configEnvPrefix + strings.ToUpper(strings.ReplaceAll(opt.name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setConfigOption(opt, value); err != nil {
+			return fmt.Errorf("environment variable %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setConfigOption(opt configOption, value string) error {
+	var err error
+	switch v := opt.value.(type) {
+	case *bool:
+		*v, err = strconv.ParseBool(value)
+	case *int:
+		*v, err = strconv.Atoi(value)
+	case *int64:
+		*v, err = strconv.ParseInt(value, 10, 64)
+	case *string:
+		*v = value
+	case *time.Duration:
+		*v, err = time.ParseDuration(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value `%s` for option `%s`", value, opt.name)
+	}
+	return nil
+}
+
+// validate reports every invalid option at once.
+func (c *Config) validate() error {
+	problems := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.Port > 0 && c.Port < 65536, "port must be between 1 and 65535, got %d", c.Port)
+	check(c.Host != "", "host can't be empty")
+	_, ok := storeBackends[c.Storage]
+	check(ok, "storage must be one of %s, got `%s`", storeBackendNames(), c.Storage)
+	check(c.DB != "", "db can't be empty")
+	check((c.TLSCert == "") == (c.TLSKey == ""), "both tls-cert and tls-key are needed for serving HTTPS")
+	check(c.ReadTimeout >= 0, "read-timeout can't be negative, got %s", c.ReadTimeout)
+	check(c.WriteTimeout >= 0, "write-timeout can't be negative, got %s", c.WriteTimeout)
+	check(c.IdleTimeout >= 0, "idle-timeout can't be negative, got %s", c.IdleTimeout)
+	check(c.ShutdownTimeout > 0, "shutdown-timeout must be positive, got %s", c.ShutdownTimeout)
+	check(strings.HasPrefix(c.APIRoot, "/"), "api-root must start with `/`, got `%s`", c.APIRoot)
+	check(c.StaticUserID > 0, "static-user-id must be positive, got %d", c.StaticUserID)
+	check(c.SigningKey != "", "signing-key can't be empty")
+	check(c.TokenExpires > 0, "token-expires must be positive, got %s", c.TokenExpires)
+	check(c.DlExpires > 0, "dl-expires must be positive, got %s", c.DlExpires)
+	check(c.DlConcurrent >= 0, "dl-concurrent can't be negative, got %d", c.DlConcurrent)
+	check(c.DlRate >= 0, "dl-rate can't be negative, got %d", c.DlRate)
+	check(c.AdminPassword == "" || c.AdminUser != "", "admin-user can't be empty when admin-password is set")
+	if c.AdminPort != "" {
+		port, err := strconv.Atoi(c.AdminPort)
+		check(err == nil && port > 0 && port < 65536, "admin-port must be a port number, got `%s`", c.AdminPort)
+	}
+	if c.MetricsPort != "" {
+		port, err := strconv.Atoi(c.MetricsPort)
+		check(err == nil && port > 0 && port < 65536, "metrics-port must be a port number, got `%s`", c.MetricsPort)
+	}
+	check(c.AuditRetention >= 0, "audit-retention can't be negative, got %d", c.AuditRetention)
+	check(c.BackupHistory >= 0, "backup-history can't be negative, got %d", c.BackupHistory)
+	check(c.BackupMaxSize > 0, "backup-max-size must be positive, got %d", c.BackupMaxSize)
+	_, levelOK := logLevelNames[c.LogLevel]
+	check(levelOK, "log-level must be one of %s, got `%s`", logLevelNamesList(), c.LogLevel)
+	check(c.LogFormat == "logfmt" || c.LogFormat == "json", "log-format must be one of %s, got `%s`", strings.Join(logFormats, ", "), c.LogFormat)
+	check(c.ScoreCardTemplate != "", "score-card-template can't be empty")
+	check(c.ScorePageTemplate != "", "score-page-template can't be empty")
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n\t" + strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// redacted returns config as a JSON object in config file format, with values
+// of secret options replaced.
+func (c *Config) redacted() string {
+	values := map[string]interface{}{}
+	for _, opt := range c.options() {
+		key := strings.ReplaceAll(opt.name, "-", "_")
+		switch v := opt.value.(type) {
+		case *string:
+			if opt.secret && *v != "" {
+				values[key] = "<redacted>"
+			} else {
+				values[key] = *v
+			}
+		case *time.Duration:
+			values[key] = v.String()
+		case *bool:
+			values[key] = *v
+		case *int:
+			values[key] = *v
+		case *int64:
+			values[key] = *v
+		}
+	}
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "\t")
+	encoder.Encode(values)
+	return strings.TrimSpace(buf.String())
+}
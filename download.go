@@ -1,61 +1,40 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"path"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/albrow/forms"
 )
 
-// AuthFileServer is a wrapper for FilerServer handler, add athentication support
-type AuthFileServer struct {
-	authenticator func(http.ResponseWriter, *http.Request) bool
-	fileServer    http.Handler
-}
-
-func (f *AuthFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if f.authenticator(w, r) {
-		f.fileServer.ServeHTTP(w, r)
-	} else {
-		http.Error(w, "Authentication Failed", http.StatusForbidden)
-	}
-}
-
-// DlExpiresTime is duration before a download request expires.
-var DlExpiresTime float64
-
-// LastDlListCheck record time of last expired request cleaning
-var LastDlListCheck time.Time
-
-func init() {
-	duration, _ := time.ParseDuration("15m")
-	DlExpiresTime = duration.Seconds()
-	LastDlListCheck = time.Now()
-}
-
-func songDownloadHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) songDownloadHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		userID int
 		err    error
 	)
-	if NeedAuth {
-		userID, err = verifyBearerAuth(r.Header.Get("Authorization"))
+	if s.cfg().Auth {
+		userID, err = s.verifyBearerAuth(r.Header.Get("Authorization"))
 		if err != nil {
 			c := Container{false, nil, 203}
 			http.Error(w, c.toJSON(), http.StatusUnauthorized)
 			return
 		}
 	} else {
-		userID = staticUserID
+		userID = s.cfg().StaticUserID
 	}
-	tojson, err := getDownloadList(userID, r)
+	setRequestUser(r, userID)
+	tojson, err := s.getDownloadList(userID, r)
 	container := Container{false, nil, 0}
 	if err != nil {
-		log.Println(err)
+		requestLog(r).Error("Error occured while getting download list", "err", err)
 	} else {
 		container.Success = true
 		container.Value = tojson
@@ -63,10 +42,9 @@ func songDownloadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getDownloadList(userID int, r *http.Request) (ToJSON, error) {
+func (s *Server) getDownloadList(userID int, r *http.Request) (ToJSON, error) {
 	data, err := forms.Parse(r)
 	if err != nil {
-		log.Println("Error occured while parsing form(s) fot getting download list")
 		return nil, err
 	}
 	needURL := data.GetBool("url")
@@ -74,76 +52,33 @@ func getDownloadList(userID int, r *http.Request) (ToJSON, error) {
 	if data.KeyExists("sid") {
 		songs = data.Values["sid"]
 	}
-	checksums, err := getPurchaseDL(userID, songs, needURL)
+	checksums, err := s.getPurchaseDL(userID, songs, needURL)
 	if err != nil {
 		return nil, err
 	}
 	return (*CheckSumContainer)(&checksums), nil
 }
 
-func getPurchaseDL(userID int, songs []string, needURL bool) (map[string]*Checksum, error) {
-	songIDCondition := ""
-	checksums := map[string]*Checksum{}
-	if len(songs) > 0 {
-		for i := range songs {
-			songs[i] = "'" + songs[i] + "'"
-		}
-		songIDCondition = fmt.Sprintf("and song.song_id in (%s)", strings.Join(songs, ", "))
-	}
-	if err := getPurchaseFromTable(
-		userID, "pack_purchase_info pur", "pur.pack_name = song.pack_name",
-		checksums, songIDCondition, needURL,
-	); err != nil {
-		return nil, err
-	}
-	if err := getPurchaseFromTable(
-		userID, "single_purchase_info pur", "pur.song_id = song.song_id",
-		checksums, songIDCondition, needURL,
-	); err != nil {
-		return nil, err
-	}
-
-	return checksums, nil
-}
-
-type dlInfo struct {
-	songID        string
-	audioChecksum string
-	songDL        string
-	difficulty    string
-	chartChecksum string
-	chartDL       string
-}
-
-func getPurchaseFromTable(userID int, tableName string, condition string, checksums map[string]*Checksum, songIDCondition string, needURL bool) error {
-	stmt := fmt.Sprintf(sqlStmtQueryDLInfo, tableName, condition, songIDCondition)
-	rows, err := db.Query(stmt, userID)
+func (s *Server) getPurchaseDL(userID int, songs []string, needURL bool) (map[string]*Checksum, error) {
+	infoes, err := s.store.PurchasedDownloads(userID, songs)
 	if err != nil {
-		return fmt.Errorf(
-			"Error occured while querying table %v for download list: %w",
-			tableName, err,
-		)
+		return nil, err
 	}
-	defer rows.Close()
 
-	info := new(dlInfo)
-	for rows.Next() {
-		rows.Scan(
-			&info.songID, &info.audioChecksum, &info.songDL,
-			&info.difficulty, &info.chartChecksum, &info.chartDL,
-		)
-		if info.songDL == "t" {
+	checksums := map[string]*Checksum{}
+	for _, info := range infoes {
+		if info.songDL {
 			var item *Checksum = nil
 			if item = checksums[info.songID]; item == nil {
 				item = new(Checksum)
 			}
 			item.Audio = map[string]string{"checksum": info.audioChecksum}
 			if needURL {
-				item.Audio["url"] = "http://" + path.Join(HostName, fileServerPrefix, info.songID, "base.ogg")
+				item.Audio["url"] = s.downloadLink(userID, info.songID, "base.ogg")
 			}
 			checksums[info.songID] = item
 		}
-		if info.chartDL == "t" {
+		if info.chartDL {
 			var item *Checksum = nil
 			if item = checksums[info.songID]; item == nil {
 				item = new(Checksum)
@@ -153,87 +88,74 @@ func getPurchaseFromTable(userID int, tableName string, condition string, checks
 			}
 			if needURL {
 				filename := info.difficulty + ".aff"
-				item.Chart[info.difficulty]["url"] = "http://" + path.Join(HostName, fileServerPrefix, info.songID, filename)
+				item.Chart[info.difficulty]["url"] = s.downloadLink(userID, info.songID, filename)
 			}
 			checksums[info.songID] = item
 		}
 	}
+	return checksums, nil
+}
 
-	if err = rows.Err(); err != nil {
-		return fmt.Errorf(
-			"Error occured while reading quiried dl info rows from %v: %w",
-			tableName, err,
-		)
-	}
-	return nil
+// dlInfo is a downloadable chart of a purchased song, songDL and chartDL tell
+// whether audio and chart are served remotely.
+type dlInfo struct {
+	songID        string
+	audioChecksum string
+	songDL        bool
+	difficulty    string
+	chartChecksum string
+	chartDL       bool
 }
 
-func fileServerWithAuth(fileServer http.Handler) http.Handler {
-	return &AuthFileServer{authenAndClean, fileServer}
+// downloadLink returns URL of a song file for user, signed with signing key
+// and valid for dl-expires.
+func (s *Server) downloadLink(userID int, songID string, fileName string) string {
+	expires := time.Now().Add(s.cfg().DlExpires).Unix()
+	query := url.Values{}
+	query.Set("uid", strconv.Itoa(userID))
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", s.downloadSignature(path.Join(fileServerPrefix, songID, fileName), userID, expires))
+	return s.publicLink(fileServerPrefix, songID, fileName) + "?" + query.Encode()
 }
 
-func authenAndClean(w http.ResponseWriter, r *http.Request) bool {
-	// var now time.Time
-	// if now = time.Now(); now.Sub(LastDlListCheck).Seconds() > DlExpiresTime {
-	// 	_, err := db.Exec(
-	// 		`delete from dl_request where request_time < ?`,
-	// 		now.Unix()-int64(DlExpiresTime),
-	// 	)
-	// 	if err != nil {
-	// 		log.Println("Error occured while cleaning download request")
-	// 		log.Println(err)
-	// 		return false
-	// 	}
-	// 	LastDlListCheck = now
-	// }
-	// data, err := forms.Parse(r)
-	// if err != nil {
-	// 	log.Println(err)
-	// 	return false
-	// }
-	// val := data.Validator()
-	// val.Require("user_id")
-	// val.Require("song_id")
-	// val.Require("time")
-	// if val.HasErrors() {
-	// 	log.Println("form passed lacks of necessary key")
-	// 	for k, v := range val.ErrorMap() {
-	// 		fmt.Printf("%s: %s\n", k, v)
-	// 	}
-	// 	return false
-	// }
-	// userID := data.GetInt("user_id")
-	// songID := data.Get("song_id")
-	// requestTime, err := strconv.ParseInt(data.Get("time"), 10, 64)
-	// if err != nil {
-	// 	log.Println("Invalid time in request form")
-	// 	return false
-	// } else if now.Unix()-requestTime > int64(DlExpiresTime) {
-	// 	return false
-	// }
-	// err = db.QueryRow(`select
-	// 		user_id
-	// 	from
-	// 		dl_request
-	// 	where
-	// 		user_id = ?1 and song_id = ?2 and request_time = ?3`,
-	// 	userID, songID, requestTime,
-	// ).Scan(&userID)
-	// if err != nil {
-	// 	log.Println("Erorr occured while looking up request in table DL_REQUEST")
-	// 	log.Println(err)
-	// 	return false
-	// }
+func (s *Server) downloadSignature(filePath string, userID int, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(s.cfg().SigningKey))
+	fmt.Fprintf(mac, "%s\n%d\n%d", filePath, userID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyDownload checks request of song file is made with a link given by
+// downloadLink which hasn't expired, and returns user the link is for.
+func (s *Server) verifyDownload(r *http.Request) (int, error) {
+	query := r.URL.Query()
+	userID, err := strconv.Atoi(query.Get("uid"))
+	if err != nil {
+		return 0, errors.New("download link carries no user")
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return 0, errors.New("download link carries no expiry time")
+	}
+	expected := s.downloadSignature(r.URL.Path, userID, expires)
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(expected)) {
+		return 0, errors.New("download link has invalid signature")
+	}
+	if time.Now().Unix() > expires {
+		return 0, errors.New("download link has expired")
+	}
+	return userID, nil
+}
 
-	// _, err = db.Exec(`delete from dl_request
-	// 	where
-	// 		user_id = ?1 and song_id = ?2 and request_time = ?3`,
-	// 	userID, songID, requestTime,
-	// )
-	// if err != nil {
-	// 	log.Println("Erorr occured while deleting request in table DL_REQUEST")
-	// 	log.Println(err)
-	// 	return false
-	// }
-	return true
+// downloadAuth only lets requests made with valid download links through.
+func (s *Server) downloadAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := s.verifyDownload(r)
+		if err != nil {
+			requestLog(r).Debug("Download rejected", "err", err)
+			http.Error(w, "Authentication Failed", http.StatusForbidden)
+			return
+		}
+		setRequestUser(r, userID)
+		next.ServeHTTP(w, r)
+	})
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestPurchaseDLQuotedSongIDs makes sure song IDs from client are only ever
+// compared as values, whatever quotes and SQL they contain.
+func TestPurchaseDLQuotedSongIDs(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	cases := []struct {
+		name  string
+		songs []string
+		want  []string
+	}{
+		{"no filter", nil, []string{"beta"}},
+		{"purchased", []string{"beta"}, []string{"beta"}},
+		{"not purchased", []string{"alpha"}, []string{}},
+		{"quote breaking out of IN list", []string{"x') or ('1' = '1"}, []string{}},
+		{"comment after quote", []string{"beta' --"}, []string{}},
+		{"double quote", []string{`beta" or "1" = "1`}, []string{}},
+		{"valid along with injected", []string{"beta", "alpha') or 1 = 1 --"}, []string{"beta"}},
+		{
+			"union",
+			[]string{"') union select song_id, checksum, 1, '2', checksum, 1 from song --"},
+			[]string{},
+		},
+		{"drop table", []string{"'); drop table song; --"}, []string{}},
+	}
+	for _, c := range cases {
+		checksums, err := s.getPurchaseDL(1, c.songs, false)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		got := []string{}
+		for songID := range checksums {
+			got = append(got, songID)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: getPurchaseDL(%q) lists %v, want %v", c.name, c.songs, got, c.want)
+		}
+	}
+
+	if _, err := s.store.SongChecksum("beta"); err != nil {
+		t.Errorf("song table is damaged: %v", err)
+	}
+}
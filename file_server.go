@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DlCacheMaxAge is how long clients may cache a downloaded song file.
+var DlCacheMaxAge = 7 * 24 * time.Hour
+
+// songContentTypes maps song file extensions to their content type, so that
+// clients don't get a sniffed `application/octet-stream` for charts.
+var songContentTypes = map[string]string{
+	".ogg": "audio/ogg",
+	".aff": "text/plain; charset=utf-8",
+	".jpg": "image/jpeg",
+}
+
+// songFileServer serves files under static songs directory with support for
+// range requests, checksum based ETag and per-user download limits.
+type songFileServer struct {
+	server *Server
+	root   http.FileSystem
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func (s *Server) newSongFileServer(root string) *songFileServer {
+	return &songFileServer{
+		server: s,
+		root:   http.Dir(root),
+		active: map[string]int{},
+	}
+}
+
+func (s *songFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filePath := path.Clean("/" + r.URL.Path)
+
+	file, err := s.root.Open(filePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	user := s.server.downloadUserKey(r)
+	if !s.acquire(user) {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Too many concurrent downloads", http.StatusTooManyRequests)
+		return
+	}
+	defer s.release(user)
+
+	header := w.Header()
+	if contentType, ok := songContentTypes[path.Ext(filePath)]; ok {
+		header.Set("Content-Type", contentType)
+	}
+	if etag := s.server.songFileETag(filePath, stat); etag != "" {
+		header.Set("ETag", etag)
+	}
+	header.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(DlCacheMaxAge.Seconds())))
+
+	var writer http.ResponseWriter = &countingWriter{w, s.server.metrics.downloadBytes}
+	if rate := s.server.cfg().DlRate * 1024; rate > 0 {
+		writer = newThrottledWriter(writer, rate)
+	}
+	// ServeContent takes care of Range, If-Range and If-None-Match with the
+	// headers set above.
+	http.ServeContent(writer, r, stat.Name(), stat.ModTime(), file)
+}
+
+func (s *songFileServer) acquire(user string) bool {
+	limit := s.server.cfg().DlConcurrent
+	if limit <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[user] >= limit {
+		return false
+	}
+	s.active[user]++
+	return true
+}
+
+func (s *songFileServer) release(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.active[user]; !ok {
+		// acquired while there was no limit
+		return
+	}
+	if s.active[user]--; s.active[user] <= 0 {
+		delete(s.active, user)
+	}
+}
+
+// downloadUserKey identifies the user a download request belongs to, which
+// is user its download link is signed for, as checked by downloadAuth.
+func (s *Server) downloadUserKey(r *http.Request) string {
+	return r.URL.Query().Get("uid")
+}
+
+// songFileETag returns strong ETag made from checksum stored in database for
+// audio and chart files, other files get a weak one made from size and
+// modification time.
+func (s *Server) songFileETag(filePath string, stat os.FileInfo) string {
+	songID := path.Base(path.Dir(filePath))
+	name := path.Base(filePath)
+
+	var (
+		checksum string
+		err      error
+	)
+	switch ext := path.Ext(name); {
+	case name == "base.ogg":
+		checksum, err = s.store.SongChecksum(songID)
+	case ext == ".aff":
+		difficulty, convErr := strconv.Atoi(strings.TrimSuffix(name, ext))
+		if convErr != nil {
+			break
+		}
+		checksum, err = s.store.ChartChecksum(songID, difficulty)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		s.log.Error("Error occured while querying checksum", "file", filePath, "err", err)
+	}
+
+	if checksum != "" {
+		return strconv.Quote(checksum)
+	}
+	return fmt.Sprintf(`W/"%x-%x"`, stat.Size(), stat.ModTime().Unix())
+}
+
+// throttledWriter limits speed of writing response body to rate bytes per
+// second.
+type throttledWriter struct {
+	http.ResponseWriter
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func newThrottledWriter(w http.ResponseWriter, rate int64) *throttledWriter {
+	return &throttledWriter{ResponseWriter: w, rate: rate, start: time.Now()}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	// write in chunks of roughly 100ms worth of data so that the cap holds
+	// for large buffers handed over by io.Copy.
+	chunkSize := int(t.rate / 10)
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	total := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = p[:chunkSize]
+		}
+		n, err := t.ResponseWriter.Write(chunk)
+		total += n
+		t.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+
+		expected := time.Duration(float64(t.written) / float64(t.rate) * float64(time.Second))
+		if wait := expected - time.Since(t.start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return total, nil
+}
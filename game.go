@@ -2,71 +2,39 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net/http"
+	"time"
 )
 
-func gameInfoHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) gameInfoHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		userID int
 		err    error
 	)
-	if NeedAuth {
-		userID, err = verifyBearerAuth(r.Header.Get("Authorization"))
+	if s.cfg().Auth {
+		userID, err = s.verifyBearerAuth(r.Header.Get("Authorization"))
 		if err != nil {
 			c := Container{false, nil, 203}
 			http.Error(w, c.toJSON(), http.StatusUnauthorized)
 			return
 		}
 	} else {
-		userID = staticUserID
+		userID = s.cfg().StaticUserID
 	}
-	tojson, err := getGameInfo(userID, r)
+	setRequestUser(r, userID)
+	tojson, err := s.getGameInfo(userID, r)
 	if err != nil {
-		log.Println(err)
+		requestLog(r).Error("Error occured while getting game info", "err", err)
 	} else {
 		fmt.Fprint(w, tojson.toJSON())
 	}
 }
 
-func getGameInfo(_ int, _ *http.Request) (ToJSON, error) {
-	var (
-		worldRankingEnabled  string
-		isBydChapterUnlocked string
-	)
-	info := new(GameInfo)
-	err := db.QueryRow(slqStmtGameInfo).Scan(
-		&info.Now,
-		&info.MaxStam,
-		&info.StaminaRecoverTick,
-		&info.CoreExp,
-		&worldRankingEnabled,
-		&isBydChapterUnlocked,
-	)
+func (s *Server) getGameInfo(_ int, _ *http.Request) (ToJSON, error) {
+	info, err := s.store.GameInfo()
 	if err != nil {
-		log.Println("Error occured while querying GAME_INFO")
 		return nil, err
 	}
-	levelsteps := []levelStep{}
-	rows, err := db.Query(sqlStmtLevelStep)
-	if err != nil {
-		return nil, fmt.Errorf("Error occured while querying table LEVEL_EXP: %w", err)
-	}
-	defer rows.Close()
-
-	step := new(levelStep)
-	for rows.Next() {
-		rows.Scan(&step.Lv, &step.Exp)
-		levelsteps = append(levelsteps, *step)
-	}
-	if err := rows.Err(); err != nil {
-		log.Println("Error occured while reading rows from LEVEL_EXP")
-		return nil, err
-	}
-
-	info.WorldRankingEnabled = worldRankingEnabled == "t"
-	info.BydUnlocked = isBydChapterUnlocked == "t"
-	info.LevelSteps = levelsteps
-
+	info.Now = time.Now().Unix()
 	return info, nil
 }
@@ -1,10 +1,26 @@
 module zrc_server
 
-go 1.14
+go 1.19
 
 require (
 	github.com/albrow/forms v0.3.3
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gorilla/mux v1.7.4
+	github.com/lib/pq v1.9.0
 	github.com/mattn/go-sqlite3 v1.10.0
+	github.com/prometheus/client_golang v1.11.1
+	golang.org/x/image v0.18.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.26.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
+	golang.org/x/sys v0.0.0-20210603081109-ebe580a85c40 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	google.golang.org/protobuf v1.26.0-rc.1 // indirect
 )
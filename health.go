@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Build information, set at build time with e.g.
+//
+//	go build -ldflags "-X main.buildVersion=v1.2.0 -X main.buildCommit=$(git rev-parse HEAD)"
+//
+// When they're not set, version and VCS revision recorded by Go are reported.
+var (
+	buildVersion string
+	buildCommit  string
+)
+
+// probePaths are requested often by process supervisors and metrics
+// scrapers, requests to them are only logged at debug level.
+var probePaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/version": true,
+	"/metrics": true,
+}
+
+const readyTimeout = 3 * time.Second
+
+// VersionInfo tells which build of server is running.
+type VersionInfo struct {
+	Version         string `json:"version"`
+	Commit          string `json:"commit"`
+	GoVersion       string `json:"go_version"`
+	SchemaVersion   int    `json:"schema_version"`
+	DBSchemaVersion *int   `json:"db_schema_version,omitempty"`
+}
+
+// ReadyResult lists result of each readiness check, "ok" or error message.
+type ReadyResult struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+func (s *Server) setHealthRouting(router *mux.Router) {
+	router.Path("/healthz").Methods("GET", "HEAD").HandlerFunc(healthHandler)
+	router.Path("/readyz").Methods("GET", "HEAD").HandlerFunc(s.readyHandler)
+	router.Path("/version").Methods("GET").HandlerFunc(s.versionHandler)
+}
+
+// healthHandler tells process is up and serving requests.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyHandler tells whether server can handle game requests, it responds
+// with 503 when any check fails.
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	result := &ReadyResult{Ready: true, Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			result.Ready = false
+			result.Checks[name] = err.Error()
+			requestLog(r).Warn("Readiness check failed", "check", name, "err", err)
+		} else {
+			result.Checks[name] = "ok"
+		}
+	}
+	check("database", s.store.Ping(ctx))
+	check("templates", s.checkTemplates())
+	check("migrations", s.checkMigrations())
+	check("songs", s.checkSongsDir())
+
+	status := http.StatusOK
+	if !result.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealthJSON(w, status, result)
+}
+
+func (s *Server) versionHandler(w http.ResponseWriter, r *http.Request) {
+	info := &VersionInfo{
+		Version:       buildVersion,
+		Commit:        buildCommit,
+		GoVersion:     runtime.Version(),
+		SchemaVersion: latestSchemaVersion(s.cfg().Storage),
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = build.Main.Version
+		}
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" && info.Commit == "" {
+				info.Commit = setting.Value
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "unknown"
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if version, err := s.store.SchemaVersion(); err == nil {
+		info.DBSchemaVersion = &version
+	} else {
+		requestLog(r).Error("Error occured while reading schema version", "err", err)
+	}
+	writeHealthJSON(w, http.StatusOK, info)
+}
+
+// checkTemplates makes sure score lookup and portal page templates have been
+// loaded.
+func (s *Server) checkTemplates() error {
+	s.scoreTemplate.Lock()
+	loaded := s.scoreTemplate.tmpl != nil
+	s.scoreTemplate.Unlock()
+	if !loaded {
+		return fmt.Errorf("score lookup templates are not loaded")
+	}
+	if len(portalTemplates) == 0 {
+		return fmt.Errorf("portal templates are not loaded")
+	}
+	return nil
+}
+
+// checkMigrations makes sure database schema is at version this build
+// expects.
+func (s *Server) checkMigrations() error {
+	version, err := s.store.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if expected := latestSchemaVersion(s.cfg().Storage); version != expected {
+		return fmt.Errorf("schema version is %d, expected %d", version, expected)
+	}
+	return nil
+}
+
+// checkSongsDir makes sure static songs directory can be listed.
+func (s *Server) checkSongsDir() error {
+	dir, err := os.Open(s.rootPath("static", "songs"))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func writeHealthJSON(w http.ResponseWriter, status int, value interface{}) {
+	res, err := json.Marshal(value)
+	if err != nil {
+		stdLog.Error("Error occured while generating JSON", "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(res)
+}
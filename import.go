@@ -0,0 +1,637 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	subCommands["import"] = importCommand
+}
+
+// errDryRun rolls back changes made by import in dry run.
+var errDryRun = errors.New("dry run")
+
+// Section: Static data file formats
+// ============================================================================
+
+type songlistFile struct {
+	Songs []songlistEntry `json:"songs"`
+}
+
+type songlistEntry struct {
+	ID             string               `json:"id"`
+	TitleLocalized map[string]string    `json:"title_localized"`
+	Set            string               `json:"set"`
+	Checksum       string               `json:"checksum"`
+	RemoteDL       bool                 `json:"remote_dl"`
+	Difficulties   []songlistDifficulty `json:"difficulties"`
+}
+
+type songlistDifficulty struct {
+	RatingClass int      `json:"ratingClass"`
+	Rating      float64  `json:"rating"`
+	Constant    *float64 `json:"constant"`
+	Checksum    string   `json:"checksum"`
+	RemoteDL    bool     `json:"remote_dl"`
+}
+
+type packlistFile struct {
+	Packs []packlistEntry `json:"packs"`
+}
+
+type packlistEntry struct {
+	ID           string         `json:"id"`
+	Price        int            `json:"price"`
+	OrigPrice    int            `json:"orig_price"`
+	DiscountFrom int64          `json:"discount_from"`
+	DiscountTo   int64          `json:"discount_to"`
+	Items        []packlistItem `json:"items"`
+}
+
+type packlistItem struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	IsAvailable *bool  `json:"is_available"`
+}
+
+type partnerFile struct {
+	Partners []partnerEntry `json:"partners"`
+}
+
+type partnerEntry struct {
+	PartID             int    `json:"part_id"`
+	PartName           string `json:"part_name"`
+	CharType           int    `json:"char_type"`
+	SkillID            string `json:"skill_id"`
+	SkillIDUncap       string `json:"skill_id_uncap"`
+	SkillRequiresUncap bool   `json:"skill_requires_uncap"`
+	SkillUnlockLevel   int    `json:"skill_unlock_level"`
+	HasVoice           bool   `json:"has_voice"`
+}
+
+type mapFile struct {
+	MapID              string    `json:"map_id"`
+	Chapter            int       `json:"chapter"`
+	AvailableFrom      int64     `json:"available_from"`
+	AvailableTo        int64     `json:"available_to"`
+	IsRepeatable       bool      `json:"is_repeatable"`
+	IsBeyond           bool      `json:"is_beyond"`
+	IsLegacy           bool      `json:"is_legacy"`
+	RequireID          string    `json:"require_id"`
+	RequireType        string    `json:"require_type"`
+	RequireValue       int       `json:"require_value"`
+	Coordinate         string    `json:"coordinate"`
+	StaminaCost        int       `json:"stamina_cost"`
+	BeyondHealth       int       `json:"beyond_health"`
+	CustomBG           string    `json:"custom_bg"`
+	CharacterAffinity  []int     `json:"character_affinity"`
+	AffinityMultiplier []float64 `json:"affinity_multiplier"`
+	Steps              []mapStep `json:"steps"`
+}
+
+type mapStep struct {
+	Position int           `json:"position"`
+	Capture  int           `json:"capture"`
+	Items    []mapStepItem `json:"items"`
+}
+
+type mapStepItem struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Amount int    `json:"amount"`
+}
+
+// staticData is everything read from import files.
+type staticData struct {
+	songs    []songlistEntry
+	packs    []packlistEntry
+	partners []partnerEntry
+	maps     []mapFile
+}
+
+// Section: Import command
+// ============================================================================
+
+func importCommand(args []string) error {
+	commandLine := flag.NewFlagSet(args[0], flag.ExitOnError)
+	songlist := commandLine.String("songlist", "", "songlist JSON file.")
+	packlist := commandLine.String("packlist", "", "packlist JSON file.")
+	partners := commandLine.String("partners", "", "Partner JSON or CSV file.")
+	maps := commandLine.String("maps", "", "World map JSON file, or directory containing them.")
+	dryRun := commandLine.Bool("dry-run", false, "Print changes without writing them.")
+	config, err := parseCommandFlags(commandLine, args[1:])
+	if err != nil {
+		return err
+	}
+
+	data, err := readStaticData(*songlist, *packlist, *partners, *maps)
+	if err != nil {
+		return err
+	}
+	s, err := openCommandDB(config)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	changes := 0
+	err = s.store.EditRows(func(tx RowTx) error {
+		if err := validateStaticData(tx, data); err != nil {
+			return err
+		}
+		for _, table := range data.tables() {
+			count, err := table.apply(tx, os.Stdout)
+			if err != nil {
+				return err
+			}
+			changes += count
+		}
+		if *dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		fmt.Printf("%d change(s), dry run, nothing written.\n", changes)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("%d change(s) written.\n", changes)
+	return nil
+}
+
+func readStaticData(songlist, packlist, partners, maps string) (*staticData, error) {
+	data := new(staticData)
+	if songlist != "" {
+		file := songlistFile{}
+		if err := readJSONFile(songlist, &file); err != nil {
+			return nil, err
+		}
+		data.songs = file.Songs
+	}
+	if packlist != "" {
+		file := packlistFile{}
+		if err := readJSONFile(packlist, &file); err != nil {
+			return nil, err
+		}
+		data.packs = file.Packs
+	}
+	if partners != "" {
+		var err error
+		if strings.EqualFold(filepath.Ext(partners), ".csv") {
+			data.partners, err = readPartnerCSV(partners)
+		} else {
+			file := partnerFile{}
+			err = readJSONFile(partners, &file)
+			data.partners = file.Partners
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if maps != "" {
+		files, err := mapFiles(maps)
+		if err != nil {
+			return nil, err
+		}
+		for _, fileName := range files {
+			file := mapFile{}
+			if err := readJSONFile(fileName, &file); err != nil {
+				return nil, err
+			}
+			if file.MapID == "" {
+				file.MapID = strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+			}
+			data.maps = append(data.maps, file)
+		}
+	}
+	return data, nil
+}
+
+func readJSONFile(fileName string, v interface{}) error {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("error occured while parsing `%s`: %w", fileName, err)
+	}
+	return nil
+}
+
+// mapFiles lists map definition files, target may be a single file or a
+// directory of JSON files.
+func mapFiles(target string) ([]string, error) {
+	stat, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return []string{target}, nil
+	}
+	return filepath.Glob(filepath.Join(target, "*.json"))
+}
+
+// readPartnerCSV reads partners from CSV file whose header row uses the same
+// names as JSON partner file.
+func readPartnerCSV(fileName string) ([]partnerEntry, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error occured while parsing `%s`: %w", fileName, err)
+	} else if len(records) == 0 {
+		return nil, nil
+	}
+
+	header := map[string]int{}
+	for i, name := range records[0] {
+		header[strings.TrimSpace(name)] = i
+	}
+	get := func(record []string, name string) string {
+		if i, ok := header[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	getInt := func(record []string, name string) (int, error) {
+		value := get(record, name)
+		if value == "" {
+			return 0, nil
+		}
+		return strconv.Atoi(value)
+	}
+	getBool := func(record []string, name string) (bool, error) {
+		value := get(record, name)
+		if value == "" {
+			return false, nil
+		}
+		return strconv.ParseBool(value)
+	}
+
+	partners := []partnerEntry{}
+	for line, record := range records[1:] {
+		entry := partnerEntry{
+			PartName:     get(record, "part_name"),
+			SkillID:      get(record, "skill_id"),
+			SkillIDUncap: get(record, "skill_id_uncap"),
+		}
+		var errs [5]error
+		entry.PartID, errs[0] = getInt(record, "part_id")
+		entry.CharType, errs[1] = getInt(record, "char_type")
+		entry.SkillUnlockLevel, errs[2] = getInt(record, "skill_unlock_level")
+		entry.SkillRequiresUncap, errs[3] = getBool(record, "skill_requires_uncap")
+		entry.HasVoice, errs[4] = getBool(record, "has_voice")
+		for _, err := range errs {
+			if err != nil {
+				return nil, fmt.Errorf("`%s` line %d: %w", fileName, line+2, err)
+			}
+		}
+		partners = append(partners, entry)
+	}
+	return partners, nil
+}
+
+// validateStaticData checks cross references of imported data against both
+// imported and existing rows.
+func validateStaticData(tx RowTx, data *staticData) error {
+	existing := map[string]map[string]bool{}
+	for _, kind := range []string{"song", "pack", "partner", "core"} {
+		ids, err := tx.KnownIDs(kind)
+		if err != nil {
+			return err
+		}
+		existing[kind] = ids
+	}
+	for _, song := range data.songs {
+		existing["song"][song.ID] = true
+	}
+	for _, pack := range data.packs {
+		existing["pack"][pack.ID] = true
+	}
+	for _, partner := range data.partners {
+		existing["partner"][strconv.Itoa(partner.PartID)] = true
+	}
+
+	problems := []string{}
+	for _, song := range data.songs {
+		if song.ID == "" {
+			problems = append(problems, "song without id")
+		}
+		if song.Set != "" && !existing["pack"][song.Set] {
+			problems = append(problems, fmt.Sprintf("song `%s` belongs to unknown pack `%s`", song.ID, song.Set))
+		}
+	}
+	for _, pack := range data.packs {
+		for _, item := range pack.Items {
+			if problem := checkItemReference(existing, item.Type, item.ID); problem != "" {
+				problems = append(problems, fmt.Sprintf("pack `%s`: %s", pack.ID, problem))
+			}
+		}
+	}
+	for _, m := range data.maps {
+		if len(m.CharacterAffinity) != len(m.AffinityMultiplier) {
+			problems = append(problems, fmt.Sprintf("map `%s`: affinity characters and multipliers differ in length", m.MapID))
+		}
+		for _, partID := range m.CharacterAffinity {
+			if !existing["partner"][strconv.Itoa(partID)] {
+				problems = append(problems, fmt.Sprintf("map `%s`: affinity with unknown partner %d", m.MapID, partID))
+			}
+		}
+		for _, step := range m.Steps {
+			for _, item := range step.Items {
+				if problem := checkItemReference(existing, item.Type, item.ID); problem != "" {
+					problems = append(problems, fmt.Sprintf("map `%s` step %d: %s", m.MapID, step.Position, problem))
+				}
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid static data:\n\t" + strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// checkItemReference returns description of problem when item points to
+// something doesn't exist.
+func checkItemReference(existing map[string]map[string]bool, itemType, itemID string) string {
+	var table string
+	switch itemType {
+	case "song", "single", "world_song":
+		table = "song"
+	case "pack":
+		table = "pack"
+	case "character":
+		table = "partner"
+	case "core":
+		table = "core"
+	default:
+		return ""
+	}
+	if !existing[table][itemID] {
+		return fmt.Sprintf("%s item points to unknown %s `%s`", itemType, table, itemID)
+	}
+	return ""
+}
+
+// tables turns imported data into rows of each table, in order they should
+// be written.
+func (data *staticData) tables() []*importTable {
+	pack := &importTable{name: "pack", keyColumns: []string{"pack_name"}}
+	packItem := &importTable{name: "pack_item", keyColumns: []string{"pack_name", "item_id", "item_type"}, scope: "pack_name"}
+	for _, p := range data.packs {
+		pack.add(importRow{
+			"pack_name": p.ID, "price": p.Price, "orig_price": p.OrigPrice,
+			"discount_from": p.DiscountFrom, "discount_to": p.DiscountTo,
+		})
+		packItem.scopeValues = append(packItem.scopeValues, p.ID)
+		for _, item := range p.Items {
+			available := item.IsAvailable == nil || *item.IsAvailable
+			packItem.add(importRow{
+				"pack_name": p.ID, "item_id": item.ID, "item_type": item.Type,
+				"is_available": sqlBool(available),
+			})
+		}
+	}
+
+	song := &importTable{name: "song", keyColumns: []string{"song_id"}}
+	chart := &importTable{name: "chart_info", keyColumns: []string{"song_id", "difficulty"}, scope: "song_id"}
+	for _, s := range data.songs {
+		var packName interface{}
+		if s.Set != "" {
+			packName = s.Set
+		}
+		song.add(importRow{
+			"song_id": s.ID, "title_local_en": s.TitleLocalized["en"], "pack_name": packName,
+			"checksum": s.Checksum, "remote_dl": sqlBool(s.RemoteDL),
+		})
+		chart.scopeValues = append(chart.scopeValues, s.ID)
+		for _, d := range s.Difficulties {
+			rating := d.Rating
+			if d.Constant != nil {
+				rating = *d.Constant
+			}
+			chart.add(importRow{
+				"song_id": s.ID, "difficulty": d.RatingClass, "rating": rating,
+				"checksum": d.Checksum, "remote_dl": sqlBool(d.RemoteDL),
+			})
+		}
+	}
+
+	partner := &importTable{name: "partner", keyColumns: []string{"part_id"}}
+	voice := &importTable{name: "part_voice", keyColumns: []string{"part_id"}, scope: "part_id"}
+	for _, p := range data.partners {
+		partner.add(importRow{
+			"part_id": p.PartID, "part_name": p.PartName, "char_type": p.CharType,
+			"skill_id": p.SkillID, "skill_id_uncap": p.SkillIDUncap,
+			"skill_requires_uncap": sqlBool(p.SkillRequiresUncap),
+			"skill_unlock_level":   p.SkillUnlockLevel,
+		})
+		voice.scopeValues = append(voice.scopeValues, p.PartID)
+		if p.HasVoice {
+			voice.add(importRow{"part_id": p.PartID})
+		}
+	}
+
+	worldMap := &importTable{name: "world_map", keyColumns: []string{"map_id"}}
+	affinity := &importTable{name: "map_affinity", keyColumns: []string{"map_id", "part_id"}, scope: "map_id"}
+	reward := &importTable{name: "map_reward", keyColumns: []string{"map_id", "position", "item_type"}, scope: "map_id"}
+	for _, m := range data.maps {
+		worldMap.add(importRow{
+			"map_id": m.MapID, "available_from": m.AvailableFrom, "available_to": m.AvailableTo,
+			"beyond_health": m.BeyondHealth, "chapter": m.Chapter, "coordinate": m.Coordinate,
+			"custom_bg": m.CustomBG, "is_beyond": sqlBool(m.IsBeyond),
+			"is_legacy": sqlBool(m.IsLegacy), "is_repeatable": sqlBool(m.IsRepeatable),
+			"require_id": m.RequireID, "require_type": m.RequireType, "require_value": m.RequireValue,
+			"stamina_cost": m.StaminaCost, "step_count": len(m.Steps),
+		})
+		affinity.scopeValues = append(affinity.scopeValues, m.MapID)
+		reward.scopeValues = append(reward.scopeValues, m.MapID)
+		for i, partID := range m.CharacterAffinity {
+			if i < len(m.AffinityMultiplier) {
+				affinity.add(importRow{"map_id": m.MapID, "part_id": partID, "multiplier": m.AffinityMultiplier[i]})
+			}
+		}
+		for _, step := range m.Steps {
+			for _, item := range step.Items {
+				var rewardID interface{}
+				if item.ID != "" {
+					rewardID = item.ID
+				}
+				reward.add(importRow{
+					"map_id": m.MapID, "position": step.Position, "item_type": item.Type,
+					"reward_id": rewardID, "amount": item.Amount,
+				})
+			}
+		}
+	}
+
+	return []*importTable{pack, song, chart, packItem, partner, voice, worldMap, affinity, reward}
+}
+
+// Section: Generic upsert with diff
+// ============================================================================
+
+// importRow maps column name to value.
+type importRow map[string]interface{}
+
+// importTable is rows to be upserted into a table, identified by keyColumns.
+// When scope is set, existing rows whose scope column has one of scopeValues
+// but are absent from import are deleted, so child rows follow their parent.
+type importTable struct {
+	name        string
+	keyColumns  []string
+	scope       string
+	scopeValues []interface{}
+	rows        []importRow
+}
+
+func (t *importTable) add(row importRow) {
+	t.rows = append(t.rows, row)
+}
+
+// valueColumns lists non-key columns of table in stable order.
+func (t *importTable) valueColumns() []string {
+	if len(t.rows) == 0 {
+		return nil
+	}
+	isKey := map[string]bool{}
+	for _, key := range t.keyColumns {
+		isKey[key] = true
+	}
+	columns := []string{}
+	for column := range t.rows[0] {
+		if !isKey[column] {
+			columns = append(columns, column)
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// keyOf returns condition matching row by key columns, along with text
+// identifying row.
+func (t *importTable) keyOf(row importRow) (map[string]interface{}, string) {
+	where := map[string]interface{}{}
+	parts := make([]string, len(t.keyColumns))
+	for i, key := range t.keyColumns {
+		where[key] = row[key]
+		parts[i] = importValueText(row[key])
+	}
+	return where, strings.Join(parts, "/")
+}
+
+// apply upserts rows of table and deletes stale scoped rows, printing every
+// change to out. Returns number of changed rows.
+func (t *importTable) apply(tx RowTx, out io.Writer) (int, error) {
+	columns := t.valueColumns()
+	// tables without value columns are only looked up for existence
+	selected := columns
+	if len(selected) == 0 {
+		selected = t.keyColumns
+	}
+	changes := 0
+	imported := map[string]bool{}
+
+	for _, row := range t.rows {
+		key, keyText := t.keyOf(row)
+		imported[keyText] = true
+
+		olds, err := tx.SelectRows(t.name, selected, key)
+		if err != nil {
+			return changes, fmt.Errorf("error occured while looking up %s %s: %w", t.name, keyText, err)
+		}
+		if len(olds) == 0 {
+			if err := tx.InsertRow(t.name, row); err != nil {
+				return changes, fmt.Errorf("error occured while inserting %s %s: %w", t.name, keyText, err)
+			}
+			fmt.Fprintf(out, "+ %s %s\n", t.name, keyText)
+			changes++
+			continue
+		}
+
+		diffs := []string{}
+		changed := map[string]interface{}{}
+		for _, column := range columns {
+			oldText, newText := importValueText(olds[0][column]), importValueText(row[column])
+			if oldText != newText {
+				diffs = append(diffs, fmt.Sprintf("%s %q -> %q", column, oldText, newText))
+				changed[column] = row[column]
+			}
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		if _, err := tx.UpdateRows(t.name, changed, key); err != nil {
+			return changes, fmt.Errorf("error occured while updating %s %s: %w", t.name, keyText, err)
+		}
+		fmt.Fprintf(out, "~ %s %s: %s\n", t.name, keyText, strings.Join(diffs, ", "))
+		changes++
+	}
+
+	deleted, err := t.deleteStale(tx, imported, out)
+	return changes + deleted, err
+}
+
+func (t *importTable) deleteStale(tx RowTx, imported map[string]bool, out io.Writer) (int, error) {
+	if t.scope == "" || len(t.scopeValues) == 0 {
+		return 0, nil
+	}
+	existing, err := tx.SelectRows(t.name, t.keyColumns, map[string]interface{}{t.scope: t.scopeValues})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, row := range existing {
+		key, keyText := t.keyOf(row)
+		if imported[keyText] {
+			continue
+		}
+		if _, err := tx.DeleteRows(t.name, key); err != nil {
+			return deleted, fmt.Errorf("error occured while deleting %s %s: %w", t.name, keyText, err)
+		}
+		fmt.Fprintf(out, "- %s %s\n", t.name, keyText)
+		deleted++
+	}
+	return deleted, nil
+}
+
+// importValueText normalizes value read from database or import file, so
+// that they can be compared.
+func importValueText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case driver.Valuer:
+		value, err := v.Value()
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return importValueText(value)
+	case []byte:
+		return string(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 
 	"github.com/albrow/forms"
 	"github.com/dgrijalva/jwt-go"
@@ -20,7 +19,7 @@ type EmptyList []struct{}
 func (c *EmptyList) toJSON() string {
 	res, err := json.Marshal(c)
 	if err != nil {
-		log.Println(err)
+		stdLog.Error("Error occured while generating JSON", "err", err)
 		return ""
 	}
 
@@ -33,7 +32,7 @@ type EmptyMap []struct{}
 func (c *EmptyMap) toJSON() string {
 	res, err := json.Marshal(c)
 	if err != nil {
-		log.Println(err)
+		stdLog.Error("Error occured while generating JSON", "err", err)
 		return ""
 	}
 
@@ -50,7 +49,7 @@ type Container struct {
 func (c *Container) toJSON() string {
 	res, err := json.Marshal(c)
 	if err != nil {
-		log.Println(err)
+		stdLog.Error("Error occured while generating JSON", "err", err)
 		return ""
 	}
 
@@ -91,7 +90,7 @@ type AggContainer []AggResult
 func (c *AggContainer) toJSON() string {
 	res, err := json.Marshal(c)
 	if err != nil {
-		log.Println(err)
+		stdLog.Error("Error occured while generating JSON", "err", err)
 		return ""
 	}
 
@@ -136,7 +135,7 @@ type UserInfo struct {
 func (info *UserInfo) toJSON() string {
 	res, err := json.Marshal(info)
 	if err != nil {
-		log.Println(err)
+		stdLog.Error("Error occured while generating JSON", "err", err)
 		return ""
 	}
 
@@ -174,7 +173,7 @@ type ToggleResult struct {
 func (r *ToggleResult) toJSON() string {
 	res, err := json.Marshal(r)
 	if err != nil {
-		log.Println(err)
+		stdLog.Error("Error occured while generating JSON", "err", err)
 		return ""
 	}
 
@@ -204,7 +203,7 @@ type PackInfoContainer []PackInfo
 func (c *PackInfoContainer) toJSON() string {
 	res, err := json.Marshal(c)
 	if err != nil {
-		log.Println(err)
+		stdLog.Error("Error occured while generating JSON", "err", err)
 		return ""
 	}
 
@@ -237,7 +236,7 @@ type CheckSumContainer map[string]*Checksum
 func (c *CheckSumContainer) toJSON() string {
 	res, err := json.Marshal(c)
 	if err != nil {
-		log.Println(err)
+		stdLog.Error("Error occured while generating JSON", "err", err)
 		return ""
 	}
 
@@ -272,7 +271,7 @@ type levelStep struct {
 func (i *GameInfo) toJSON() string {
 	res, err := json.Marshal(i)
 	if err != nil {
-		log.Println(err)
+		stdLog.Error("Error occured while generating JSON", "err", err)
 		return ""
 	}
 
@@ -292,7 +291,7 @@ type MapInfoContainer struct {
 func (c *MapInfoContainer) toJSON() string {
 	res, err := json.Marshal(c)
 	if err != nil {
-		log.Println(err)
+		stdLog.Error("Error occured while generating JSON", "err", err)
 		return ""
 	}
 
@@ -348,7 +347,7 @@ type ScoreToken struct {
 func (t *ScoreToken) toJSON() string {
 	res, err := json.Marshal(t)
 	if err != nil {
-		log.Println(err)
+		stdLog.Error("Error occured while generating JSON", "err", err)
 		return ""
 	}
 
@@ -387,24 +386,16 @@ func scoreRecordFromForm(data *forms.Data) *ScoreRecord {
 	}
 }
 
-func (r *ScoreRecord) scoreToRating() error {
+func (r *ScoreRecord) scoreToRating(store Store) error {
 	r.Rating = 0.0
-	score := float64(r.Score)
-	var baseRating float64
-	err := db.QueryRow(sqlStmtBaseRating, r.SongID, r.Difficulty).Scan(&baseRating)
+	baseRating, err := store.ChartRating(r.SongID, r.Difficulty)
 	if err != nil {
 		return fmt.Errorf("error while querying base rating for `%s`: %w", r.SongID, err)
 	} else if baseRating == 0 {
 		return errorZeroRating
 	}
 
-	if r.Score >= 10_000_000 {
-		r.Rating = baseRating + 2
-	} else if r.Score >= 9_800_000 {
-		r.Rating = baseRating + 1 + (score-9_800_000)/200_000
-	} else if r.Rating = baseRating + (score-9_500_000)/300_000; r.Rating < 0 {
-		r.Rating = 0
-	}
+	r.Rating = playRating(baseRating, r.Score)
 	return nil
 }
 
@@ -413,3 +404,43 @@ type ScoreUploadResult struct {
 	Success bool           `json:"success"`
 	Value   map[string]int `json:"value,omitempty"`
 }
+
+// Seciton: Backup
+// ============================================================================
+
+// BackupData is a cloud save document, mapping backup keys to their content
+type BackupData map[string]json.RawMessage
+
+func (b *BackupData) toJSON() string {
+	res, err := json.Marshal(b)
+	if err != nil {
+		stdLog.Error("Error occured while generating JSON", "err", err)
+		return ""
+	}
+
+	return string(res)
+}
+
+// Seciton: Present
+// ============================================================================
+
+// PresentContainer type define
+type PresentContainer []Present
+
+func (c *PresentContainer) toJSON() string {
+	res, err := json.Marshal(c)
+	if err != nil {
+		stdLog.Error("Error occured while generating JSON", "err", err)
+		return ""
+	}
+
+	return string(res)
+}
+
+// Present is a gift sent to player
+type Present struct {
+	PresentID   string       `json:"present_id"`
+	ExpireTs    int64        `json:"expire_ts"`
+	Description string       `json:"description"`
+	Items       []RewardItem `json:"items"`
+}
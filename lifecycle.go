@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/gorilla/mux"
+)
+
+func newHTTPServer(addr string, handler http.Handler, config *Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+}
+
+// Serve runs server, admin server and metrics server until SIGINT or SIGTERM
+// is received, then waits for in-flight requests to finish before closing
+// server. SIGHUP reloads configuration.
+func (s *Server) Serve() error {
+	config := s.cfg()
+	servers := []*http.Server{newHTTPServer(fmt.Sprintf(":%d", config.Port), s, config)}
+	names := []string{"server"}
+	if config.AdminPassword != "" && config.AdminPort != "" {
+		adminRouter := mux.NewRouter()
+		adminRouter.Use(s.instrument)
+		s.setAdminRouting(adminRouter)
+		servers = append(servers, newHTTPServer(":"+config.AdminPort, s.logRequests(adminRouter), config))
+		names = append(names, "admin API")
+	}
+	if config.MetricsPort != "" {
+		metricsRouter := mux.NewRouter()
+		metricsRouter.Path("/metrics").Methods("GET").Handler(s.metrics.handler())
+		servers = append(servers, newHTTPServer(":"+config.MetricsPort, metricsRouter, config))
+		names = append(names, "metrics")
+	}
+
+	errs := make(chan error, len(servers))
+	for i, server := range servers {
+		name := names[i]
+		scheme := "HTTP"
+		if config.TLSCert != "" {
+			scheme = "HTTPS"
+		}
+		fmt.Printf("Starting %s %s at %s\n", scheme, name, server.Addr)
+		go func(server *http.Server) {
+			var err error
+			if config.TLSCert != "" {
+				err = server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+			} else {
+				err = server.ListenAndServe()
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+			}
+		}(server)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	var serveErr error
+loop:
+	for {
+		select {
+		case err := <-errs:
+			serveErr = err
+			break loop
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				s.reloadConfig()
+				continue
+			}
+			s.log.Info("Shutting down", "signal", sig)
+			break loop
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg().ShutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			s.log.Error("Error occured while shutting down", "addr", server.Addr, "err", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		s.log.Error("Error occured while closing storage", "err", err)
+	}
+	return serveErr
+}
+
+// reloadConfig reads configuration again and applies options that can change
+// without restarting. Invalid configuration is reported and ignored.
+func (s *Server) reloadConfig() {
+	config, _, err := loadConfig(s.configArgs)
+	if err != nil {
+		s.log.Error("Config is not reloaded", "err", err)
+		return
+	}
+	if changed := config.keepStructural(s.cfg()); len(changed) > 0 {
+		s.log.Warn("Options need restart to take effect", "options", strings.Join(changed, ","))
+	}
+	s.config.Store(config)
+	for _, hook := range s.reloadHooks {
+		hook()
+	}
+	s.log.Info("Reloaded config")
+}
+
+// keepStructural resets options which can't change while server is running
+// to their values in old, and returns names of those that differ.
+func (c *Config) keepStructural(old *Config) []string {
+	changed := []string{}
+	keep := func(name string, value *string, oldValue string) {
+		if *value != oldValue {
+			changed = append(changed, name)
+			*value = oldValue
+		}
+	}
+	keep("host", &c.Host, old.Host)
+	keep("root", &c.Root, old.Root)
+	keep("storage", &c.Storage, old.Storage)
+	keep("db", &c.DB, old.DB)
+	keep("public-url", &c.PublicURL, old.PublicURL)
+	keep("tls-cert", &c.TLSCert, old.TLSCert)
+	keep("tls-key", &c.TLSKey, old.TLSKey)
+	keep("api-root", &c.APIRoot, old.APIRoot)
+	keep("admin-port", &c.AdminPort, old.AdminPort)
+	keep("metrics-port", &c.MetricsPort, old.MetricsPort)
+	if c.Port != old.Port {
+		changed = append(changed, "port")
+		c.Port = old.Port
+	}
+	if (c.AdminPassword == "") != (old.AdminPassword == "") {
+		// enabling or disabling admin API changes routing
+		changed = append(changed, "admin-password")
+		c.AdminPassword = old.AdminPassword
+	}
+	if c.ReadTimeout != old.ReadTimeout || c.WriteTimeout != old.WriteTimeout || c.IdleTimeout != old.IdleTimeout {
+		changed = append(changed, "read-timeout, write-timeout, idle-timeout")
+		c.ReadTimeout, c.WriteTimeout, c.IdleTimeout = old.ReadTimeout, old.WriteTimeout, old.IdleTimeout
+	}
+	return changed
+}
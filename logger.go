@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func (l logLevel) String() string {
+	for name, level := range logLevelNames {
+		if level == l {
+			return name
+		}
+	}
+	return strconv.Itoa(int(l))
+}
+
+// logFormats are formats log entries can be written in.
+var logFormats = []string{"logfmt", "json"}
+
+// logLevelNamesList lists names of log levels from lowest to highest, for
+// messages.
+func logLevelNamesList() string {
+	names := []string{}
+	for name := range logLevelNames {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return logLevelNames[names[i]] < logLevelNames[names[j]] })
+	return strings.Join(names, ", ")
+}
+
+// logOutput is shared by a logger and all loggers derived from it.
+type logOutput struct {
+	sync.Mutex
+	w     io.Writer
+	json  bool
+	level logLevel
+}
+
+// Logger writes leveled log entries made of a message and key-value fields,
+// one entry per line in logfmt or JSON.
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+// stdLog is logger for code running outside of a Server, e.g. sub-commands.
+var stdLog = newLogger(os.Stderr)
+
+func newLogger(w io.Writer) *Logger {
+	return &Logger{out: &logOutput{w: w, level: levelInfo}}
+}
+
+// configure sets format and lowest level of entries written by l and loggers
+// derived from it.
+func (l *Logger) configure(format string, level string) error {
+	lv, ok := logLevelNames[level]
+	if !ok {
+		return fmt.Errorf("unknown log level `%s`", level)
+	}
+	if format != "logfmt" && format != "json" {
+		return fmt.Errorf("unknown log format `%s`", format)
+	}
+	l.out.Lock()
+	defer l.out.Unlock()
+	l.out.json = format == "json"
+	l.out.level = lv
+	return nil
+}
+
+// With returns a logger adding given key-value pairs to each entry.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{l.out, fields}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+// Fatal writes an error entry and exits.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(levelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level logLevel, msg string, kv []interface{}) {
+	l.out.Lock()
+	defer l.out.Unlock()
+	if level < l.out.level {
+		return
+	}
+
+	pairs := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	pairs = append(pairs, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	pairs = append(pairs, l.fields...)
+	pairs = append(pairs, kv...)
+	if len(pairs)%2 != 0 {
+		pairs = append(pairs, "(MISSING)")
+	}
+
+	buf := new(bytes.Buffer)
+	if l.out.json {
+		buf.WriteByte('{')
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		key, value := fmt.Sprint(pairs[i]), logValue(pairs[i+1])
+		if l.out.json {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONField(buf, key, value)
+			continue
+		}
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(value))
+	}
+	if l.out.json {
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('\n')
+	l.out.w.Write(buf.Bytes())
+}
+
+// logValue turns value of a field into what is written, errors and
+// durations are written as text, numbers and booleans as they are.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func writeJSONField(buf *bytes.Buffer, key string, value interface{}) {
+	k, _ := json.Marshal(key)
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(k)
+	buf.WriteByte(':')
+	buf.Write(v)
+}
+
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if value == nil {
+		s = "null"
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n\\") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// Section: Requests
+// ============================================================================
+
+type requestInfoKey struct{}
+
+// requestInfo is what is known about a request being handled, route and user
+// are filled in once request is routed and authenticated.
+type requestInfo struct {
+	id     string
+	route  string
+	userID int
+	log    *Logger
+}
+
+// logRequests gives each request an ID, which is returned in X-Request-ID
+// header and attached to everything logged for the request, and logs request
+// once it's handled. Requests to probePaths are logged at debug level.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		info := &requestInfo{
+			id:  id,
+			log: s.log.With("request_id", id, "method", r.Method, "path", r.URL.Path),
+		}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		logHandled := requestLog(r).Info
+		if probePaths[r.URL.Path] {
+			logHandled = requestLog(r).Debug
+		}
+		logHandled(
+			"Handled request",
+			"status", recorder.status,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+	})
+}
+
+// requestLog returns logger of request, with its ID, route and user attached.
+func requestLog(r *http.Request) *Logger {
+	info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return stdLog
+	}
+	l := info.log
+	if info.route != "" {
+		l = l.With("route", info.route)
+	}
+	if info.userID != 0 {
+		l = l.With("user_id", info.userID)
+	}
+	return l
+}
+
+// setRequestUser records user request is acting as for logging.
+func setRequestUser(r *http.Request, userID int) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.userID = userID
+	}
+}
+
+func setRequestRoute(r *http.Request, route string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.route = route
+	}
+}
+
+// validRequestID tells whether request ID given by client can be used, it
+// must be short and made of letters, digits, `-`, `_` and `.`.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
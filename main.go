@@ -1,157 +1,57 @@
 package main
 
 import (
-	"database/sql"
-	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
 	"os"
-	"path"
-	"path/filepath"
 	"unsafe"
-
-	"github.com/gorilla/mux"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 //#include "./theos_code/main.h"
 import "C"
 
-var (
-	staticUserID = 1
-	// NeedAuth is switch for authentication
-	NeedAuth bool
-	// Port is port number used by server
-	Port string
-	// HostName is server address
-	HostName string
-	// APIRoot is leading path of all request URL
-	APIRoot           = "/zrcaeasv"
-	scoreCardTemplate string
-	scorePageTemplate string
-	// InsideHandler recording internal func inside info getting purpose handler
-	InsideHandler = map[string]func(userID int, r *http.Request) (ToJSON, error){}
-	db            *sql.DB
-)
-
-const fileServerPrefix = "/static/songs"
-
-var scoreCardTemplatePath = path.Join("static", "score_lookup", "card_template.html")
-var scorePageTemplatePath = path.Join("static", "score_lookup", "page_template.html")
-
-func setRouting(apiroot string) *mux.Router {
-	router := mux.NewRouter()
-
-	pwd, err := os.Getwd()
+// startUp loads configuration from args and creates server with it.
+func startUp(args []string) *Server {
+	config, run, err := loadConfig(args)
 	if err != nil {
-		log.Fatal(err)
-	}
-	fileServerPath := path.Join(pwd, fileServerPrefix)
-	router.PathPrefix(fileServerPrefix).Handler(
-		fileServerWithAuth(
-			http.StripPrefix(fileServerPrefix, http.FileServer(http.Dir(fileServerPath))),
-		),
-	)
-
-	router.Path(path.Join("/score", "b30", "{id:[0-9]{9}}")).Methods("GET").Handler(http.HandlerFunc(scoreLookupHandler))
-
-	s := router.PathPrefix(apiroot).Subrouter()
-
-	s.Path("/auth/login").Methods("POST").HandlerFunc(loginHandler)
-
-	s.Path("/compose/aggregate").Methods("GET").Handler(http.HandlerFunc(aggregateHandler))
-
-	s.Path("/user/me/character").Methods("POST").Handler(http.HandlerFunc(changeCharacter))
-	s.PathPrefix("/user/me/characters/{partID}/toggle_uncap").Methods("POST").Handler(http.HandlerFunc(toggleUncap))
-
-	s.Path("/game/info").Methods("GET").Handler(http.HandlerFunc(gameInfoHandler))
-	InsideHandler["/game/info"] = getGameInfo
-
-	s.Path("/purchase/bundle/pack").Methods("GET").Handler(http.HandlerFunc(packInfoHandler))
-	InsideHandler["/purchase/bundle/pack"] = getPackInfo
-
-	s.Path("/present/me").Methods("GET").Handler(http.HandlerFunc(presentMeHandler))
-	InsideHandler["/present/me"] = presentMe
-
-	s.Path("/user/me/save").Methods("GET").Handler(http.HandlerFunc(returnBackup))
-	s.Path("/user/me/save").Methods("POST").Handler(http.HandlerFunc(receiveBackup))
-
-	s.Path("/score/token").Methods("GET").Handler(http.HandlerFunc(scoreTokenHandler))
-	s.Path("/score/song").Methods("POST").Handler(http.HandlerFunc(scoreUploadHandler))
-
-	s.Path("/user/me").Methods("GET").Handler(http.HandlerFunc(userInfoHandler))
-
-	s.PathPrefix("/user/me/setting").Methods("POST").Handler(http.HandlerFunc(userSettingHandler))
-	InsideHandler["/user/me"] = getUserInfo
-
-	s.Path("/world/map/me").Methods("GET").Handler(http.HandlerFunc(myMapInfoHandler))
-	InsideHandler["/world/map/me"] = getMyMapInfo
-
-	s.Path("/serve/download/me/song").Methods("GET").Handler(http.HandlerFunc(songDownloadHandler))
-	InsideHandler["/serve/download/me/song"] = getDownloadList
-
-	return router
-}
-
-func startUp(args []string) {
-	commandLine := flag.NewFlagSet(args[0], flag.ExitOnError)
-
-	needAuth := commandLine.Bool("auth", false, "Sitch on/off authentication")
-	port := commandLine.Int("port", 8080, "Port number for server.")
-	hostFlag := commandLine.String("host", "127.0.0.1", "Host name for server.")
-	docuemntRoot := commandLine.String("root", "", "Root path of server documents.")
-	dbFile := commandLine.String("db", "ZrcaeaDB.db", "sqlite DB file to use.")
-
-	commandLine.Parse(args[1:])
-
-	connectToDB(*dbFile)
-	NeedAuth = *needAuth
-	Port = fmt.Sprintf("%d", *port)
-	HostName = fmt.Sprintf("%s:%s", *hostFlag, Port)
-	fmt.Printf("Root URL: %s%s\n", HostName, APIRoot)
-
-	if *docuemntRoot != "" {
-		fmt.Println("Documents Root:", *docuemntRoot)
-		os.Chdir(*docuemntRoot)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-
-	readTemplate()
-	if scoreCardTemplate == "" || scorePageTemplate == "" {
-		log.Fatal("Can't read webpage templates.")
+	if run.printConfig {
+		fmt.Println(config.redacted())
+		os.Exit(0)
 	}
-}
 
-func connectToDB(dbFile string) {
-	var err error
-	dbFile, err = filepath.Abs(dbFile)
-	if err != nil {
-		log.Fatal(err)
+	// messages of process as a whole, e.g. applied migrations, follow log
+	// options of the server it runs
+	if err := stdLog.configure(config.LogFormat, config.LogLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	db, err = sql.Open("sqlite3", dbFile)
+	server, err := NewServer(config)
 	if err != nil {
-		log.Fatal(err)
+		stdLog.Fatal("Error occured while starting server", "err", err)
 	}
-	err = db.Ping()
-	if err != nil {
-		log.Println("Error while connecting to database.")
-		log.Fatal(err)
+	server.configArgs = args
+	if run.migrateOnly {
+		version, err := server.store.SchemaVersion()
+		if err != nil {
+			stdLog.Fatal("Error occured while reading schema version", "err", err)
+		}
+		fmt.Println("Database schema version:", version)
+		server.Close()
+		os.Exit(0)
 	}
-}
+	server.startAuditRetention()
+	server.logStartUp()
 
-func readTemplate() {
-	content, err := ioutil.ReadFile(scoreCardTemplatePath)
-	if err != nil {
-		log.Fatal(err)
+	if config.Root != "" {
+		fmt.Println("Documents Root:", config.Root)
 	}
-	scoreCardTemplate = string(content)
 
-	content, err = ioutil.ReadFile(scorePageTemplatePath)
-	if err != nil {
-		log.Fatal(err)
+	if _, err := server.getScoreTemplate(); err != nil {
+		server.log.Fatal("Can't read webpage templates", "err", err)
 	}
-	scorePageTemplate = string(content)
+	return server
 }
 
 func goStrings(argc C.int, argv **C.char) []string {
@@ -169,24 +69,19 @@ func goStrings(argc C.int, argv **C.char) []string {
 func ExportMainObjectiveC(argc C.int, argv, envp **C.char) C.int {
 	//convert args from iOS args to golang's os.Args
 	args := goStrings(argc, argv)
-	startUp(args)
-	defer db.Close()
-
-	fmt.Println("Starting a server at port", Port)
-	router := setRouting(APIRoot)
-	if err := http.ListenAndServe(":"+Port, router); err != nil {
-		log.Fatal(err)
+	server := startUp(args)
+	if err := server.Serve(); err != nil {
+		server.log.Fatal("Error occured while serving", "err", err)
 	}
 	return 0
 }
 
 func main() {
-	startUp(os.Args)
-	defer db.Close()
-
-	fmt.Println("Starting a server at port", Port)
-	router := setRouting(APIRoot)
-	if err := http.ListenAndServe(":"+Port, router); err != nil {
-		log.Fatal(err)
+	if runSubCommand(os.Args) {
+		return
+	}
+	server := startUp(os.Args)
+	if err := server.Serve(); err != nil {
+		server.log.Fatal("Error occured while serving", "err", err)
 	}
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are Prometheus collectors of a server, registered on a registry of
+// its own.
+type metrics struct {
+	registry      *prometheus.Registry
+	requests      *prometheus.CounterVec
+	latency       *prometheus.HistogramVec
+	scoreUploads  *prometheus.CounterVec
+	logins        *prometheus.CounterVec
+	downloadBytes prometheus.Counter
+}
+
+func newMetrics(store Store, db *sql.DB, dbName string) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "zrc_http_requests_total",
+			Help: "Number of HTTP requests handled, by route template, method and status code.",
+		}, []string{"route", "method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "zrc_http_request_duration_seconds",
+			Help:    "Time taken to handle HTTP requests, by route template and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		scoreUploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "zrc_score_uploads_total",
+			Help: "Number of scores uploaded, by chart difficulty and clear type.",
+		}, []string{"difficulty", "clear_type"}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "zrc_logins_total",
+			Help: "Number of login attempts, by result.",
+		}, []string{"result"}),
+		downloadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "zrc_download_bytes_total",
+			Help: "Bytes of song files served.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.latency, m.scoreUploads, m.logins, m.downloadBytes,
+		collectors.NewDBStatsCollector(db, dbName),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		&staticCacheCollector{store},
+	)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *metrics) countLogin(ok bool) {
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	m.logins.WithLabelValues(result).Inc()
+}
+
+// instrument records count and latency of requests, labelled by template of
+// route they matched.
+func (s *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		setRequestRoute(r, route)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		s.metrics.requests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		s.metrics.latency.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder remembers status code written to response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(p)
+}
+
+// countingWriter adds bytes written to response to a counter.
+type countingWriter struct {
+	http.ResponseWriter
+	counter prometheus.Counter
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.counter.Add(float64(n))
+	return n, err
+}
+
+// staticCacheCollector exports hit and miss counts of static data cache.
+type staticCacheCollector struct {
+	store Store
+}
+
+var (
+	staticCacheHitsDesc = prometheus.NewDesc(
+		"zrc_static_cache_hits_total", "Number of reads of static game data served from cache.",
+		[]string{"group"}, nil,
+	)
+	staticCacheMissesDesc = prometheus.NewDesc(
+		"zrc_static_cache_misses_total", "Number of reads of static game data loaded from database.",
+		[]string{"group"}, nil,
+	)
+)
+
+func (c *staticCacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- staticCacheHitsDesc
+	ch <- staticCacheMissesDesc
+}
+
+func (c *staticCacheCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, stats := range c.store.StaticCacheStats() {
+		ch <- prometheus.MustNewConstMetric(staticCacheHitsDesc, prometheus.CounterValue, float64(stats.Hits), stats.Group)
+		ch <- prometheus.MustNewConstMetric(staticCacheMissesDesc, prometheus.CounterValue, float64(stats.Misses), stats.Group)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFS holds SQL migrations of each storage backend in a directory
+// named after it. File names are formatted as `<version>_<name>.sql` and
+// applied in ascending order of version, backends keep the same versions.
+//
+//go:embed migrations/*/*.sql
+var migrationFS embed.FS
+
+type migration struct {
+	version int
+	name    string
+	stmt    string
+	convert func(c sqlConn) error
+}
+
+// migrationFuncs convert data in ways SQL can't, by backend and version. Each
+// runs in transaction of its migration after the SQL file.
+var migrationFuncs = map[string]map[int]func(c sqlConn) error{
+	"sqlite": {5: convertBooleanFlags, 6: convertOldBackups},
+}
+
+// loadMigrations reads all embedded migrations of backend sorted by version.
+func loadMigrations(backend string) ([]migration, error) {
+	dir := path.Join("migrations", backend)
+	entries, err := migrationFS.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []migration{}
+	for _, entry := range entries {
+		fileName := entry.Name()
+		parts := strings.SplitN(strings.TrimSuffix(fileName, ".sql"), "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid migration file name `%s`", fileName)
+		}
+		content, err := migrationFS.ReadFile(path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version, parts[1], string(content), migrationFuncs[backend][version]})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("duplicated migration version %d", migrations[i].version)
+		}
+	}
+	return migrations, nil
+}
+
+// latestSchemaVersion is the schema version of backend this build expects.
+func latestSchemaVersion(backend string) int {
+	migrations, err := loadMigrations(backend)
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+func (st *sqlStore) SchemaVersion() (int, error) {
+	var version int
+	err := st.queryRow(sqlStmtSchemaVersion).Scan(&version)
+	return version, err
+}
+
+// migrate applies all migrations of backend not yet recorded in
+// SCHEMA_VERSION, each in its own transaction, and returns resulting schema
+// version.
+func (st *sqlStore) migrate(backend string) (int, error) {
+	if _, err := st.exec(sqlStmtCreateSchemaVersion); err != nil {
+		return 0, fmt.Errorf("error occured while creating table SCHEMA_VERSION: %w", err)
+	}
+	current, err := st.SchemaVersion()
+	if err != nil {
+		return 0, fmt.Errorf("error occured while reading schema version: %w", err)
+	}
+
+	migrations, err := loadMigrations(backend)
+	if err != nil {
+		return current, err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := st.applyMigration(m); err != nil {
+			return current, err
+		}
+		stdLog.Info("Applied migration", "version", m.version, "name", m.name)
+		current = m.version
+	}
+	return current, nil
+}
+
+func (st *sqlStore) applyMigration(m migration) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	c := sqlConn{tx, st.backend}
+
+	if _, err := tx.Exec(m.stmt); err != nil {
+		return fmt.Errorf("error occured while applying migration %04d_%s: %w", m.version, m.name, err)
+	}
+	if m.convert != nil {
+		if err := m.convert(c); err != nil {
+			return fmt.Errorf("error occured while converting data in migration %04d_%s: %w", m.version, m.name, err)
+		}
+	}
+	if _, err := c.exec(sqlStmtInsertSchemaVersion, m.version, m.name, time.Now().Unix()); err != nil {
+		return fmt.Errorf("error occured while recording migration %04d_%s: %w", m.version, m.name, err)
+	}
+	return tx.Commit()
+}
+
+// booleanFlags are columns 0005_boolean_flags turns into integer, by table in
+// order tables are rebuilt.
+var booleanFlags = []struct {
+	table string
+	flags []string
+}{
+	{"game_info", []string{"world_ranking_enabled", "is_byd_chapter_unlocked", "is_aprilfools"}},
+	{"partner", []string{"skill_requires_uncap"}},
+	{"song", []string{"remote_dl"}},
+	{"chart_info", []string{"remote_dl"}},
+	{"pack_item", []string{"is_available"}},
+	{"world_map", []string{"is_beyond", "is_legacy", "is_repeatable"}},
+	{"player", []string{"is_locked_name_duplicated", "is_skill_sealed", "max_stamina_notification", "is_hide_rating"}},
+	{"part_stats", []string{"is_uncapped_override", "is_uncapped"}},
+	{"player_map_prog", []string{"is_locked"}},
+	{"recent_score", []string{"is_recent_10"}},
+}
+
+// convertBooleanFlags copies rows of each table having flags into its new
+// layout created by 0005_boolean_flags, then replaces the table with it.
+// Columns are matched by name, those only the old table has are added to the
+// new one with their declared type, so no data is lost on databases whose
+// tables differ from the initial schema.
+func convertBooleanFlags(c sqlConn) error {
+	for _, t := range booleanFlags {
+		newTable := "new_" + t.table
+		oldColumns, err := sqliteColumns(c, t.table)
+		if err != nil {
+			return err
+		}
+		newColumns, err := sqliteColumns(c, newTable)
+		if err != nil {
+			return err
+		}
+		known := map[string]bool{}
+		for _, column := range newColumns {
+			known[column.name] = true
+		}
+		isFlag := map[string]bool{}
+		for _, flag := range t.flags {
+			isFlag[flag] = true
+		}
+
+		names := []string{}
+		values := []string{}
+		for _, column := range oldColumns {
+			name := quoteSQLiteName(column.name)
+			if !known[column.name] {
+				stmt := fmt.Sprintf("alter table %s add column %s %s", newTable, name, column.typeName)
+				if _, err := c.exec(stmt); err != nil {
+					return fmt.Errorf("keeping column %s of %s: %w", column.name, t.table, err)
+				}
+			}
+			names = append(names, name)
+			if isFlag[column.name] {
+				values = append(values, fmt.Sprintf("case when %s = 't' then 1 else 0 end", name))
+			} else {
+				values = append(values, name)
+			}
+		}
+
+		stmts := []string{
+			fmt.Sprintf(
+				"insert into %s (%s) select %s from %s",
+				newTable, strings.Join(names, ", "), strings.Join(values, ", "), t.table,
+			),
+			fmt.Sprintf("drop table %s", t.table),
+			fmt.Sprintf("alter table %s rename to %s", newTable, t.table),
+		}
+		for _, stmt := range stmts {
+			if _, err := c.exec(stmt); err != nil {
+				return fmt.Errorf("rebuilding table %s: %w", t.table, err)
+			}
+		}
+	}
+	return nil
+}
+
+type sqliteColumn struct {
+	name     string
+	typeName string
+}
+
+// sqliteColumns lists columns of table in SQLite database.
+func sqliteColumns(c sqlConn, table string) ([]sqliteColumn, error) {
+	rows, err := c.query(sqlStmtSQLiteColumns, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := []sqliteColumn{}
+	for rows.Next() {
+		var column sqliteColumn
+		if err := rows.Scan(&column.name, &column.typeName); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s doesn't exist", table)
+	}
+	return columns, nil
+}
+
+// quoteSQLiteName quotes a table or column name read from database schema.
+func quoteSQLiteName(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// convertOldBackups copies backups from table renamed by 0006_backup_versions.
+// Versioned rows are kept as they are. Rows of the old layout, made of
+// `"key":value` pairs joined by commas, become version 1 of their user.
+func convertOldBackups(c sqlConn) error {
+	rows, err := c.query(sqlStmtOldBackups)
+	if err != nil {
+		return err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return err
+	}
+	if len(columns) != 2 {
+		rows.Close()
+		if _, err := c.exec(sqlStmtCopyOldBackups); err != nil {
+			return err
+		}
+		_, err := c.exec(sqlStmtDropOldBackups)
+		return err
+	}
+
+	type oldBackup struct {
+		userID int
+		data   sql.NullString
+	}
+	backups := []oldBackup{}
+	for rows.Next() {
+		var b oldBackup
+		if err := rows.Scan(&b.userID, &b.data); err != nil {
+			rows.Close()
+			return err
+		}
+		backups = append(backups, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, b := range backups {
+		if strings.TrimSpace(b.data.String) == "" {
+			continue
+		}
+		content, createdAt, err := convertOldBackup(b.data.String)
+		if err != nil {
+			stdLog.Warn("Skip broken backup", "user_id", b.userID, "err", err)
+			continue
+		}
+		if _, err := c.exec(sqlStmtWriteBackupData, b.userID, 1, createdAt, content); err != nil {
+			return err
+		}
+	}
+	_, err = c.exec(sqlStmtDropOldBackups)
+	return err
+}
+
+// convertOldBackup turns backup of the old layout into JSON document, along
+// with time it was created, falling back to now.
+func convertOldBackup(data string) (string, int64, error) {
+	content := "{" + data + "}"
+	var doc struct {
+		CreatedAt int64 `json:"createdAt"`
+	}
+	if err := json.Unmarshal([]byte(content), &doc); err != nil {
+		return "", 0, err
+	}
+	if doc.CreatedAt == 0 {
+		doc.CreatedAt = time.Now().Unix()
+	}
+	return content, doc.CreatedAt, nil
+}
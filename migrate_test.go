@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestMigrateBooleanFlags migrates a database made before migrations existed,
+// whose song table has columns in another order and one column more than the
+// initial schema.
+func TestMigrateBooleanFlags(t *testing.T) {
+	config := defaultConfig()
+	config.DB = filepath.Join(t.TempDir(), "zrc.db")
+	db, err := sql.Open("sqlite3", config.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initSQL, err := migrationFS.ReadFile("migrations/sqlite/0001_init.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmts := []string{
+		`create table song (
+			remote_dl text,
+			song_id text primary key,
+			bpm text,
+			checksum text not null default '',
+			pack_name text,
+			title_local_en text not null default ''
+		)`,
+		string(initSQL),
+		`insert into pack (pack_name) values ('base')`,
+		`insert into song (song_id, pack_name, remote_dl, bpm) values
+			('on', 'base', 't', '200'), ('off', 'base', '', '150'), ('null', 'base', null, null)`,
+		`insert into chart_info (song_id, difficulty, rating, remote_dl) values
+			('on', 2, 9.5, 't'), ('off', 2, 10.5, '')`,
+		`insert into player (user_id, user_name, user_code, is_hide_rating, is_skill_sealed) values
+			(1, 'first', 1, 't', null), (2, 'second', 2, '', 't')`,
+		`insert into world_map (map_id, is_beyond, is_legacy, is_repeatable) values ('map', 't', null, 't')`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			t.Fatalf("preparing database: %v", err)
+		}
+	}
+	db.Close()
+
+	st, db, err := openStore(config)
+	if err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	defer st.Close()
+
+	checks := []struct {
+		query string
+		want  [][]interface{}
+	}{
+		{
+			"select song_id, remote_dl, bpm, pack_name from song order by song_id",
+			[][]interface{}{{"null", "0", "", "base"}, {"off", "0", "150", "base"}, {"on", "1", "200", "base"}},
+		},
+		{
+			"select song_id, rating, remote_dl from chart_info order by song_id",
+			[][]interface{}{{"off", "10.5", "0"}, {"on", "9.5", "1"}},
+		},
+		{
+			"select user_name, is_hide_rating, is_skill_sealed from player order by user_id",
+			[][]interface{}{{"first", "1", "0"}, {"second", "0", "1"}},
+		},
+		{
+			"select map_id, is_beyond, is_legacy, is_repeatable from world_map",
+			[][]interface{}{{"map", "1", "0", "1"}},
+		},
+		{
+			// seeded by 0002_seed in text
+			"select world_ranking_enabled, is_byd_chapter_unlocked, is_aprilfools from game_info",
+			[][]interface{}{{"0", "1", "0"}},
+		},
+		{
+			"select typeof(remote_dl) from song group by typeof(remote_dl)",
+			[][]interface{}{{"integer"}},
+		},
+	}
+	for _, c := range checks {
+		got, err := queryStrings(db, c.query)
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s = %v, want %v", c.query, got, c.want)
+		}
+	}
+}
+
+// queryStrings reads rows of query with every value formatted as string, null
+// as empty string.
+func queryStrings(db *sql.DB, query string) ([][]interface{}, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := [][]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		row := make([]interface{}, len(columns))
+		for i, v := range values {
+			switch v := v.(type) {
+			case nil:
+				row[i] = ""
+			case []byte:
+				row[i] = string(v)
+			default:
+				row[i] = fmt.Sprint(v)
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
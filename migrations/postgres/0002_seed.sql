@@ -0,0 +1,42 @@
+-- Minimal game data for a brand-new install. Rows are only inserted when
+-- missing, so existing databases keep their own values.
+
+insert into game_info (
+	max_stamina, stamina_recover_tick, core_exp,
+	world_ranking_enabled, is_byd_chapter_unlocked, is_aprilfools
+)
+select 12, 1800000, 250, '', 't', ''
+where not exists (select 1 from game_info);
+
+insert into level_exp (lv, exp_val) values
+	(1, 0), (2, 50), (3, 100), (4, 150), (5, 200),
+	(6, 300), (7, 450), (8, 650), (9, 900), (10, 1200),
+	(11, 1600), (12, 2100), (13, 2700), (14, 3400), (15, 4200),
+	(16, 5100), (17, 6100), (18, 7200), (19, 8500), (20, 10000),
+	(21, 11500), (22, 13000), (23, 14500), (24, 16000), (25, 17500),
+	(26, 19000), (27, 20500), (28, 22000), (29, 23500), (30, 25000)
+on conflict do nothing;
+
+insert into partner (
+	part_id, part_name, char_type,
+	skill_id, skill_id_uncap, skill_requires_uncap, skill_unlock_level
+) values
+	(0, 'hikari', 1, 'gauge_easy', '', '', 0),
+	(1, 'tairitsu', 0, '', '', '', 0)
+on conflict do nothing;
+
+-- Default player used when server runs without authentication.
+insert into player (
+	user_id, user_name, pwdhash, user_code, partner, join_date
+) values (1, 'player', '', 1, 0, cast(extract(epoch from now()) as bigint) * 1000)
+on conflict do nothing;
+
+insert into part_stats (
+	user_id, part_id, overdrive, prog, frag, lv, exp_val
+) values
+	(1, 0, 55, 35, 55, 1, 0),
+	(1, 1, 55, 55, 55, 1, 0)
+on conflict do nothing;
+
+-- Default player is inserted with explicit user_id, move identity past it.
+select setval(pg_get_serial_sequence('player', 'user_id'), (select max(user_id) from player));
@@ -0,0 +1,14 @@
+-- Presents sent to players, items are stored as JSON list of reward items.
+
+create table if not exists present (
+	present_id text primary key,
+	expire_ts bigint not null,
+	description text not null default '',
+	items text not null default '[]'
+);
+
+create table if not exists player_present (
+	user_id integer not null references player(user_id),
+	present_id text not null references present(present_id),
+	primary key (user_id, present_id)
+);
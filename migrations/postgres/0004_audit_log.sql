@@ -0,0 +1,29 @@
+-- Append-only record of player activities and admin actions. Rows are only
+-- ever removed by retention cleaning.
+
+create table if not exists audit_log (
+	log_id bigint generated by default as identity primary key,
+	created_at bigint not null,
+	actor text not null,
+	user_id integer,
+	action text not null,
+	detail text not null default '',
+	remote_addr text not null default '',
+	device text not null default ''
+);
+
+create index if not exists audit_log_user on audit_log(user_id, created_at);
+
+create index if not exists audit_log_action on audit_log(action, created_at);
+
+create or replace function audit_log_append_only() returns trigger as $$
+begin
+	raise exception 'audit_log is append-only';
+end;
+$$ language plpgsql;
+
+drop trigger if exists audit_log_append_only on audit_log;
+
+create trigger audit_log_append_only
+before update on audit_log
+for each row execute function audit_log_append_only();
@@ -0,0 +1,76 @@
+-- Flags are converted from text, 't' for true and anything else for false,
+-- into integer 1 and 0.
+
+alter table game_info
+	alter column world_ranking_enabled type integer using case when world_ranking_enabled = 't' then 1 else 0 end,
+	alter column world_ranking_enabled set default 0,
+	alter column world_ranking_enabled set not null,
+	alter column is_byd_chapter_unlocked type integer using case when is_byd_chapter_unlocked = 't' then 1 else 0 end,
+	alter column is_byd_chapter_unlocked set default 0,
+	alter column is_byd_chapter_unlocked set not null,
+	alter column is_aprilfools type integer using case when is_aprilfools = 't' then 1 else 0 end,
+	alter column is_aprilfools set default 0,
+	alter column is_aprilfools set not null;
+
+alter table partner
+	alter column skill_requires_uncap type integer using case when skill_requires_uncap = 't' then 1 else 0 end,
+	alter column skill_requires_uncap set default 0,
+	alter column skill_requires_uncap set not null;
+
+alter table song
+	alter column remote_dl type integer using case when remote_dl = 't' then 1 else 0 end,
+	alter column remote_dl set default 0,
+	alter column remote_dl set not null;
+
+alter table chart_info
+	alter column remote_dl type integer using case when remote_dl = 't' then 1 else 0 end,
+	alter column remote_dl set default 0,
+	alter column remote_dl set not null;
+
+alter table pack_item
+	alter column is_available type integer using case when is_available = 't' then 1 else 0 end,
+	alter column is_available set default 0,
+	alter column is_available set not null;
+
+alter table world_map
+	alter column is_beyond type integer using case when is_beyond = 't' then 1 else 0 end,
+	alter column is_beyond set default 0,
+	alter column is_beyond set not null,
+	alter column is_legacy type integer using case when is_legacy = 't' then 1 else 0 end,
+	alter column is_legacy set default 0,
+	alter column is_legacy set not null,
+	alter column is_repeatable type integer using case when is_repeatable = 't' then 1 else 0 end,
+	alter column is_repeatable set default 0,
+	alter column is_repeatable set not null;
+
+alter table player
+	alter column is_locked_name_duplicated type integer using case when is_locked_name_duplicated = 't' then 1 else 0 end,
+	alter column is_locked_name_duplicated set default 0,
+	alter column is_locked_name_duplicated set not null,
+	alter column is_skill_sealed type integer using case when is_skill_sealed = 't' then 1 else 0 end,
+	alter column is_skill_sealed set default 0,
+	alter column is_skill_sealed set not null,
+	alter column max_stamina_notification type integer using case when max_stamina_notification = 't' then 1 else 0 end,
+	alter column max_stamina_notification set default 0,
+	alter column max_stamina_notification set not null,
+	alter column is_hide_rating type integer using case when is_hide_rating = 't' then 1 else 0 end,
+	alter column is_hide_rating set default 0,
+	alter column is_hide_rating set not null;
+
+alter table part_stats
+	alter column is_uncapped_override type integer using case when is_uncapped_override = 't' then 1 else 0 end,
+	alter column is_uncapped_override set default 0,
+	alter column is_uncapped_override set not null,
+	alter column is_uncapped type integer using case when is_uncapped = 't' then 1 else 0 end,
+	alter column is_uncapped set default 0,
+	alter column is_uncapped set not null;
+
+alter table player_map_prog
+	alter column is_locked type integer using case when is_locked = 't' then 1 else 0 end,
+	alter column is_locked set default 0,
+	alter column is_locked set not null;
+
+alter table recent_score
+	alter column is_recent_10 type integer using case when is_recent_10 = 't' then 1 else 0 end,
+	alter column is_recent_10 set default 0,
+	alter column is_recent_10 set not null;
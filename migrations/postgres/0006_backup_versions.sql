@@ -0,0 +1,4 @@
+-- PostgreSQL databases have always been created with versioned DATA_BACKUP,
+-- this migration only keeps versions in step with SQLite.
+
+select 1;
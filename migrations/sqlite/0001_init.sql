@@ -0,0 +1,222 @@
+-- Initial schema. Flags are stored as text, 't' for true and '' or null for
+-- false.
+
+create table if not exists game_info (
+	max_stamina integer not null default 12,
+	stamina_recover_tick integer not null default 1800000,
+	core_exp integer not null default 250,
+	world_ranking_enabled text,
+	is_byd_chapter_unlocked text,
+	is_aprilfools text
+);
+
+create table if not exists level_exp (
+	lv integer primary key,
+	exp_val integer not null
+);
+
+create table if not exists partner (
+	part_id integer primary key,
+	part_name text not null,
+	char_type integer not null default 0,
+	skill_id text,
+	skill_id_uncap text,
+	skill_requires_uncap text,
+	skill_unlock_level integer not null default 0
+);
+
+create table if not exists part_voice (
+	part_id integer primary key references partner(part_id)
+);
+
+create table if not exists core (
+	core_id text primary key,
+	internal_id text not null,
+	core_name text not null
+);
+
+create table if not exists pack (
+	pack_name text primary key,
+	price integer not null default 0,
+	orig_price integer not null default 0,
+	discount_from integer not null default 0,
+	discount_to integer not null default 0
+);
+
+create table if not exists song (
+	song_id text primary key,
+	title_local_en text not null default '',
+	pack_name text references pack(pack_name),
+	checksum text not null default '',
+	remote_dl text
+);
+
+create table if not exists chart_info (
+	song_id text not null references song(song_id),
+	difficulty integer not null,
+	rating real not null default 0,
+	checksum text not null default '',
+	remote_dl text,
+	primary key (song_id, difficulty)
+);
+
+create table if not exists pack_item (
+	pack_name text not null references pack(pack_name),
+	item_id text not null,
+	item_type text not null,
+	is_available text,
+	primary key (pack_name, item_id, item_type)
+);
+
+create table if not exists world_map (
+	map_id text primary key,
+	available_from integer not null default -1,
+	available_to integer not null default -1,
+	beyond_health integer not null default 0,
+	chapter integer not null default 0,
+	coordinate text not null default '',
+	custom_bg text,
+	is_beyond text,
+	is_legacy text,
+	is_repeatable text,
+	require_id text,
+	require_type text,
+	require_value integer,
+	stamina_cost integer not null default 0,
+	step_count integer not null default 0
+);
+
+create table if not exists map_affinity (
+	map_id text not null references world_map(map_id),
+	part_id integer not null references partner(part_id),
+	multiplier real not null default 1,
+	primary key (map_id, part_id)
+);
+
+create table if not exists map_reward (
+	map_id text not null references world_map(map_id),
+	position integer not null,
+	reward_id text,
+	item_type text not null,
+	amount integer,
+	primary key (map_id, position, item_type)
+);
+
+create table if not exists player (
+	user_id integer primary key,
+	user_name text not null unique,
+	email text unique,
+	pwdhash text not null default '',
+	user_code integer not null unique,
+	display_name text,
+	ticket integer not null default 0,
+	partner integer default 0,
+	is_locked_name_duplicated text,
+	is_skill_sealed text,
+	curr_map text,
+	prog_boost integer not null default 0,
+	stamina integer not null default 12,
+	next_fragstam_ts integer not null default -1,
+	max_stamina_ts integer not null default -1,
+	max_stamina_notification text,
+	is_hide_rating text,
+	favorite_partner integer,
+	recent_score_date integer,
+	max_friend integer not null default 50,
+	rating integer not null default 0,
+	join_date integer not null default 0
+);
+
+create table if not exists part_stats (
+	user_id integer not null references player(user_id),
+	part_id integer not null references partner(part_id),
+	is_uncapped_override text,
+	is_uncapped text,
+	overdrive real not null default 0,
+	prog real not null default 0,
+	frag real not null default 0,
+	prog_tempest real not null default 0,
+	lv integer not null default 1 references level_exp(lv),
+	exp_val real not null default 0,
+	primary key (user_id, part_id)
+);
+
+create table if not exists core_possess_info (
+	user_id integer not null references player(user_id),
+	core_id text not null references core(core_id),
+	amount integer not null default 0,
+	primary key (user_id, core_id)
+);
+
+create table if not exists pack_purchase_info (
+	user_id integer not null references player(user_id),
+	pack_name text not null references pack(pack_name),
+	primary key (user_id, pack_name)
+);
+
+create table if not exists single_purchase_info (
+	user_id integer not null references player(user_id),
+	song_id text not null references song(song_id),
+	primary key (user_id, song_id)
+);
+
+create table if not exists world_unlock (
+	user_id integer not null references player(user_id),
+	item_name text not null,
+	primary key (user_id, item_name)
+);
+
+create table if not exists world_song_unlock (
+	user_id integer not null references player(user_id),
+	item_name text not null,
+	primary key (user_id, item_name)
+);
+
+create table if not exists player_map_prog (
+	user_id integer not null references player(user_id),
+	map_id text not null references world_map(map_id),
+	curr_capture integer not null default 0,
+	curr_position integer not null default 0,
+	is_locked text,
+	primary key (user_id, map_id)
+);
+
+create table if not exists score (
+	user_id integer not null references player(user_id),
+	played_date integer not null,
+	song_id text not null,
+	difficulty integer not null,
+	score integer not null,
+	shiny_pure integer not null default 0,
+	pure integer not null default 0,
+	far integer not null default 0,
+	lost integer not null default 0,
+	rating real not null default 0,
+	health integer not null default 0,
+	modifier integer,
+	clear_type integer not null default 0,
+	primary key (user_id, played_date)
+);
+
+create table if not exists best_score (
+	user_id integer not null,
+	played_date integer not null,
+	primary key (user_id, played_date),
+	foreign key (user_id, played_date) references score(user_id, played_date)
+);
+
+create table if not exists recent_score (
+	user_id integer not null,
+	played_date integer not null,
+	is_recent_10 text,
+	primary key (user_id, played_date),
+	foreign key (user_id, played_date) references score(user_id, played_date)
+);
+
+create table if not exists data_backup (
+	user_id integer not null references player(user_id),
+	version integer not null,
+	created_at integer not null,
+	backup_data text not null,
+	primary key (user_id, version)
+);
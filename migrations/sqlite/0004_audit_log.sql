@@ -0,0 +1,23 @@
+-- Append-only record of player activities and admin actions. Rows are only
+-- ever removed by retention cleaning.
+
+create table if not exists audit_log (
+	log_id integer primary key autoincrement,
+	created_at integer not null,
+	actor text not null,
+	user_id integer,
+	action text not null,
+	detail text not null default '',
+	remote_addr text not null default '',
+	device text not null default ''
+);
+
+create index if not exists audit_log_user on audit_log(user_id, created_at);
+
+create index if not exists audit_log_action on audit_log(action, created_at);
+
+create trigger if not exists audit_log_append_only
+before update on audit_log
+begin
+	select raise(abort, 'audit_log is append-only');
+end;
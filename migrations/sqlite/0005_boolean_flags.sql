@@ -0,0 +1,124 @@
+-- Flags are converted from text, 't' for true and anything else for false,
+-- into integer 1 and 0. SQLite can't change type of a column, so each table
+-- having flags is rebuilt and renamed back. Tables below are the new layouts,
+-- rows are copied into them by convertBooleanFlags, which matches columns by
+-- name so that databases with columns in another order or extra columns keep
+-- all their data.
+
+create table new_game_info (
+	max_stamina integer not null default 12,
+	stamina_recover_tick integer not null default 1800000,
+	core_exp integer not null default 250,
+	world_ranking_enabled integer not null default 0,
+	is_byd_chapter_unlocked integer not null default 0,
+	is_aprilfools integer not null default 0
+);
+
+create table new_partner (
+	part_id integer primary key,
+	part_name text not null,
+	char_type integer not null default 0,
+	skill_id text,
+	skill_id_uncap text,
+	skill_requires_uncap integer not null default 0,
+	skill_unlock_level integer not null default 0
+);
+
+create table new_song (
+	song_id text primary key,
+	title_local_en text not null default '',
+	pack_name text references pack(pack_name),
+	checksum text not null default '',
+	remote_dl integer not null default 0
+);
+
+create table new_chart_info (
+	song_id text not null references song(song_id),
+	difficulty integer not null,
+	rating real not null default 0,
+	checksum text not null default '',
+	remote_dl integer not null default 0,
+	primary key (song_id, difficulty)
+);
+
+create table new_pack_item (
+	pack_name text not null references pack(pack_name),
+	item_id text not null,
+	item_type text not null,
+	is_available integer not null default 0,
+	primary key (pack_name, item_id, item_type)
+);
+
+create table new_world_map (
+	map_id text primary key,
+	available_from integer not null default -1,
+	available_to integer not null default -1,
+	beyond_health integer not null default 0,
+	chapter integer not null default 0,
+	coordinate text not null default '',
+	custom_bg text,
+	is_beyond integer not null default 0,
+	is_legacy integer not null default 0,
+	is_repeatable integer not null default 0,
+	require_id text,
+	require_type text,
+	require_value integer,
+	stamina_cost integer not null default 0,
+	step_count integer not null default 0
+);
+
+create table new_player (
+	user_id integer primary key,
+	user_name text not null unique,
+	email text unique,
+	pwdhash text not null default '',
+	user_code integer not null unique,
+	display_name text,
+	ticket integer not null default 0,
+	partner integer default 0,
+	is_locked_name_duplicated integer not null default 0,
+	is_skill_sealed integer not null default 0,
+	curr_map text,
+	prog_boost integer not null default 0,
+	stamina integer not null default 12,
+	next_fragstam_ts integer not null default -1,
+	max_stamina_ts integer not null default -1,
+	max_stamina_notification integer not null default 0,
+	is_hide_rating integer not null default 0,
+	favorite_partner integer,
+	recent_score_date integer,
+	max_friend integer not null default 50,
+	rating integer not null default 0,
+	join_date integer not null default 0
+);
+
+create table new_part_stats (
+	user_id integer not null references player(user_id),
+	part_id integer not null references partner(part_id),
+	is_uncapped_override integer not null default 0,
+	is_uncapped integer not null default 0,
+	overdrive real not null default 0,
+	prog real not null default 0,
+	frag real not null default 0,
+	prog_tempest real not null default 0,
+	lv integer not null default 1 references level_exp(lv),
+	exp_val real not null default 0,
+	primary key (user_id, part_id)
+);
+
+create table new_player_map_prog (
+	user_id integer not null references player(user_id),
+	map_id text not null references world_map(map_id),
+	curr_capture integer not null default 0,
+	curr_position integer not null default 0,
+	is_locked integer not null default 0,
+	primary key (user_id, map_id)
+);
+
+create table new_recent_score (
+	user_id integer not null,
+	played_date integer not null,
+	is_recent_10 integer not null default 0,
+	primary key (user_id, played_date),
+	foreign key (user_id, played_date) references score(user_id, played_date)
+);
@@ -0,0 +1,14 @@
+-- Databases created before backups were versioned still have DATA_BACKUP with
+-- a single pseudo-JSON row per user, since 0001_init only creates the table
+-- when it's missing. The table is rebuilt here, its rows are copied back by
+-- convertOldBackups in migrate.go, which also drops the old table.
+
+alter table data_backup rename to old_data_backup;
+
+create table data_backup (
+	user_id integer not null references player(user_id),
+	version integer not null,
+	created_at integer not null,
+	backup_data text not null,
+	primary key (user_id, version)
+);
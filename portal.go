@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PortalRoot is leading path of player portal pages.
+var PortalRoot = "/portal"
+
+// portalCookie holds JWT of player logged into portal.
+const portalCookie = "zrc_portal"
+
+// portalHistoryPageSize is number of plays listed on a page of play history.
+const portalHistoryPageSize = 50
+
+// portalFS holds portal page templates, every page is rendered inside
+// `layout.html`.
+//
+//go:embed portal/*.html
+var portalFS embed.FS
+
+var portalTemplates = map[string]*template.Template{}
+
+var portalFuncs = template.FuncMap{
+	"diffName":      diffName,
+	"clearTypeName": clearTypeName,
+	"unix": func(sec int64) string {
+		return time.Unix(sec, 0).Format("2006-01-02 15:04")
+	},
+	"unixMilli": func(msec int64) string {
+		return time.Unix(0, msec*int64(time.Millisecond)).Format("2006-01-02")
+	},
+	"add": func(a, b int) int { return a + b },
+}
+
+// portalSortKeys are keys of scoreSorts in order listed on best score page.
+var portalSortKeys = []string{"rating", "score", "base", "date", "title"}
+
+// portalPage is data passed to every portal template.
+type portalPage struct {
+	Root   string
+	Active string
+	Player *PlayerSummary
+	Error  string
+	Data   interface{}
+}
+
+func init() {
+	pages, err := portalFS.ReadDir("portal")
+	if err != nil {
+		stdLog.Fatal("Error occured while reading portal pages", "err", err)
+	}
+	for _, page := range pages {
+		name := page.Name()
+		if name == "layout.html" {
+			continue
+		}
+		tmpl, err := template.New(name).Funcs(portalFuncs).ParseFS(
+			portalFS, "portal/layout.html", path.Join("portal", name),
+		)
+		if err != nil {
+			stdLog.Fatal("Error occured while parsing portal page", "page", name, "err", err)
+		}
+		portalTemplates[strings.TrimSuffix(name, ".html")] = tmpl
+	}
+}
+
+func (s *Server) setPortalRouting(router *mux.Router) {
+	portal := router.PathPrefix(PortalRoot).Subrouter()
+	portal.Path("/login").Methods("GET").HandlerFunc(s.portalLoginPage)
+	portal.Path("/login").Methods("POST").HandlerFunc(s.portalLogin)
+	portal.Path("/logout").Methods("POST").HandlerFunc(s.portalLogout)
+
+	portal.Path("/").Methods("GET").Handler(s.portalAuth(s.portalProfile))
+	portal.Path("/recent").Methods("GET").Handler(s.portalAuth(s.portalRecent))
+	portal.Path("/best").Methods("GET").Handler(s.portalAuth(s.portalBest))
+	portal.Path("/history").Methods("GET").Handler(s.portalAuth(s.portalHistory))
+	portal.Path("/characters").Methods("GET").Handler(s.portalAuth(s.portalCharacters))
+}
+
+// Section: Session
+// ============================================================================
+
+// portalRoot is path of portal pages as seen by clients, under path of public
+// URL.
+func (s *Server) portalRoot() string {
+	return s.publicPath(PortalRoot)
+}
+
+// portalAuth resolves player from portal cookie, redirecting to login page
+// when there's no valid session.
+func (s *Server) portalAuth(next func(w http.ResponseWriter, r *http.Request, page *portalPage)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := s.cfg().StaticUserID
+		if s.cfg().Auth {
+			cookie, err := r.Cookie(portalCookie)
+			if err == nil {
+				userID, err = s.verifyBearerAuth("Bearer " + cookie.Value)
+			}
+			if err != nil {
+				http.Redirect(w, r, path.Join(s.portalRoot(), "login"), http.StatusSeeOther)
+				return
+			}
+		}
+		setRequestUser(r, userID)
+
+		player, err := s.store.PlayerSummary(userID)
+		if err == sql.ErrNoRows {
+			s.portalClearCookie(w)
+			http.Redirect(w, r, path.Join(s.portalRoot(), "login"), http.StatusSeeOther)
+			return
+		} else if err != nil {
+			requestLog(r).Error("Error occured while reading player", "err", err)
+			http.Error(w, "Server side error", http.StatusInternalServerError)
+			return
+		}
+		next(w, r, &portalPage{Root: s.portalRoot(), Player: player})
+	})
+}
+
+func (s *Server) portalLoginPage(w http.ResponseWriter, r *http.Request) {
+	renderPortal(w, r, "login", &portalPage{Root: s.portalRoot(), Active: "login"})
+}
+
+func (s *Server) portalLogin(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	user := r.PostForm.Get("name")
+	userID, ok, err := s.checkPassword(user, r.PostForm.Get("password"))
+	if err != nil {
+		requestLog(r).Error("Error occured while checking password", "name", user, "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		s.writeAudit(r, "anonymous", 0, auditLoginFailed, fmt.Sprintf("portal name=%q", user))
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		renderPortal(w, r, "login", &portalPage{
+			Root: s.portalRoot(), Active: "login", Error: "Wrong user name or password.",
+		})
+		return
+	}
+
+	s.writeAudit(r, playerActor(userID), userID, auditLogin, "portal")
+	http.SetCookie(w, &http.Cookie{
+		Name:     portalCookie,
+		Value:    s.genJWT(userID),
+		Path:     s.portalRoot(),
+		MaxAge:   int(s.cfg().TokenExpires.Seconds()),
+		HttpOnly: true,
+		Secure:   s.cfg().TLSCert != "" || s.publicURL.Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, s.portalRoot()+"/", http.StatusSeeOther)
+}
+
+func (s *Server) portalLogout(w http.ResponseWriter, r *http.Request) {
+	s.portalClearCookie(w)
+	http.Redirect(w, r, path.Join(s.portalRoot(), "login"), http.StatusSeeOther)
+}
+
+func (s *Server) portalClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name: portalCookie, Value: "", Path: s.portalRoot(), MaxAge: -1, HttpOnly: true,
+	})
+}
+
+func renderPortal(w http.ResponseWriter, r *http.Request, name string, page *portalPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := portalTemplates[name].ExecuteTemplate(w, "layout", page); err != nil {
+		requestLog(r).Error("Error occured while rendering portal page", "page", name, "err", err)
+	}
+}
+
+// Section: Pages
+// ============================================================================
+
+func (s *Server) portalProfile(w http.ResponseWriter, r *http.Request, page *portalPage) {
+	userID := page.Player.UserID
+	summary, err := getRatingSummary(s.store, userID)
+	if err != nil {
+		requestLog(r).Error("Error occured while getting r10 and b30", "err", err)
+	}
+	plays, last, err := s.store.PlayCount(userID)
+	if err != nil {
+		requestLog(r).Error("Error occured while counting plays", "err", err)
+	}
+	page.Active = "profile"
+	page.Data = map[string]interface{}{
+		"B30": summary.B30, "R10": summary.R10, "Plays": plays, "LastPlayed": last,
+	}
+	renderPortal(w, r, "profile", page)
+}
+
+func (s *Server) portalRecent(w http.ResponseWriter, r *http.Request, page *portalPage) {
+	scores, err := s.store.RecentScores(page.Player.UserID)
+	if err != nil {
+		requestLog(r).Error("Error occured while reading recent scores", "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
+	}
+	page.Active = "recent"
+	page.Data = scores
+	renderPortal(w, r, "recent", page)
+}
+
+func (s *Server) portalBest(w http.ResponseWriter, r *http.Request, page *portalPage) {
+	query := r.URL.Query()
+	filter := ScoreFilter{
+		Sort:       query.Get("sort"),
+		Difficulty: portalIntParam(query.Get("diff")),
+		Pack:       query.Get("pack"),
+		ClearType:  portalIntParam(query.Get("clear")),
+	}
+	if _, ok := scoreSorts[filter.Sort]; !ok {
+		filter.Sort = "rating"
+	}
+
+	scores, err := s.store.BestScores(page.Player.UserID, filter)
+	if err != nil {
+		requestLog(r).Error("Error occured while reading best scores", "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
+	}
+	packs, err := s.store.PackNames()
+	if err != nil {
+		requestLog(r).Error("Error occured while reading pack list", "err", err)
+	}
+
+	page.Active = "best"
+	page.Data = map[string]interface{}{
+		"Scores": scores, "Sort": filter.Sort, "Diff": filter.Difficulty, "Clear": filter.ClearType, "Pack": filter.Pack,
+		"Packs": packs, "Diffs": diffs, "ClearTypes": clearTypes, "Sorts": portalSortKeys,
+	}
+	renderPortal(w, r, "best", page)
+}
+
+func (s *Server) portalHistory(w http.ResponseWriter, r *http.Request, page *portalPage) {
+	pageNum := portalIntParam(r.URL.Query().Get("page"))
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	scores, err := s.store.ScoreHistory(
+		page.Player.UserID, portalHistoryPageSize+1, (pageNum-1)*portalHistoryPageSize,
+	)
+	if err != nil {
+		requestLog(r).Error("Error occured while reading play history", "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
+	}
+	hasNext := len(scores) > portalHistoryPageSize
+	if hasNext {
+		scores = scores[:portalHistoryPageSize]
+	}
+
+	// group plays by day for timeline
+	type day struct {
+		Date   string
+		Scores []ScoreEntry
+	}
+	days := []*day{}
+	for _, score := range scores {
+		date := time.Unix(score.TimePlayed, 0).Format("2006-01-02")
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			days = append(days, &day{Date: date})
+		}
+		last := days[len(days)-1]
+		last.Scores = append(last.Scores, score)
+	}
+
+	page.Active = "history"
+	page.Data = map[string]interface{}{
+		"Days": days, "Page": pageNum, "HasNext": hasNext,
+	}
+	renderPortal(w, r, "history", page)
+}
+
+func (s *Server) portalCharacters(w http.ResponseWriter, r *http.Request, page *portalPage) {
+	stats, err := s.store.Characters(page.Player.UserID, -1)
+	if err != nil {
+		requestLog(r).Error("Error occured while reading characters", "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
+	}
+	current, err := s.store.CurrentPartner(page.Player.UserID)
+	if err != nil {
+		requestLog(r).Error("Error occured while reading current character", "err", err)
+	}
+	page.Active = "characters"
+	page.Data = map[string]interface{}{"Characters": stats, "Current": current}
+	renderPortal(w, r, "characters", page)
+}
+
+// portalIntParam parses optional integer query parameter, -1 for absent or
+// invalid value.
+func portalIntParam(value string) int {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return -1
+	}
+	return i
+}
@@ -2,72 +2,36 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 )
 
-func packInfoHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) packInfoHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		userID int
 		err    error
 	)
-	if NeedAuth {
-		userID, err = verifyBearerAuth(r.Header.Get("Authorization"))
+	if s.cfg().Auth {
+		userID, err = s.verifyBearerAuth(r.Header.Get("Authorization"))
 		if err != nil {
 			c := Container{false, nil, 203}
 			http.Error(w, c.toJSON(), http.StatusUnauthorized)
 			return
 		}
 	} else {
-		userID = staticUserID
+		userID = s.cfg().StaticUserID
 	}
-	tojson, err := getPackInfo(userID, r)
+	setRequestUser(r, userID)
+	tojson, err := s.getPackInfo(userID, r)
 	if err != nil {
-		log.Println(err)
+		requestLog(r).Error("Error occured while getting pack info", "err", err)
 	}
 	fmt.Fprint(w, tojson.toJSON())
 }
 
-func getPackInfo(_ int, _ *http.Request) (ToJSON, error) {
-	container := []PackInfo{}
-	rows, err := db.Query(sqlStmtPackInfo)
+func (s *Server) getPackInfo(_ int, _ *http.Request) (ToJSON, error) {
+	container, err := s.store.Packs()
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		info := new(PackInfo)
-		rows.Scan(
-			&info.Name,
-			&info.Price,
-			&info.OrigPrice,
-			&info.DiscountFrom,
-			&info.DiscountTo,
-		)
-		items := []PackItem{}
-		itemRows, err := db.Query(sqlStmtPackItem, info.Name)
-		if err != nil {
-			return nil, err
-		}
-		defer itemRows.Close()
-
-		for itemRows.Next() {
-			item := new(PackItem)
-			itemRows.Scan(&item.ID, &item.ItemType, &item.IsAvailable)
-			items = append(items, *item)
-		}
-
-		if err := itemRows.Err(); err != nil {
-			return nil, err
-		}
-
-		container = append(container, *info)
-	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-
 	return (*PackInfoContainer)(&container), nil
 }
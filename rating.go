@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Number of best and recent plays counted in player potential, the sum of
+// both is always divided by their total regardless of how many plays a player
+// actually has.
+const (
+	ratingBestCount   = 30
+	ratingRecentCount = 10
+)
+
+// ratingSummary is potential of a player together with its two parts.
+type ratingSummary struct {
+	// B30 and R10 are averages of top 30 best plays and top 10 recent plays,
+	// missing plays count as 0.
+	B30 float64
+	R10 float64
+	// Potential is player rating truncated to 2 decimal places and stored as
+	// hundredths, same as RATING column of PLAYER.
+	Potential int
+}
+
+// playRating computes rating of a single play from chart constant and score.
+func playRating(baseRating float64, score int) float64 {
+	var rating float64
+	if score >= 10_000_000 {
+		rating = baseRating + 2
+	} else if score >= 9_800_000 {
+		rating = baseRating + 1 + float64(score-9_800_000)/200_000
+	} else {
+		rating = baseRating + float64(score-9_500_000)/300_000
+	}
+	return math.Max(rating, 0)
+}
+
+// computeRating sums top 30 of best ratings and top 10 of recent ratings and
+// divides the sum by 40. Neither slice needs to be sorted.
+func computeRating(best []float64, recent []float64) ratingSummary {
+	bestSum := topRatingSum(best, ratingBestCount)
+	recentSum := topRatingSum(recent, ratingRecentCount)
+	potential := (bestSum + recentSum) / (ratingBestCount + ratingRecentCount)
+	return ratingSummary{
+		B30: bestSum / ratingBestCount,
+		R10: recentSum / ratingRecentCount,
+		// small epsilon keeps values like 12.50 from being truncated to 12.49
+		// by floating point error
+		Potential: int(math.Floor(potential*100 + 1e-9)),
+	}
+}
+
+func topRatingSum(ratings []float64, n int) float64 {
+	sorted := append([]float64(nil), ratings...)
+	sort.Sort(sort.Reverse(sort.Float64Slice(sorted)))
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	var sum float64
+	for _, rating := range sorted {
+		sum += rating
+	}
+	return sum
+}
+
+// getRatingSummary reads best and recent 10 ratings of player and computes
+// potential from them.
+func getRatingSummary(src ratingSource, userID int) (ratingSummary, error) {
+	best, err := src.BestRatings(userID)
+	if err != nil {
+		return ratingSummary{}, err
+	}
+	recent, err := src.Recent10Ratings(userID)
+	if err != nil {
+		return ratingSummary{}, err
+	}
+	return computeRating(best, recent), nil
+}
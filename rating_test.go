@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// repeatRating makes n ratings of the same value.
+func repeatRating(rating float64, n int) []float64 {
+	ratings := make([]float64, n)
+	for i := range ratings {
+		ratings[i] = rating
+	}
+	return ratings
+}
+
+func TestPlayRating(t *testing.T) {
+	cases := []struct {
+		base  float64
+		score int
+		want  float64
+	}{
+		{10, 10_002_221, 12},
+		{10, 10_000_000, 12},
+		{10, 9_900_000, 11.5},
+		{10, 9_800_000, 11},
+		{10, 9_650_000, 10.5},
+		{10, 9_500_000, 10},
+		{10, 9_200_000, 9},
+		{1.5, 8_000_000, 0},
+	}
+	for _, c := range cases {
+		if got := playRating(c.base, c.score); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("playRating(%v, %d) = %v, want %v", c.base, c.score, got, c.want)
+		}
+	}
+}
+
+func TestComputeRating(t *testing.T) {
+	cases := []struct {
+		name      string
+		best      []float64
+		recent    []float64
+		b30, r10  float64
+		potential int
+	}{
+		{"no plays", nil, nil, 0, 0, 0},
+		{
+			// a single play is still divided by 40
+			"one best play", []float64{12}, nil,
+			0.4, 0, 30,
+		},
+		{
+			"one recent play", nil, []float64{10},
+			0, 1, 25,
+		},
+		{
+			"full", repeatRating(12, 30), repeatRating(13, 10),
+			12, 13, 1225,
+		},
+		{
+			"only top 30 and top 10 count",
+			append(repeatRating(1, 5), repeatRating(12, 30)...),
+			append([]float64{1, 2}, repeatRating(13, 10)...),
+			12, 13, 1225,
+		},
+		{
+			"unsorted input",
+			append(append(repeatRating(11, 15), repeatRating(2, 3)...), repeatRating(13, 15)...),
+			[]float64{1, 14, 1, 14, 14, 14, 14, 14, 14, 14, 14, 14},
+			12, 14, 1250,
+		},
+		{
+			"truncated, not rounded",
+			repeatRating(12.5, 30), append(repeatRating(12.5, 9), 12.4),
+			12.5, 12.49, 1249,
+		},
+		{"exact 12.50", repeatRating(12.5, 30), repeatRating(12.5, 10), 12.5, 12.5, 1250},
+		// sums of these are a little below the exact value in floating
+		// point, they must not be truncated one hundredth lower
+		{"float error 12.51", repeatRating(12.51, 30), repeatRating(12.51, 10), 12.51, 12.51, 1251},
+		{"float error 12.57", repeatRating(12.57, 30), repeatRating(12.57, 10), 12.57, 12.57, 1257},
+		{"float error 11.70", repeatRating(11.7, 30), repeatRating(11.7, 10), 11.7, 11.7, 1170},
+	}
+	for _, c := range cases {
+		got := computeRating(c.best, c.recent)
+		if math.Abs(got.B30-c.b30) > 1e-9 || math.Abs(got.R10-c.r10) > 1e-9 || got.Potential != c.potential {
+			t.Errorf("%s: computeRating = %+v, want B30 %v, R10 %v, potential %d", c.name, got, c.b30, c.r10, c.potential)
+		}
+	}
+}
+
+// testRatingSource serves fixed ratings.
+type testRatingSource struct {
+	best, recent []float64
+}
+
+func (s testRatingSource) BestRatings(userID int) ([]float64, error) {
+	return s.best, nil
+}
+
+func (s testRatingSource) Recent10Ratings(userID int) ([]float64, error) {
+	return s.recent, nil
+}
+
+func TestGetRatingSummary(t *testing.T) {
+	src := testRatingSource{best: repeatRating(11, 30), recent: repeatRating(12, 10)}
+	got, err := getRatingSummary(src, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Potential != 1125 {
+		t.Errorf("getRatingSummary potential = %d, want 1125", got.Potential)
+	}
+}
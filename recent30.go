@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Size limits of Recent 30 and the Recent 10 picked from it.
+const (
+	recent30Size    = 30
+	recent10Size    = 10
+	recentMinCharts = 10
+	recentExScore   = 9_800_000
+	recentHardClear = int8(5)
+)
+
+// recentPlay is a play kept in Recent 30, chart identifies song and
+// difficulty.
+type recentPlay struct {
+	playedDate int64
+	chart      string
+	rating     float64
+	isR10      bool
+}
+
+// recent30 holds the latest plays of a player, oldest first. It has no
+// knowledge of database, see updateRecentScore for persisting it.
+//
+// Rules kept by insert:
+//   - there are never more than 30 plays, the oldest play is replaced once
+//     it's full;
+//   - a protected play (EX score or hard clear) never pushes a Recent 10 play
+//     out, so it can't lower Recent 10;
+//   - when possible, replacing keeps at least 10 distinct charts so that
+//     Recent 10 can always be filled;
+//   - Recent 10 is the 10 highest rated plays with distinct charts.
+type recent30 struct {
+	plays []recentPlay
+}
+
+func newRecent30(plays []recentPlay) *recent30 {
+	r := &recent30{plays: append([]recentPlay(nil), plays...)}
+	sort.SliceStable(r.plays, func(i, j int) bool {
+		return r.plays[i].playedDate < r.plays[j].playedDate
+	})
+	r.markR10()
+	return r
+}
+
+// insert adds play into Recent 30, returns the play taken out to make room
+// for it, if any.
+func (r *recent30) insert(play recentPlay, protected bool) *recentPlay {
+	play.isR10 = false
+	if len(r.plays) < recent30Size {
+		r.plays = append(r.plays, play)
+		r.markR10()
+		return nil
+	}
+
+	victim := r.pickVictim(play, protected)
+	removed := r.plays[victim]
+	r.plays = append(r.plays[:victim], r.plays[victim+1:]...)
+	r.plays = append(r.plays, play)
+	r.markR10()
+	return &removed
+}
+
+// pickVictim finds index of the play to be replaced by play, falling back to
+// the oldest one allowed when no play satisfies every rule.
+func (r *recent30) pickVictim(play recentPlay, protected bool) int {
+	counts := map[string]int{play.chart: 1}
+	for _, p := range r.plays {
+		counts[p.chart]++
+	}
+
+	fallback := -1
+	for i, p := range r.plays {
+		if protected && p.isR10 {
+			continue
+		}
+		if fallback < 0 {
+			fallback = i
+		}
+		if counts[p.chart] == 1 && len(counts) <= recentMinCharts {
+			// removing the only play of this chart would leave too few charts
+			continue
+		}
+		return i
+	}
+	if fallback < 0 {
+		return 0
+	}
+	return fallback
+}
+
+// markR10 flags the highest rated play of each chart, up to 10 charts, as
+// Recent 10. Newer play wins on equal rating.
+func (r *recent30) markR10() {
+	order := make([]int, len(r.plays))
+	for i := range order {
+		order[i] = i
+		r.plays[i].isR10 = false
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := r.plays[order[i]], r.plays[order[j]]
+		if a.rating != b.rating {
+			return a.rating > b.rating
+		}
+		return a.playedDate > b.playedDate
+	})
+
+	seen := map[string]bool{}
+	for _, i := range order {
+		if len(seen) == recent10Size {
+			break
+		}
+		if chart := r.plays[i].chart; !seen[chart] {
+			seen[chart] = true
+			r.plays[i].isR10 = true
+		}
+	}
+}
+
+// Section: Persisting
+// ============================================================================
+
+// updateRecentScore puts record into Recent 30 of user and writes changes of
+// RECENT_SCORE back.
+func updateRecentScore(tx ScoreTx, userID int, record *ScoreRecord) error {
+	plays, err := tx.RecentPlays(userID)
+	if err != nil {
+		return fmt.Errorf("error occured while reading recent score: %w", err)
+	}
+
+	before := map[int64]bool{}
+	for _, play := range plays {
+		before[play.playedDate] = play.isR10
+	}
+
+	recent := newRecent30(plays)
+	removed := recent.insert(
+		recentPlay{
+			playedDate: record.TimePlayed,
+			chart:      fmt.Sprintf("%s%d", record.SongID, record.Difficulty),
+			rating:     record.Rating,
+		},
+		record.Score >= recentExScore || record.ClearType == recentHardClear,
+	)
+
+	if removed != nil {
+		if err := tx.DeleteRecentPlay(userID, removed.playedDate); err != nil {
+			return fmt.Errorf("error occured while removing recent score: %w", err)
+		}
+	}
+	for _, play := range recent.plays {
+		wasR10, existed := before[play.playedDate]
+		if !existed {
+			err = tx.InsertRecentPlay(userID, play)
+		} else if wasR10 != play.isR10 {
+			err = tx.SetRecent10(userID, play.playedDate, play.isR10)
+		}
+		if err != nil {
+			return fmt.Errorf("error occured while writing recent score: %w", err)
+		}
+	}
+	return nil
+}
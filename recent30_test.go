@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// testPlays makes plays played at 1, 2, 3... on given charts, rated by
+// ratings when given and 10 otherwise.
+func testPlays(charts []string, ratings ...float64) []recentPlay {
+	plays := make([]recentPlay, len(charts))
+	for i, chart := range charts {
+		plays[i] = recentPlay{playedDate: int64(i + 1), chart: chart, rating: 10}
+		if i < len(ratings) {
+			plays[i].rating = ratings[i]
+		}
+	}
+	return plays
+}
+
+// distinctCharts makes n charts named c0, c1, c2...
+func distinctCharts(n int) []string {
+	charts := make([]string, n)
+	for i := range charts {
+		charts[i] = fmt.Sprintf("c%d", i)
+	}
+	return charts
+}
+
+func recentR10(r *recent30) []int64 {
+	dates := []int64{}
+	for _, p := range r.plays {
+		if p.isR10 {
+			dates = append(dates, p.playedDate)
+		}
+	}
+	return dates
+}
+
+func TestRecent30MarkR10(t *testing.T) {
+	cases := []struct {
+		name    string
+		charts  []string
+		ratings []float64
+		want    []int64
+	}{
+		{"empty", nil, nil, []int64{}},
+		{"best play of each chart", []string{"a", "a", "b"}, []float64{9, 11, 10}, []int64{2, 3}},
+		{"newer wins tie", []string{"a", "a"}, []float64{10, 10}, []int64{2}},
+		{
+			"only 10 charts",
+			distinctCharts(12),
+			[]float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+			[]int64{3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+		},
+		{
+			"repeated chart doesn't take a slot",
+			[]string{"a", "a", "a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"},
+			[]float64{12, 12, 12, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			[]int64{3, 5, 6, 7, 8, 9, 10, 11, 12, 13},
+		},
+	}
+	for _, c := range cases {
+		r := newRecent30(testPlays(c.charts, c.ratings...))
+		if got := recentR10(r); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%s: Recent 10 = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRecent30Insert(t *testing.T) {
+	// 30 plays of 15 charts, two plays each, ratings rise with time
+	fifteen := make([]string, 30)
+	ratings := make([]float64, 30)
+	for i := range fifteen {
+		fifteen[i] = fmt.Sprintf("c%d", i%15)
+		ratings[i] = float64(i)
+	}
+	// 30 plays of 10 charts, chart c0 is played only once and first
+	ten := []string{"c0"}
+	for i := 1; len(ten) < 30; i++ {
+		ten = append(ten, fmt.Sprintf("c%d", i%9+1))
+	}
+
+	cases := []struct {
+		name        string
+		plays       []recentPlay
+		play        recentPlay
+		protected   bool
+		wantRemoved int64 // played date of removed play, 0 for none
+	}{
+		{
+			name:  "not full",
+			plays: testPlays(distinctCharts(29)),
+			play:  recentPlay{playedDate: 100, chart: "new", rating: 5},
+		},
+		{
+			name:        "oldest is replaced",
+			plays:       testPlays(fifteen, ratings...),
+			play:        recentPlay{playedDate: 100, chart: "new", rating: 5},
+			wantRemoved: 1,
+		},
+		{
+			name:        "only play of a chart is kept to have 10 charts",
+			plays:       testPlays(ten),
+			play:        recentPlay{playedDate: 100, chart: "c1", rating: 5},
+			wantRemoved: 2,
+		},
+		{
+			name:        "new chart can replace only play of a chart",
+			plays:       testPlays(ten),
+			play:        recentPlay{playedDate: 100, chart: "new", rating: 5},
+			wantRemoved: 1,
+		},
+		{
+			// the 10 latest plays are Recent 10, the oldest ones are not
+			name:        "protected play replaces oldest play anyway when it's not Recent 10",
+			plays:       testPlays(fifteen, ratings...),
+			play:        recentPlay{playedDate: 100, chart: "new", rating: 1},
+			protected:   true,
+			wantRemoved: 1,
+		},
+		{
+			name:        "protected play skips Recent 10",
+			plays:       testPlays(fifteen, append([]float64{50}, ratings[1:]...)...),
+			play:        recentPlay{playedDate: 100, chart: "new", rating: 1},
+			protected:   true,
+			wantRemoved: 2,
+		},
+		{
+			name:        "unprotected play may push Recent 10 out",
+			plays:       testPlays(fifteen, append([]float64{50}, ratings[1:]...)...),
+			play:        recentPlay{playedDate: 100, chart: "new", rating: 1},
+			wantRemoved: 1,
+		},
+	}
+	for _, c := range cases {
+		r := newRecent30(c.plays)
+		removed := r.insert(c.play, c.protected)
+		switch {
+		case c.wantRemoved == 0 && removed != nil:
+			t.Errorf("%s: removed %+v, want none", c.name, *removed)
+		case c.wantRemoved != 0 && removed == nil:
+			t.Errorf("%s: removed nothing, want play %d", c.name, c.wantRemoved)
+		case removed != nil && removed.playedDate != c.wantRemoved:
+			t.Errorf("%s: removed play %d, want play %d", c.name, removed.playedDate, c.wantRemoved)
+		}
+		if last := r.plays[len(r.plays)-1]; last.playedDate != c.play.playedDate {
+			t.Errorf("%s: latest play is %d, want %d", c.name, last.playedDate, c.play.playedDate)
+		}
+	}
+}
+
+// TestRecent30Random inserts random plays and checks rules of recent30 hold
+// after each of them.
+func TestRecent30Random(t *testing.T) {
+	for seed := int64(1); seed <= 200; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		// few charts make repeated plays and the 10 charts rule likely
+		charts := distinctCharts(rng.Intn(20) + 1)
+		r := newRecent30(nil)
+
+		for date := int64(1); date <= 200; date++ {
+			play := recentPlay{
+				playedDate: date,
+				chart:      charts[rng.Intn(len(charts))],
+				rating:     float64(rng.Intn(130)) / 10,
+			}
+			protected := rng.Intn(3) == 0
+
+			before := append([]recentPlay(nil), r.plays...)
+			chartsBefore := map[string]bool{play.chart: true}
+			for _, p := range before {
+				chartsBefore[p.chart] = true
+			}
+			r10Before := recentR10Sum(r)
+
+			removed := r.insert(play, protected)
+
+			where := fmt.Sprintf("seed %d, play %d", seed, date)
+			if len(r.plays) > recent30Size {
+				t.Fatalf("%s: %d plays in Recent 30", where, len(r.plays))
+			}
+			if (removed != nil) != (len(before) == recent30Size) {
+				t.Fatalf("%s: removed %v with %d plays before", where, removed, len(before))
+			}
+			checkRecent10(t, where, r)
+
+			if protected && removed != nil && removed.isR10 {
+				t.Fatalf("%s: protected play pushed Recent 10 play %+v out", where, *removed)
+			}
+			if protected && recentR10Sum(r) < r10Before {
+				t.Fatalf("%s: protected play lowered Recent 10 from %v to %v", where, r10Before, recentR10Sum(r))
+			}
+			if !protected {
+				chartsAfter := map[string]bool{}
+				for _, p := range r.plays {
+					chartsAfter[p.chart] = true
+				}
+				want := len(chartsBefore)
+				if want > recentMinCharts {
+					want = recentMinCharts
+				}
+				if len(chartsAfter) < want {
+					t.Fatalf("%s: %d charts left in Recent 30, want at least %d", where, len(chartsAfter), want)
+				}
+			}
+		}
+	}
+}
+
+// checkRecent10 makes sure Recent 10 are the best plays of up to 10 distinct
+// charts.
+func checkRecent10(t *testing.T, where string, r *recent30) {
+	t.Helper()
+	best := map[string]float64{}
+	for _, p := range r.plays {
+		if rating, ok := best[p.chart]; !ok || p.rating > rating {
+			best[p.chart] = p.rating
+		}
+	}
+	ratings := []float64{}
+	for _, rating := range best {
+		ratings = append(ratings, rating)
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(ratings)))
+	if len(ratings) > recent10Size {
+		ratings = ratings[:recent10Size]
+	}
+
+	seen := map[string]bool{}
+	count := 0
+	for _, p := range r.plays {
+		if !p.isR10 {
+			continue
+		}
+		count++
+		if seen[p.chart] {
+			t.Fatalf("%s: chart %s is in Recent 10 twice", where, p.chart)
+		}
+		seen[p.chart] = true
+		if p.rating != best[p.chart] {
+			t.Fatalf("%s: Recent 10 play of %s is rated %v, best is %v", where, p.chart, p.rating, best[p.chart])
+		}
+	}
+	if count != len(ratings) {
+		t.Fatalf("%s: %d plays in Recent 10, want %d", where, count, len(ratings))
+	}
+	if sum, want := recentR10Sum(r), sumFloats(ratings); sum != want {
+		t.Fatalf("%s: Recent 10 sums to %v, best possible is %v", where, sum, want)
+	}
+}
+
+func recentR10Sum(r *recent30) float64 {
+	ratings := []float64{}
+	for _, p := range r.plays {
+		if p.isR10 {
+			ratings = append(ratings, p.rating)
+		}
+	}
+	return sumFloats(ratings)
+}
+
+// sumFloats adds up values from the largest, so that equal sets of values
+// always give equal sums.
+func sumFloats(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Sort(sort.Reverse(sort.Float64Slice(sorted)))
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	return sum
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"crypto/md5"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +18,15 @@ import (
 // DataAndChecksumKeys are keys must be included in uploaded backup date
 var DataAndChecksumKeys []string
 
+// Error codes returned for backup requests.
+const (
+	errorCodeBackupNotFound    = 402
+	errorCodeBackupMissingKey  = 403
+	errorCodeBackupChecksum    = 404
+	errorCodeBackupInvalidData = 405
+	errorCodeBackupTooLarge    = 406
+)
+
 func init() {
 
 	DataAndChecksumKeys = []string{
@@ -22,79 +35,177 @@ func init() {
 	}
 }
 
-func returnBackup(w http.ResponseWriter, r *http.Request) {
+func (s *Server) returnBackup(w http.ResponseWriter, r *http.Request) {
 	var (
 		userID int
 		err    error
 	)
-	if NeedAuth {
-		userID, err = verifyBearerAuth(r.Header.Get("Authorization"))
+	if s.cfg().Auth {
+		userID, err = s.verifyBearerAuth(r.Header.Get("Authorization"))
 		if err != nil {
 			c := Container{false, nil, 203}
 			http.Error(w, c.toJSON(), http.StatusUnauthorized)
 			return
 		}
 	} else {
-		userID = staticUserID
+		userID = s.cfg().StaticUserID
 	}
+	setRequestUser(r, userID)
 
-	var data string
-	err = db.QueryRow(sqlStmtReadBackupData, userID).Scan(&data)
+	form, err := forms.Parse(r)
 	if err != nil {
-		log.Printf("%s: Error occured while querying table DATA_BACKUP for downloading data: %s\n", r.URL.Path, err)
-	} else if data == "" {
-		http.Error(w, `{"success":false,"error_code":402}`, http.StatusNotFound)
-	} else {
-		fmt.Fprintf(w, `{"success":true,"value":{"user_id":%d,%s}}`, userID, data)
+		requestLog(r).Warn("Error occured while parsing form", "err", err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	version := 0
+	if form.KeyExists("version") {
+		if version = form.GetInt("version"); version <= 0 {
+			c := Container{false, nil, errorCodeBackupNotFound}
+			http.Error(w, c.toJSON(), http.StatusNotFound)
+			return
+		}
+	}
+	version, data, err := s.store.Backup(userID, version)
+	if err == sql.ErrNoRows {
+		c := Container{false, nil, errorCodeBackupNotFound}
+		http.Error(w, c.toJSON(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		requestLog(r).Error("Error occured while querying table DATA_BACKUP for downloading data", "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
 	}
+
+	backup := BackupData{}
+	if err = json.Unmarshal([]byte(data), &backup); err != nil {
+		requestLog(r).Error("Stored backup is broken", "version", version, "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
+	}
+	backup["user_id"] = json.RawMessage(strconv.Itoa(userID))
+	backup["version_id"] = json.RawMessage(strconv.Itoa(version))
+	container := Container{true, &backup, 0}
+	fmt.Fprint(w, container.toJSON())
 }
 
-func receiveBackup(w http.ResponseWriter, r *http.Request) {
+func (s *Server) receiveBackup(w http.ResponseWriter, r *http.Request) {
 	var (
 		userID int
 		err    error
 	)
-	if NeedAuth {
-		userID, err = verifyBearerAuth(r.Header.Get("Authorization"))
+	if s.cfg().Auth {
+		userID, err = s.verifyBearerAuth(r.Header.Get("Authorization"))
 		if err != nil {
 			c := Container{false, nil, 203}
 			http.Error(w, c.toJSON(), http.StatusUnauthorized)
 			return
 		}
 	} else {
-		userID = staticUserID
+		userID = s.cfg().StaticUserID
 	}
+	setRequestUser(r, userID)
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg().BackupMaxSize<<10)
 	data, err := forms.Parse(r)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		requestLog(r).Warn("Uploaded backup is too large", "limit", tooLarge.Limit)
+		c := Container{false, nil, errorCodeBackupTooLarge}
+		http.Error(w, c.toJSON(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		requestLog(r).Warn("Error occured while parsing form", "err", err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	backup, errorCode := validateBackup(data)
+	if errorCode != 0 {
+		requestLog(r).Warn("Uploaded backup rejected", "error_code", errorCode)
+		c := Container{false, nil, errorCode}
+		http.Error(w, c.toJSON(), http.StatusBadRequest)
+		return
+	}
+
+	version, err := s.storeBackup(userID, backup)
 	if err != nil {
-		log.Printf("%s: Error occured while parsing form: %s\n", r.URL.Path, err)
+		requestLog(r).Error("Error occured while writing backup data", "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
 	}
+	if !data.GetBool("merge_scores") {
+		s.writeAudit(r, playerActor(userID), userID, auditBackupUpload, fmt.Sprintf("version=%d", version))
+		fmt.Fprintf(w, `{"success":true,"value":{"user_id":%d,"version_id":%d}}`, userID, version)
+		return
+	}
+
+	merged, err := s.mergeBackupScores(userID, backup)
+	if err != nil {
+		s.writeAudit(r, playerActor(userID), userID, auditBackupUpload, fmt.Sprintf("version=%d merge_failed", version))
+		requestLog(r).Error("Error occured while merging backup scores", "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
+	}
+	if merged.Merged > 0 {
+		s.invalidateScoreImage(userID)
+	}
+	s.writeAudit(
+		r, playerActor(userID), userID, auditBackupUpload,
+		fmt.Sprintf("version=%d merged_scores=%d skipped_scores=%d", version, merged.Merged, merged.Skipped),
+	)
+	fmt.Fprintf(
+		w, `{"success":true,"value":{"user_id":%d,"version_id":%d,"merged_scores":%d,"skipped_scores":%d}}`,
+		userID, version, merged.Merged, merged.Skipped,
+	)
+}
+
+// validateBackup checks all necessary keys and their checksums in uploaded
+// form, and collects them into a backup document. Non-zero error code is
+// returned when validation fails.
+func validateBackup(data *forms.Data) (BackupData, int) {
 	val := data.Validator()
 	for _, key := range DataAndChecksumKeys {
 		val.Require(key + "_data")
 		val.Require(key + "_checksum")
 	}
 	if val.HasErrors() {
-		log.Printf("%s: Data uploaded lacks of necessary key.\n", r.URL.Path)
-		for k, v := range val.ErrorMap() {
-			log.Printf("%s: %s", k, v)
+		missing := []string{}
+		for k := range val.ErrorMap() {
+			missing = append(missing, k)
 		}
+		sort.Strings(missing)
+		stdLog.Warn("Backup lacks of necessary key(s)", "keys", strings.Join(missing, ","))
+		return nil, errorCodeBackupMissingKey
 	}
-	results := []string{}
+
+	backup := BackupData{}
 	for _, key := range DataAndChecksumKeys {
 		content := data.Get(key + "_data")
 		checksum := data.Get(key + "_checksum")
 		sum := fmt.Sprintf("%x", md5.Sum([]byte(content)))
-		if string(sum) != checksum {
-			log.Printf("%s: Checksum check failed for key `%s`", r.URL.Path, key)
-			return
+		if !strings.EqualFold(sum, checksum) {
+			stdLog.Warn("Checksum check failed for backup", "key", key)
+			return nil, errorCodeBackupChecksum
+		}
+		if !json.Valid([]byte(content)) {
+			stdLog.Warn("Backup data is not valid JSON", "key", key)
+			return nil, errorCodeBackupInvalidData
 		}
-		results = append(results, fmt.Sprintf(`"%s":%s`, key, content))
+		backup[key] = json.RawMessage(content)
 	}
-	result := strings.Join(results, ",")
-	result = fmt.Sprintf(`%s,"createdAt":%d`, result, time.Now().Unix())
-	_, err = db.Exec(sqlStmtWriteBackupDate, result, userID)
+	backup["createdAt"] = json.RawMessage(strconv.FormatInt(time.Now().Unix(), 10))
+	return backup, 0
+}
+
+// storeBackup saves backup as a new version for user and drops versions
+// exceed backup history limit, returns version number of new backup.
+func (s *Server) storeBackup(userID int, backup BackupData) (int, error) {
+	content, err := json.Marshal(backup)
 	if err != nil {
-		log.Printf("%s: Error occured while writing backup data: %s\n", r.URL.Path, err)
+		return 0, err
 	}
-	fmt.Fprintf(w, `{"success":true,"value":{"user_id":%d}}`, userID)
+
+	return s.store.SaveBackup(userID, time.Now().Unix(), string(content), s.cfg().BackupHistory)
 }
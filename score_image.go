@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Layout of score image, in pixels.
+const (
+	scoreImageColumns = 3
+	scoreImageCardW   = 390
+	scoreImageCardH   = 96
+	scoreImageGap     = 12
+	scoreImageHeaderH = 130
+	scoreImageTitleH  = 44
+	scoreImageJacket  = 80
+	scoreImageWidth   = scoreImageColumns*scoreImageCardW + (scoreImageColumns+1)*scoreImageGap
+)
+
+var (
+	scoreImageBg      = color.RGBA{0x24, 0x20, 0x3c, 0xff}
+	scoreImageCardBg  = color.RGBA{0x3b, 0x33, 0x63, 0xff}
+	scoreImageText    = color.RGBA{0xf4, 0xf4, 0xf8, 0xff}
+	scoreImageSubText = color.RGBA{0xb8, 0xb4, 0xd0, 0xff}
+	scoreImageDiffs   = []color.RGBA{
+		{0x1b, 0x8f, 0xc9, 0xff}, {0x6a, 0xa8, 0x4f, 0xff},
+		{0xa0, 0x5a, 0xc8, 0xff}, {0xc0, 0x39, 0x2b, 0xff},
+	}
+)
+
+// scoreImageFaces are font faces used on score image. A face is not safe for
+// concurrent use, so each render makes its own from fonts shared by all.
+type scoreImageFaces struct {
+	title, large, normal, small font.Face
+}
+
+// scoreImageFonts are bundled Go fonts, parsed once.
+type scoreImageFonts struct {
+	regular, bold *opentype.Font
+}
+
+var (
+	scoreImageFontsOnce sync.Once
+	scoreImageFont      scoreImageFonts
+	scoreImageFontErr   error
+)
+
+func (s *Server) scoreImageHandler(w http.ResponseWriter, r *http.Request) {
+	userCode := mux.Vars(r)["id"]
+	withJacket := r.URL.Query().Get("jacket") != ""
+	code, _ := strconv.ParseInt(userCode, 10, 64)
+	userID, name, err := s.store.PlayerByCode(code)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		requestLog(r).Error("Error occured while looking up player", "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
+	}
+
+	cacheKey := scoreImageKey(userID, withJacket)
+	content, ok := s.scoreImages.get(cacheKey)
+	if !ok {
+		content, err = s.renderScoreImage(userID, userCode, name, withJacket)
+		if err != nil {
+			requestLog(r).Error("Error occured while rendering score image", "err", err)
+			http.Error(w, "Server side error", http.StatusInternalServerError)
+			return
+		}
+		s.scoreImages.put(cacheKey, content)
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(content)
+}
+
+// invalidateScoreImage drops cached score images of a player.
+func (s *Server) invalidateScoreImage(userID int) {
+	for _, withJacket := range []bool{false, true} {
+		s.scoreImages.remove(scoreImageKey(userID, withJacket))
+	}
+}
+
+func scoreImageKey(userID int, withJacket bool) string {
+	return fmt.Sprintf("%d:%t", userID, withJacket)
+}
+
+// scoreImageCacheSize is number of rendered score images kept in memory.
+const scoreImageCacheSize = 256
+
+// scoreImageCache keeps a limited number of rendered score images, dropping
+// least recently used one when it's full.
+type scoreImageCache struct {
+	sync.Mutex
+	size    int
+	order   *list.List // of *scoreImageItem, most recently used first
+	entries map[string]*list.Element
+}
+
+type scoreImageItem struct {
+	key     string
+	content []byte
+}
+
+func newScoreImageCache(size int) *scoreImageCache {
+	return &scoreImageCache{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *scoreImageCache) get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*scoreImageItem).content, true
+}
+
+func (c *scoreImageCache) put(key string, content []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*scoreImageItem).content = content
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&scoreImageItem{key, content})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*scoreImageItem).key)
+	}
+}
+
+func (c *scoreImageCache) remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+func (c *scoreImageCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+}
+
+func (s *Server) renderScoreImage(userID int, userCode string, name string, withJacket bool) ([]byte, error) {
+	faces, err := newScoreImageFaces()
+	if err != nil {
+		return nil, err
+	}
+	defer faces.Close()
+	summary, err := getRatingSummary(s.store, userID)
+	if err != nil {
+		return nil, err
+	}
+	best, err := s.store.Best30(userID)
+	if err != nil {
+		return nil, err
+	}
+	recent30, err := s.store.RecentScores(userID)
+	if err != nil {
+		return nil, err
+	}
+	recent := []ScoreEntry{}
+	for _, entry := range recent30 {
+		if entry.IsR10 && len(recent) < 10 {
+			recent = append(recent, entry)
+		}
+	}
+
+	bestRows := (len(best) + scoreImageColumns - 1) / scoreImageColumns
+	recentRows := (len(recent) + scoreImageColumns - 1) / scoreImageColumns
+	height := scoreImageHeaderH + 2*scoreImageTitleH +
+		(bestRows+recentRows)*(scoreImageCardH+scoreImageGap) + scoreImageGap
+	img := image.NewRGBA(image.Rect(0, 0, scoreImageWidth, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(scoreImageBg), image.Point{}, draw.Src)
+
+	drawText(img, faces.title, scoreImageText, scoreImageGap, 50, name)
+	drawText(
+		img, faces.normal, scoreImageSubText, scoreImageGap, 84,
+		fmt.Sprintf("User code %s    Rating %.2f", userCode, float64(summary.Potential)/100),
+	)
+	drawText(
+		img, faces.normal, scoreImageSubText, scoreImageGap, 112,
+		fmt.Sprintf("Best 30 %.4f    Recent 10 %.4f", summary.B30, summary.R10),
+	)
+
+	y := scoreImageHeaderH
+	for _, section := range []struct {
+		title   string
+		entries []ScoreEntry
+	}{
+		{"Best 30", best},
+		{"Recent 10", recent},
+	} {
+		drawText(img, faces.large, scoreImageText, scoreImageGap, y+scoreImageTitleH-12, section.title)
+		y += scoreImageTitleH
+		for i, entry := range section.entries {
+			x := scoreImageGap + (i%scoreImageColumns)*(scoreImageCardW+scoreImageGap)
+			cardY := y + (i/scoreImageColumns)*(scoreImageCardH+scoreImageGap)
+			s.drawScoreCard(img, faces.normal, faces.small, x, cardY, i+1, &entry, withJacket)
+		}
+		y += (len(section.entries) + scoreImageColumns - 1) / scoreImageColumns * (scoreImageCardH + scoreImageGap)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *Server) drawScoreCard(
+	img *image.RGBA, normal font.Face, small font.Face,
+	x int, y int, rank int, entry *ScoreEntry, withJacket bool,
+) {
+	card := image.Rect(x, y, x+scoreImageCardW, y+scoreImageCardH)
+	draw.Draw(img, card, image.NewUniform(scoreImageCardBg), image.Point{}, draw.Src)
+	diffColor := scoreImageSubText
+	if entry.Difficulty >= 0 && int(entry.Difficulty) < len(scoreImageDiffs) {
+		diffColor = scoreImageDiffs[entry.Difficulty]
+	}
+	draw.Draw(img, image.Rect(x, y, x+6, y+scoreImageCardH), image.NewUniform(diffColor), image.Point{}, draw.Src)
+
+	textX := x + 16
+	if withJacket {
+		jacketRect := image.Rect(textX, y+8, textX+scoreImageJacket, y+8+scoreImageJacket)
+		if jacket := s.loadJacket(entry.SongID); jacket != nil {
+			xdraw.ApproxBiLinear.Scale(img, jacketRect, jacket, jacket.Bounds(), draw.Over, nil)
+		}
+		textX += scoreImageJacket + 10
+	}
+	maxWidth := x + scoreImageCardW - textX - 10
+
+	drawText(
+		img, normal, scoreImageText, textX, y+28,
+		fitText(normal, fmt.Sprintf("#%d %s", rank, entry.Title), maxWidth),
+	)
+	drawText(
+		img, small, diffColor, textX, y+54,
+		fmt.Sprintf("%s %.1f", diffName(entry.Difficulty), entry.BaseRating),
+	)
+	drawText(
+		img, normal, scoreImageText, textX+90, y+54,
+		fmt.Sprintf("%08d", entry.Score),
+	)
+	drawText(
+		img, small, scoreImageSubText, textX, y+80,
+		fmt.Sprintf("Rating %.4f    %s", entry.Rating, clearTypeName(entry.ClearType)),
+	)
+}
+
+// loadJacket reads jacket of song from static songs directory, nil if song has
+// no readable jacket.
+func (s *Server) loadJacket(songID string) image.Image {
+	f, err := os.Open(s.rootPath("static", "songs", path.Base(songID), "base.jpg"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	jacket, err := jpeg.Decode(f)
+	if err != nil {
+		s.log.Error("Error occured while decoding jacket", "song_id", songID, "err", err)
+		return nil
+	}
+	return jacket
+}
+
+func drawText(img *image.RGBA, face font.Face, c color.Color, x int, y int, text string) {
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(text)
+}
+
+// fitText truncates text with ellipsis so that it fits in width.
+func fitText(face font.Face, text string, width int) string {
+	limit := fixed.I(width)
+	if font.MeasureString(face, text) <= limit {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		if s := string(runes) + "…"; font.MeasureString(face, s) <= limit {
+			return s
+		}
+	}
+	return ""
+}
+
+func getScoreImageFonts() (*scoreImageFonts, error) {
+	scoreImageFontsOnce.Do(func() {
+		scoreImageFont.regular, scoreImageFontErr = opentype.Parse(goregular.TTF)
+		if scoreImageFontErr == nil {
+			scoreImageFont.bold, scoreImageFontErr = opentype.Parse(gobold.TTF)
+		}
+	})
+	return &scoreImageFont, scoreImageFontErr
+}
+
+// newScoreImageFaces makes faces for one render, they should be closed after
+// use.
+func newScoreImageFaces() (*scoreImageFaces, error) {
+	fonts, err := getScoreImageFonts()
+	if err != nil {
+		return nil, err
+	}
+	faces := &scoreImageFaces{}
+	for _, item := range []struct {
+		face *font.Face
+		font *opentype.Font
+		size float64
+	}{
+		{&faces.title, fonts.bold, 36},
+		{&faces.large, fonts.bold, 26},
+		{&faces.normal, fonts.regular, 20},
+		{&faces.small, fonts.regular, 16},
+	} {
+		*item.face, err = opentype.NewFace(item.font, &opentype.FaceOptions{
+			Size: item.size, DPI: 72, Hinting: font.HintingFull,
+		})
+		if err != nil {
+			faces.Close()
+			return nil, err
+		}
+	}
+	return faces, nil
+}
+
+func (f *scoreImageFaces) Close() {
+	for _, face := range []font.Face{f.title, f.large, f.normal, f.small} {
+		if face != nil {
+			face.Close()
+		}
+	}
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"embed"
 	"encoding/json"
 	"fmt"
-	"log"
+	"html/template"
 	"net/http"
+	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,92 +23,249 @@ var clearTypes = []string{
 
 var diffs = []string{"PST", "PRS", "FTR", "BYD"}
 
-func scoreLookupHandler(w http.ResponseWriter, r *http.Request) {
+// diffName returns short name of difficulty, or its number when it's not a
+// known one.
+func diffName(diff int8) string {
+	if diff >= 0 && int(diff) < len(diffs) {
+		return diffs[diff]
+	}
+	return strconv.Itoa(int(diff))
+}
+
+// clearTypeName returns name of clear type, or its number when it's not a
+// known one.
+func clearTypeName(clearType int8) string {
+	if clearType >= 0 && int(clearType) < len(clearTypes) {
+		return clearTypes[clearType]
+	}
+	return strconv.Itoa(int(clearType))
+}
+
+// Score lookup page is rendered with page template, which includes card
+// template as `card` once for every score. Template files take precedence
+// over built-in ones as long as they parse.
+//
+//go:embed score_lookup/*.html
+var scoreTemplateFS embed.FS
+
+// ScoreLookupPage is data passed to score lookup page template.
+type ScoreLookupPage struct {
+	Name     string
+	UserCode string
+	Rating   float64
+	B30      float64
+	R10      float64
+	Scores   []ScoreLookupCard
+}
+
+// ScoreLookupCard is data passed to card template for each score.
+type ScoreLookupCard struct {
+	Rank           int
+	SongID         string
+	Title          string
+	Difficulty     string
+	Level          string
+	BaseRating     float64
+	Score          int
+	Rating         float64
+	Shiny          int
+	Pure           int
+	Far            int
+	Lost           int
+	ClearType      string
+	ClearTypeTitle string
+	TimePlayed     time.Time
+}
+
+func (s *Server) scoreLookupHandler(w http.ResponseWriter, r *http.Request) {
 	userCode := path.Base(r.URL.Path)
-	rows, err := db.Query(sqlStmtScoreLookup, userCode)
+	page := &ScoreLookupPage{UserCode: userCode}
+	code, _ := strconv.ParseInt(userCode, 10, 64)
+	userID, name, err := s.store.PlayerByCode(code)
 	if err == sql.ErrNoRows {
-		log.Printf("%s: Currently no record in database for user `%s`\n", r.URL.Path, userCode)
+		requestLog(r).Info("Currently no record in database for user", "user_code", userCode)
+		http.NotFound(w, r)
 		return
 	} else if err != nil {
-		log.Printf("%s: Error occured while looking up score record: %s\n", r.URL.Path, err)
+		requestLog(r).Error("Error occured while looking up player", "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
+	}
+	page.Name = name
+
+	entries, err := s.store.Best30(userID)
+	if err != nil {
+		requestLog(r).Error("Error occured while looking up score record", "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
 	data, err := forms.Parse(r)
 	if err != nil {
-		log.Printf("%s: Error occured while parsing request form: %s\n", r.URL.Path, err)
+		requestLog(r).Error("Error occured while parsing request form", "err", err)
 	}
 	isGetJSON := data.GetBool("json")
 
-	var (
-		songTitle  string
-		baseRating float64
-	)
-	record := new(ScoreRecord)
-	results := []string{}
-	count := 1
-	for rows.Next() {
-		rows.Scan(
-			&record.TimePlayed, &record.SongID, &songTitle, &record.Difficulty, &baseRating,
-			&record.Score, &record.Shiny, &record.Pure, &record.Far, &record.Lost,
-			&record.Rating, &record.Health, &record.ClearType,
-		)
-		result := genScoreText(record, songTitle, baseRating, isGetJSON, count)
-		results = append(results, result)
-		count++
-	}
-	if err := rows.Err(); err != nil {
-		log.Printf("%s: Error occured while reading rows queried for score looking up", r.URL.Path)
-		return
+	records := []ScoreRecord{}
+	for i := range entries {
+		records = append(records, entries[i].ScoreRecord)
+		page.Scores = append(page.Scores, newScoreLookupCard(&entries[i], len(records)))
 	}
 	if isGetJSON {
-		fmt.Fprintf(w, "[%s]", strings.Join(results, ","))
+		res, err := json.Marshal(records)
+		if err != nil {
+			requestLog(r).Error("Error occured while generating score JSON", "err", err)
+			http.Error(w, "Server side error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(res)
+		return
+	}
+
+	if summary, err := getRatingSummary(s.store, userID); err != nil {
+		requestLog(r).Error("Error occured while getting r10 and b30 data", "err", err)
 	} else {
-		fmt.Fprint(w, genScoreHTML(userCode, results))
+		page.Rating = float64(summary.Potential) / 100
+		page.B30, page.R10 = summary.B30, summary.R10
+	}
+	tmpl, err := s.getScoreTemplate()
+	if err != nil {
+		requestLog(r).Error("Error occured while loading webpage templates", "err", err)
+		http.Error(w, "Server side error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, page); err != nil {
+		requestLog(r).Error("Error occured while rendering score lookup page", "err", err)
 	}
 }
 
-func genScoreText(
-	record *ScoreRecord, songTitle string, baseRating float64, isGetJSON bool, count int,
-) string {
-	ratingTitle := fmt.Sprintf("%d", int(baseRating))
+func newScoreLookupCard(entry *ScoreEntry, rank int) ScoreLookupCard {
+	baseRating := entry.BaseRating
+	level := fmt.Sprintf("%d", int(baseRating))
 	if (baseRating > 9.6 && baseRating < 10.0) || (baseRating > 10.6 && baseRating < 11.0) {
-		ratingTitle += "+"
+		level += "+"
 	}
-	clearTypeTitle := clearTypes[record.ClearType]
-	var result string
-	if isGetJSON {
-		if res, err := json.Marshal(record); err != nil {
-			log.Println("Error occured while generating score JSON")
-			log.Println(err)
-		} else {
-			result = string(res)
+	clearType := clearTypeName(entry.ClearType)
+	return ScoreLookupCard{
+		Rank:           rank,
+		SongID:         entry.SongID,
+		Title:          entry.Title,
+		Difficulty:     diffName(entry.Difficulty),
+		Level:          level,
+		BaseRating:     baseRating,
+		Score:          entry.Score,
+		Rating:         entry.Rating,
+		Shiny:          entry.Shiny,
+		Pure:           entry.Pure,
+		Far:            entry.Far,
+		Lost:           entry.Lost,
+		ClearType:      clearType,
+		ClearTypeTitle: strings.Title(strings.Replace(clearType, "-", " ", 1)),
+		TimePlayed:     time.Unix(entry.TimePlayed, 0),
+	}
+}
+
+// getScoreTemplate returns parsed score lookup templates. Templates are read
+// once, or reloaded whenever a template file changes in dev mode.
+func (s *Server) getScoreTemplate() (*template.Template, error) {
+	s.scoreTemplate.Lock()
+	defer s.scoreTemplate.Unlock()
+
+	config := s.cfg()
+	if s.scoreTemplate.tmpl != nil && !config.Dev {
+		return s.scoreTemplate.tmpl, nil
+	}
+	cardPath, pagePath := s.rootPath(config.ScoreCardTemplate), s.rootPath(config.ScorePageTemplate)
+	var modTime time.Time
+	for _, fileName := range []string{cardPath, pagePath} {
+		if info, err := os.Stat(fileName); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
 		}
-	} else {
-		result = fmt.Sprintf(
-			scoreCardTemplate, count, songTitle, diffs[record.Difficulty], ratingTitle, baseRating,
-			record.Score, record.Rating, record.Pure, record.Shiny, record.Far, record.Lost, clearTypeTitle,
-			strings.Title(strings.Replace(clearTypeTitle, "-", " ", 1)),
-			time.Unix(record.TimePlayed, 0),
-		)
-	}
-	return result
+	}
+	if s.scoreTemplate.tmpl != nil && modTime.Equal(s.scoreTemplate.modTime) {
+		return s.scoreTemplate.tmpl, nil
+	}
+
+	tmpl, err := s.parseScoreTemplate(pagePath, cardPath)
+	if err != nil {
+		return nil, err
+	}
+	if s.scoreTemplate.tmpl != nil {
+		s.log.Info("Reloaded score lookup templates")
+	}
+	s.scoreTemplate.tmpl, s.scoreTemplate.modTime = tmpl, modTime
+	return tmpl, nil
+}
+
+// reloadScoreTemplate parses templates again, keeping the ones in use when new
+// ones fail to parse.
+func (s *Server) reloadScoreTemplate() {
+	s.scoreTemplate.Lock()
+	defer s.scoreTemplate.Unlock()
+
+	config := s.cfg()
+	tmpl, err := s.parseScoreTemplate(s.rootPath(config.ScorePageTemplate), s.rootPath(config.ScoreCardTemplate))
+	if err != nil {
+		s.log.Error("Error occured while reloading score lookup templates, keeping old ones", "err", err)
+		return
+	}
+	s.scoreTemplate.tmpl, s.scoreTemplate.modTime = tmpl, time.Time{}
+	s.log.Info("Reloaded score lookup templates")
 }
 
-func genScoreHTML(userCode string, results []string) string {
-	var (
-		b30    float64
-		r10    float64
-		output string
+// parseScoreTemplate reads and parses page template along with card template.
+// Template files that don't parse, e.g. ones written for the old `{{CONTENT}}`
+// format, are reported and built-in templates are used instead.
+func (s *Server) parseScoreTemplate(pagePath string, cardPath string) (*template.Template, error) {
+	tmpl, err := parseScoreTemplateWith(readScoreTemplate, pagePath, cardPath)
+	if err == nil {
+		return tmpl, nil
+	}
+	tmpl, builtInErr := parseScoreTemplateWith(readBuiltInScoreTemplate, pagePath, cardPath)
+	if builtInErr != nil {
+		return nil, err
+	}
+	s.log.Warn(
+		"Score lookup template files can't be used, using built-in ones",
+		"page", pagePath, "card", cardPath, "err", err,
 	)
-	err := db.QueryRow(sqlStmtGetScoreLookupRating, userCode).Scan(&b30, &r10)
+	return tmpl, nil
+}
+
+func parseScoreTemplateWith(read func(string) (string, error), pagePath string, cardPath string) (*template.Template, error) {
+	page, err := read(pagePath)
+	if err != nil {
+		return nil, err
+	}
+	card, err := read(cardPath)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("page").Parse(page)
+	if err == nil {
+		_, err = tmpl.New("card").Parse(card)
+	}
 	if err != nil {
-		log.Printf("Error occured while getting r10 and b30 data: %s\n", err)
+		return nil, err
 	}
-	output = strings.ReplaceAll(
-		scorePageTemplate, "{{CONTENT}}", strings.Join(results, "\n"))
-	output = strings.ReplaceAll(output, "{{R10}}", fmt.Sprintf("%.6f", r10))
-	output = strings.ReplaceAll(output, "{{B30}}", fmt.Sprintf("%.6f", b30))
-	return output
+	return tmpl, nil
+}
+
+// readScoreTemplate reads template file, falling back
+// to built-in one of the same name.
+func readScoreTemplate(fileName string) (string, error) {
+	content, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return readBuiltInScoreTemplate(fileName)
+	}
+	return string(content), err
+}
+
+// readBuiltInScoreTemplate reads built-in template of the same name as
+// fileName.
+func readBuiltInScoreTemplate(fileName string) (string, error) {
+	content, err := scoreTemplateFS.ReadFile(path.Join("score_lookup", path.Base(fileName)))
+	return string(content), err
 }
@@ -17,8 +17,12 @@ export GOARCH=arm64
 export CC=$PROJ_ROOT/scripts/clangwrap.sh
 export CXX=$PROJ_ROOT/scripts/clangwrap.sh
 
+BUILD_VERSION=$(git describe --tags --always --dirty 2>/dev/null)
+BUILD_COMMIT=$(git rev-parse HEAD 2>/dev/null)
+LDFLAGS="-X main.buildVersion=$BUILD_VERSION -X main.buildCommit=$BUILD_COMMIT"
+
 echo "building darwin/arm64 static lib"
-go build -buildmode=c-archive -o $LIB_PATH/$LIB_NAME
+go build -buildmode=c-archive -ldflags "$LDFLAGS" -o $LIB_PATH/$LIB_NAME
 if [ ! -f $LIB_PATH/$LIB_NAME ]; then
     echo "failed to build darwin/arm64 static lib!"
     exit 1
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const fileServerPrefix = "/static/songs"
+
+// insideHandler is internal func of an info getting handler, which can also
+// be called through aggregate request.
+type insideHandler func(userID int, r *http.Request) (ToJSON, error)
+
+// Server holds everything a running server depends on: storage, config,
+// templates, caches and routing. Handlers are methods of Server so that
+// nothing is shared through package level state.
+type Server struct {
+	store   Store
+	config  atomic.Value // *Config
+	metrics *metrics
+	log     *Logger
+
+	// publicURL is base URL clients use to reach this server, all generated
+	// links are derived from it
+	publicURL *url.URL
+	router    *mux.Router
+	// insideHandlers records internal funcs of handlers by their endpoint
+	insideHandlers map[string]insideHandler
+	// reloadHooks run after config is reloaded, for dropping anything read
+	// from files or database that may have changed.
+	reloadHooks []func()
+	// configArgs are command line args config was loaded from, they are read
+	// again when reloading config.
+	configArgs []string
+
+	scoreTemplate struct {
+		sync.Mutex
+		tmpl    *template.Template
+		modTime time.Time
+	}
+	// scoreImages holds rendered PNG of recently looked up players until the
+	// player uploads a new score or static data is invalidated.
+	scoreImages *scoreImageCache
+
+	done chan struct{}
+}
+
+// NewServer opens storage in config, brings its schema up to date and sets up
+// routing.
+func NewServer(config *Config) (*Server, error) {
+	publicURL, err := parsePublicURL(config)
+	if err != nil {
+		return nil, err
+	}
+	log := newLogger(os.Stderr)
+	if err := log.configure(config.LogFormat, config.LogLevel); err != nil {
+		return nil, err
+	}
+	store, db, err := openStore(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		store:          store,
+		metrics:        newMetrics(store, db, config.Storage),
+		log:            log,
+		publicURL:      publicURL,
+		insideHandlers: map[string]insideHandler{},
+		done:           make(chan struct{}),
+	}
+	s.config.Store(config)
+	s.scoreImages = newScoreImageCache(scoreImageCacheSize)
+	s.reloadHooks = []func(){s.configureLog, s.reloadScoreTemplate, s.invalidateStatic}
+	if s.router, err = s.setRouting(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// cfg returns config currently in effect, it's replaced as a whole when
+// config is reloaded.
+func (s *Server) cfg() *Config {
+	return s.config.Load().(*Config)
+}
+
+// ServeHTTP dispatches request to handlers of game API, score lookup, portal
+// and admin API if it's not on a separate port.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.logRequests(s.router).ServeHTTP(w, r)
+}
+
+// configureLog applies log options in config.
+func (s *Server) configureLog() {
+	config := s.cfg()
+	if err := s.log.configure(config.LogFormat, config.LogLevel); err != nil {
+		s.log.Error("Error occured while configuring log", "err", err)
+	}
+}
+
+// invalidateStatic drops cached game data and everything rendered from it.
+func (s *Server) invalidateStatic() {
+	s.store.InvalidateStatic()
+	s.scoreImages.clear()
+}
+
+// Close stops background tasks and closes storage.
+func (s *Server) Close() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	return s.store.Close()
+}
+
+func (s *Server) setRouting() (*mux.Router, error) {
+	config := s.cfg()
+	router := mux.NewRouter()
+	router.Use(s.instrument)
+
+	if config.MetricsPort == "" {
+		router.Path("/metrics").Methods("GET").Handler(s.metrics.handler())
+	}
+	s.setHealthRouting(router)
+
+	fileServerPath, err := filepath.Abs(s.rootPath(strings.TrimPrefix(fileServerPrefix, "/")))
+	if err != nil {
+		return nil, err
+	}
+	router.PathPrefix(fileServerPrefix).Handler(
+		s.downloadAuth(
+			http.StripPrefix(fileServerPrefix, s.newSongFileServer(fileServerPath)),
+		),
+	)
+
+	if config.AdminPassword != "" && config.AdminPort == "" {
+		s.setAdminRouting(router)
+	}
+
+	s.setPortalRouting(router)
+
+	router.Path(path.Join("/score", "b30", "{id:[0-9]{9}}")).Methods("GET").Handler(http.HandlerFunc(s.scoreLookupHandler))
+	router.Path(path.Join("/score", "b30", "{id:[0-9]{9}}.png")).Methods("GET").Handler(http.HandlerFunc(s.scoreImageHandler))
+
+	api := router.PathPrefix(config.APIRoot).Subrouter()
+
+	api.Path("/auth/login").Methods("POST").HandlerFunc(s.loginHandler)
+
+	api.Path("/compose/aggregate").Methods("GET").Handler(http.HandlerFunc(s.aggregateHandler))
+
+	api.Path("/user/me/character").Methods("POST").Handler(http.HandlerFunc(s.changeCharacter))
+	api.PathPrefix("/user/me/characters/{partID}/toggle_uncap").Methods("POST").Handler(http.HandlerFunc(s.toggleUncap))
+
+	api.Path("/game/info").Methods("GET").Handler(http.HandlerFunc(s.gameInfoHandler))
+	s.insideHandlers["/game/info"] = s.getGameInfo
+
+	api.Path("/purchase/bundle/pack").Methods("GET").Handler(http.HandlerFunc(s.packInfoHandler))
+	s.insideHandlers["/purchase/bundle/pack"] = s.getPackInfo
+
+	api.Path("/present/me").Methods("GET").Handler(http.HandlerFunc(s.presentMeHandler))
+	s.insideHandlers["/present/me"] = s.presentMe
+
+	api.Path("/user/me/save").Methods("GET").Handler(http.HandlerFunc(s.returnBackup))
+	api.Path("/user/me/save").Methods("POST").Handler(http.HandlerFunc(s.receiveBackup))
+	api.Path("/user/me/export").Methods("GET").Handler(http.HandlerFunc(s.exportHandler))
+
+	api.Path("/score/token").Methods("GET").Handler(http.HandlerFunc(s.scoreTokenHandler))
+	api.Path("/score/song").Methods("POST").Handler(http.HandlerFunc(s.scoreUploadHandler))
+
+	api.Path("/user/me").Methods("GET").Handler(http.HandlerFunc(s.userInfoHandler))
+
+	api.PathPrefix("/user/me/setting").Methods("POST").Handler(http.HandlerFunc(s.userSettingHandler))
+	s.insideHandlers["/user/me"] = s.getUserInfo
+
+	api.Path("/world/map/me").Methods("GET").Handler(http.HandlerFunc(s.myMapInfoHandler))
+	s.insideHandlers["/world/map/me"] = s.getMyMapInfo
+
+	api.Path("/serve/download/me/song").Methods("GET").Handler(http.HandlerFunc(s.songDownloadHandler))
+	s.insideHandlers["/serve/download/me/song"] = s.getDownloadList
+
+	return router, nil
+}
+
+// parsePublicURL validates public URL setting, empty setting falls back to
+// host and port server is bound to.
+func parsePublicURL(config *Config) (*url.URL, error) {
+	rawURL := config.PublicURL
+	if rawURL == "" {
+		scheme := "http"
+		if config.TLSCert != "" {
+			scheme = "https"
+		}
+		rawURL = fmt.Sprintf("%s://%s:%d", scheme, config.Host, config.Port)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public URL `%s`: %w", rawURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("public URL `%s` must use http or https scheme", rawURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("public URL `%s` has no host", rawURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawQuery, u.Fragment = "", ""
+	return u, nil
+}
+
+// rootPath resolves path of a server document, relative paths are relative to
+// documents root in config.
+func (s *Server) rootPath(elem ...string) string {
+	name := filepath.Join(elem...)
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(s.cfg().Root, name)
+}
+
+// publicPath joins path elements onto path of public URL, for links and
+// cookies that stay on this server.
+func (s *Server) publicPath(elem ...string) string {
+	return path.Join(append([]string{"/", s.publicURL.Path}, elem...)...)
+}
+
+// publicLink joins path elements onto public URL.
+func (s *Server) publicLink(elem ...string) string {
+	u := *s.publicURL
+	u.Path = path.Join(append([]string{"/", u.Path}, elem...)...)
+	return u.String()
+}
+
+// logStartUp prints URLs server can be reached at.
+func (s *Server) logStartUp() {
+	fmt.Printf("Root URL: %s\n", s.publicLink(s.cfg().APIRoot))
+	fmt.Printf("Score lookup: %s/<user_code>\n", s.publicLink("score", "b30"))
+	fmt.Printf("Score image: %s/<user_code>.png\n", s.publicLink("score", "b30"))
+	fmt.Printf("Player portal: %s/\n", s.publicLink(PortalRoot))
+	if s.cfg().Auth && s.cfg().SigningKey == defaultConfig().SigningKey {
+		s.log.Warn("Authentication is on but signing-key is left as default")
+	}
+}
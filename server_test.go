@@ -0,0 +1,568 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testAdminPassword = "admin-secret"
+	testPassword      = "player-secret"
+	// testUserCode is user code of default player, user 1
+	testUserCode = "000000001"
+)
+
+// newTestServer builds a Server on a fresh SQLite database seeded by
+// seedStore, with documents root in a temporary directory and admin API on.
+// Default player owns pack `extra` and has password testPassword.
+func newTestServer(t testing.TB, edit func(config *Config)) *Server {
+	t.Helper()
+	root := t.TempDir()
+	songDir := filepath.Join(root, "static", "songs", "beta")
+	if err := os.MkdirAll(songDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(songDir, "base.ogg"), []byte("beta audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := defaultConfig()
+	config.Root = root
+	config.DB = filepath.Join(root, "zrc.db")
+	config.AdminPassword = testAdminPassword
+	config.LogLevel = "error"
+	if edit != nil {
+		edit(config)
+	}
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err := s.getScoreTemplate(); err != nil {
+		t.Fatalf("loading score templates: %v", err)
+	}
+
+	seedStore(t, s.store)
+	if _, err := s.store.GrantPurchase(1, "pack", "extra"); err != nil {
+		t.Fatal(err)
+	}
+	hash := fmt.Sprintf("%x", md5.Sum([]byte(testPassword)))
+	if _, err := s.store.UpdatePlayer(1, map[string]interface{}{"pwdhash": hash}); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// routeCase is a request and what its response must look like.
+type routeCase struct {
+	method string
+	target string
+	form   url.Values
+	header http.Header
+	status int
+	// contains are substrings response body must have, lacks are ones it
+	// must not.
+	contains []string
+	lacks    []string
+}
+
+// serve makes request to s, form is put in query of GET requests and body of
+// others.
+func serve(s *Server, method string, target string, form url.Values, header http.Header) *httptest.ResponseRecorder {
+	var r *http.Request
+	if method == http.MethodGet || method == http.MethodHead || method == http.MethodDelete {
+		if len(form) > 0 {
+			target += "?" + form.Encode()
+		}
+		r = httptest.NewRequest(method, target, nil)
+	} else {
+		r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// runRoutes makes requests of cases in order and checks their responses.
+func runRoutes(t *testing.T, s *Server, cases []routeCase) {
+	t.Helper()
+	for _, c := range cases {
+		w := serve(s, c.method, c.target, c.form, c.header)
+		name := c.method + " " + c.target
+		if w.Code != c.status {
+			t.Errorf("%s: status %d, want %d, body: %s", name, w.Code, c.status, w.Body.String())
+			continue
+		}
+		body := w.Body.String()
+		for _, want := range c.contains {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: body lacks %q: %s", name, want, body)
+			}
+		}
+		for _, unwanted := range c.lacks {
+			if strings.Contains(body, unwanted) {
+				t.Errorf("%s: body has %q: %s", name, unwanted, body)
+			}
+		}
+	}
+}
+
+// decodeValue decodes `value` of a container in response body.
+func decodeValue(t *testing.T, w *httptest.ResponseRecorder, value interface{}) {
+	t.Helper()
+	var container struct {
+		Success bool            `json:"success"`
+		Value   json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &container); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body.String(), err)
+	}
+	if !container.Success {
+		t.Fatalf("request failed: %s", w.Body.String())
+	}
+	if err := json.Unmarshal(container.Value, value); err != nil {
+		t.Fatalf("decoding value %q: %v", container.Value, err)
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	s := newTestServer(t, nil)
+	runRoutes(t, s, []routeCase{
+		{method: "GET", target: "/healthz", status: 200, contains: []string{"ok"}},
+		{method: "GET", target: "/readyz", status: 200, contains: []string{`"ready":true`, `"database":"ok"`}},
+		{method: "GET", target: "/version", status: 200, contains: []string{`"schema_version":6`, `"db_schema_version":6`}},
+		{method: "GET", target: "/metrics", status: 200, contains: []string{"zrc_http_requests_total"}},
+		{method: "GET", target: "/nothing", status: 404},
+	})
+}
+
+func TestServerReadyAfterReload(t *testing.T) {
+	s := newTestServer(t, nil)
+	for _, hook := range s.reloadHooks {
+		hook()
+	}
+	runRoutes(t, s, []routeCase{
+		{method: "GET", target: "/readyz", status: 200, contains: []string{`"ready":true`}},
+	})
+}
+
+func TestServerOwnLogger(t *testing.T) {
+	quiet := newTestServer(t, nil)
+	verbose := newTestServer(t, func(config *Config) {
+		config.LogLevel = "debug"
+		config.LogFormat = "json"
+	})
+	verbose.configureLog()
+	if quiet.log.out.level != levelError || quiet.log.out.json {
+		t.Errorf("second server changed log options of first one to level %v, JSON %v", quiet.log.out.level, quiet.log.out.json)
+	}
+	if verbose.log.out.level != levelDebug || !verbose.log.out.json {
+		t.Errorf("log options of server are level %v, JSON %v", verbose.log.out.level, verbose.log.out.json)
+	}
+}
+
+func TestServerGameAPI(t *testing.T) {
+	s := newTestServer(t, nil)
+	api := s.cfg().APIRoot
+	calls := `[{"id":0,"endpoint":"/user/me"},{"id":1,"endpoint":"/game/info"},{"id":2,"endpoint":"/nothing"}]`
+	runRoutes(t, s, []routeCase{
+		{method: "GET", target: api + "/game/info", status: 200, contains: []string{`"max_stamina":12`}},
+		{
+			method: "GET", target: api + "/purchase/bundle/pack", status: 200,
+			contains: []string{`"name":"extra"`, `"id":"beta"`, `"price":500`},
+		},
+		{method: "GET", target: api + "/present/me", status: 200},
+		{
+			method: "GET", target: api + "/user/me", status: 200,
+			contains: []string{`"user_code":"000000001"`, `"name":"player"`, `"packs":["extra"]`},
+		},
+		{method: "GET", target: api + "/world/map/me", status: 200, contains: []string{`"user_id":1`}},
+		{
+			method: "GET", target: api + "/compose/aggregate", form: url.Values{"calls": {calls}}, status: 200,
+			contains: []string{`"success":true`, `"id":0`, `"user_code":"000000001"`, `"id":1`, `"max_stamina":12`, `"id":2`},
+		},
+		{
+			method: "POST", target: api + "/user/me/character",
+			form: url.Values{"character": {"1"}, "skill_sealed": {"false"}}, status: 200,
+			contains: []string{`"character": 1`},
+		},
+		{
+			method: "POST", target: api + "/user/me/characters/1/toggle_uncap", status: 200,
+			contains: []string{`"success":true`, `"character_id":1`},
+		},
+		{
+			method: "POST", target: api + "/user/me/setting/is_hide_rating",
+			form: url.Values{"value": {"true"}}, status: 200,
+			contains: []string{`"success":true`, `"is_hide_rating":true`},
+		},
+		{
+			method: "POST", target: api + "/user/me/setting/favorite_character",
+			form: url.Values{"value": {"1"}}, status: 200,
+			contains: []string{`"favorite_character":1`},
+		},
+		{method: "GET", target: api + "/score/token", status: 200, contains: []string{`"success":true`}},
+		{
+			method: "POST", target: api + "/score/song",
+			form: url.Values{
+				"song_id": {"alpha"}, "difficulty": {"2"}, "score": {"9800000"},
+				"shiny_perfect_count": {"900"}, "perfect_count": {"1000"}, "near_count": {"10"},
+				"miss_count": {"0"}, "health": {"100"}, "modifier": {"0"}, "beyond_gauge": {"0"},
+				"clear_type": {"1"},
+			},
+			status: 200,
+			// 9.5 + 1, counted in both best 30 and recent 10, divided by 40
+			contains: []string{`"success":true`, `"user_rating":52`},
+		},
+		{
+			method: "GET", target: api + "/user/me", status: 200,
+			contains: []string{`"rating":52`, `"song_id":"alpha"`},
+		},
+		{
+			method: "GET", target: api + "/user/me/export", status: 200,
+			contains: []string{`"format":"zrc-player-archive"`, `"song_id":"alpha"`},
+			lacks:    []string{"pwdhash"},
+		},
+	})
+}
+
+func TestServerBackup(t *testing.T) {
+	s := newTestServer(t, nil)
+	api := s.cfg().APIRoot
+
+	form := url.Values{}
+	for _, key := range DataAndChecksumKeys {
+		content := fmt.Sprintf(`{"%s":[]}`, key)
+		form.Set(key+"_data", content)
+		form.Set(key+"_checksum", fmt.Sprintf("%x", md5.Sum([]byte(content))))
+	}
+	badChecksum := url.Values{}
+	for key, values := range form {
+		badChecksum[key] = values
+	}
+	badChecksum.Set("scores_checksum", "0")
+
+	runRoutes(t, s, []routeCase{
+		{method: "GET", target: api + "/user/me/save", status: 404, contains: []string{`"error_code":402`}},
+		{method: "POST", target: api + "/user/me/save", form: url.Values{"scores_data": {"[]"}}, status: 400, contains: []string{`"error_code":403`}},
+		{method: "POST", target: api + "/user/me/save", form: badChecksum, status: 400, contains: []string{`"error_code":404`}},
+		{method: "POST", target: api + "/user/me/save", form: form, status: 200, contains: []string{`"version_id":1`}},
+		{method: "POST", target: api + "/user/me/save", form: form, status: 200, contains: []string{`"version_id":2`}},
+		{
+			method: "GET", target: api + "/user/me/save", status: 200,
+			contains: []string{`"version_id":2`, `"user_id":1`, `"story":[]`},
+		},
+		{method: "GET", target: api + "/user/me/save", form: url.Values{"version": {"1"}}, status: 200, contains: []string{`"version_id":1`}},
+		{method: "GET", target: api + "/user/me/save", form: url.Values{"version": {"9"}}, status: 404},
+	})
+}
+
+func TestServerSongDownload(t *testing.T) {
+	s := newTestServer(t, nil)
+	w := serve(s, "GET", s.cfg().APIRoot+"/serve/download/me/song", url.Values{"url": {"true"}}, nil)
+	if w.Code != 200 {
+		t.Fatalf("download list: status %d", w.Code)
+	}
+	var checksums map[string]Checksum
+	decodeValue(t, w, &checksums)
+	if _, ok := checksums["alpha"]; ok {
+		t.Errorf("download list has song not purchased: %v", checksums)
+	}
+	link, err := url.Parse(checksums["beta"].Audio["url"])
+	if err != nil || link.Path != "/static/songs/beta/base.ogg" {
+		t.Fatalf("download link of beta is %q", checksums["beta"].Audio["url"])
+	}
+
+	tampered := link.Query()
+	tampered.Set("uid", "2")
+	runRoutes(t, s, []routeCase{
+		{method: "GET", target: link.RequestURI(), status: 200, contains: []string{"beta audio"}},
+		{method: "GET", target: link.Path + "?" + tampered.Encode(), status: 403},
+		{method: "GET", target: link.Path, status: 403},
+		{
+			method: "GET", target: s.cfg().APIRoot + "/serve/download/me/song",
+			form: url.Values{"sid": {"beta", "alpha') or ('1' = '1"}}, status: 200,
+			contains: []string{`"beta"`}, lacks: []string{`"alpha"`},
+		},
+	})
+}
+
+func TestServerScoreLookup(t *testing.T) {
+	s := newTestServer(t, nil)
+	err := s.store.UpdateScores(func(tx ScoreTx) error {
+		record := &ScoreRecord{SongID: "beta", Difficulty: 2, Score: 9_900_000, Rating: 12.2, TimePlayed: 100}
+		if err := tx.InsertScore(1, record); err != nil {
+			return err
+		}
+		return tx.InsertBestScore(1, record.TimePlayed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runRoutes(t, s, []routeCase{
+		{method: "GET", target: "/score/b30/" + testUserCode, status: 200, contains: []string{"player", "beta"}},
+		{method: "GET", target: "/score/b30/" + testUserCode, form: url.Values{"json": {"true"}}, status: 200, contains: []string{`"song_id":"beta"`}},
+		{method: "GET", target: "/score/b30/123456789", status: 404},
+		{method: "GET", target: "/score/b30/12345", status: 404},
+		{method: "GET", target: "/score/b30/123456789.png", status: 404},
+	})
+
+	w := serve(s, "GET", "/score/b30/"+testUserCode+".png", nil, nil)
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/png" || !strings.HasPrefix(w.Body.String(), "\x89PNG") {
+		t.Errorf("score image: status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestServerOldScoreTemplates(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		dir := filepath.Join(config.Root, "static", "score_lookup")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		// templates of the format used before html/template
+		files := map[string]string{
+			config.ScorePageTemplate: "<html><body>{{CONTENT}}</body></html>",
+			config.ScoreCardTemplate: "<div>%s %d</div>",
+		}
+		for name, content := range files {
+			if err := ioutil.WriteFile(filepath.Join(config.Root, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	runRoutes(t, s, []routeCase{
+		{method: "GET", target: "/score/b30/" + testUserCode, status: 200, contains: []string{"player"}, lacks: []string{"CONTENT"}},
+	})
+}
+
+// TestScoreImageParallel renders score images concurrently, run it with
+// -race to check that renders share no font face.
+func TestScoreImageParallel(t *testing.T) {
+	s := newTestServer(t, nil)
+	err := s.store.UpdateScores(func(tx ScoreTx) error {
+		record := &ScoreRecord{SongID: "gamma", Difficulty: 3, Score: 9_900_000, Rating: 11.5, TimePlayed: 100}
+		if err := tx.InsertScore(1, record); err != nil {
+			return err
+		}
+		return tx.InsertBestScore(1, record.TimePlayed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			content, err := s.renderScoreImage(1, testUserCode, "player", false)
+			if err == nil && !strings.HasPrefix(string(content), "\x89PNG") {
+				err = fmt.Errorf("rendered %d bytes of no PNG", len(content))
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestServerPortal(t *testing.T) {
+	s := newTestServer(t, nil)
+	runRoutes(t, s, []routeCase{
+		{method: "GET", target: "/portal/login", status: 200, contains: []string{"password"}},
+		{method: "GET", target: "/portal/", status: 200, contains: []string{"player", testUserCode}},
+		{method: "GET", target: "/portal/recent", status: 200},
+		{method: "GET", target: "/portal/best", status: 200},
+		{method: "GET", target: "/portal/best", form: url.Values{"sort": {"title"}, "diff": {"2"}, "pack": {"extra"}}, status: 200},
+		{method: "GET", target: "/portal/best", form: url.Values{"sort": {"1; drop table player"}}, status: 200},
+		{method: "GET", target: "/portal/history", form: url.Values{"page": {"2"}}, status: 200},
+		{method: "GET", target: "/portal/characters", status: 200, contains: []string{"hikari", "tairitsu"}},
+		{method: "POST", target: "/portal/logout", status: 303},
+	})
+}
+
+func TestServerAuth(t *testing.T) {
+	s := newTestServer(t, func(config *Config) { config.Auth = true })
+	api := s.cfg().APIRoot
+
+	basic := func(user, pwd string) http.Header {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.SetBasicAuth(user, pwd)
+		return r.Header
+	}
+	runRoutes(t, s, []routeCase{
+		{method: "GET", target: api + "/user/me", status: 401, contains: []string{`"error_code":203`}},
+		{method: "GET", target: api + "/user/me", header: http.Header{"Authorization": {"Bearer nonsense"}}, status: 401},
+		{method: "POST", target: api + "/auth/login", header: basic("player", "wrong"), status: 403, contains: []string{`"error_code": 104`}},
+		{method: "GET", target: "/portal/", status: 303},
+		{method: "POST", target: "/portal/login", form: url.Values{"name": {"player"}, "password": {"wrong"}}, status: 403},
+	})
+
+	w := serve(s, "POST", api+"/auth/login", nil, basic("player", testPassword))
+	var token LoginToken
+	if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil || token.Token == "" {
+		t.Fatalf("login: status %d, body %s", w.Code, w.Body.String())
+	}
+	bearer := http.Header{"Authorization": {"Bearer " + token.Token}}
+	runRoutes(t, s, []routeCase{
+		{method: "GET", target: api + "/user/me", header: bearer, status: 200, contains: []string{`"user_code":"000000001"`}},
+		{method: "GET", target: api + "/game/info", header: bearer, status: 200},
+	})
+
+	w = serve(s, "POST", "/portal/login", url.Values{"name": {"player"}, "password": {testPassword}}, nil)
+	cookies := w.Result().Cookies()
+	if w.Code != 303 || len(cookies) != 1 || cookies[0].Name != portalCookie {
+		t.Fatalf("portal login: status %d, cookies %v", w.Code, cookies)
+	}
+	runRoutes(t, s, []routeCase{
+		{
+			method: "GET", target: "/portal/",
+			header: http.Header{"Cookie": {cookies[0].Name + "=" + cookies[0].Value}},
+			status: 200, contains: []string{testUserCode},
+		},
+	})
+
+	entries, err := s.store.QueryAudit(AuditFilter{Action: auditLoginFailed, Limit: 10})
+	if err != nil || len(entries) != 2 {
+		t.Errorf("failed logins in audit log = %v, %v", entries, err)
+	}
+}
+
+// TestServerPortalBehindProxy checks portal links, redirects and cookie keep
+// path of public URL, as a reverse proxy serves the server under it.
+func TestServerPortalBehindProxy(t *testing.T) {
+	s := newTestServer(t, func(config *Config) {
+		config.Auth = true
+		config.PublicURL = "https://example.com/zrc/"
+	})
+	runRoutes(t, s, []routeCase{
+		{method: "GET", target: "/portal/login", status: 200, contains: []string{`action="/zrc/portal/login"`}},
+	})
+	if w := serve(s, "GET", "/portal/", nil, nil); w.Header().Get("Location") != "/zrc/portal/login" {
+		t.Errorf("portal without session redirects to %q", w.Header().Get("Location"))
+	}
+	if w := serve(s, "POST", "/portal/logout", nil, nil); w.Header().Get("Location") != "/zrc/portal/login" {
+		t.Errorf("portal logout redirects to %q", w.Header().Get("Location"))
+	}
+
+	w := serve(s, "POST", "/portal/login", url.Values{"name": {"player"}, "password": {"wrong"}}, nil)
+	if w.Code != 403 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("failed portal login: status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	w = serve(s, "POST", "/portal/login", url.Values{"name": {"player"}, "password": {testPassword}}, nil)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Path != "/zrc/portal" || !cookies[0].Secure {
+		t.Fatalf("portal login cookies %v", cookies)
+	}
+	if location := w.Header().Get("Location"); location != "/zrc/portal/" {
+		t.Errorf("portal login redirects to %q", location)
+	}
+	runRoutes(t, s, []routeCase{
+		{
+			method: "GET", target: "/portal/",
+			header: http.Header{"Cookie": {cookies[0].Name + "=" + cookies[0].Value}},
+			status: 200, contains: []string{`href="/zrc/portal/recent"`},
+		},
+	})
+}
+
+func TestAdminStoreError(t *testing.T) {
+	r := httptest.NewRequest("POST", "/admin/players", nil)
+	w := httptest.NewRecorder()
+	adminStoreError(w, r, "create player", fmt.Errorf("UNIQUE constraint failed: player.secret_column"))
+	if w.Code != 500 || strings.Contains(w.Body.String(), "secret_column") {
+		t.Errorf("database error: status %d, body %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	adminStoreError(w, r, "update player", fmt.Errorf("wrapped: %w", invalidf("nothing to update")))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "nothing to update") {
+		t.Errorf("invalid argument: status %d, body %s", w.Code, w.Body.String())
+	}
+}
+
+func TestServerAdmin(t *testing.T) {
+	s := newTestServer(t, nil)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("admin", testAdminPassword)
+	admin := r.Header
+
+	runRoutes(t, s, []routeCase{
+		{method: "GET", target: "/admin/players", status: 401},
+		{method: "GET", target: "/admin/players", header: http.Header{"Authorization": {"Basic YWRtaW46d3Jvbmc="}}, status: 401},
+	})
+
+	w := serve(s, "POST", "/admin/players", url.Values{"user_name": {"alice"}, "password": {"pw"}, "email": {"a@example.com"}}, admin)
+	var created struct {
+		UserID   int    `json:"user_id"`
+		UserCode string `json:"user_code"`
+	}
+	decodeValue(t, w, &created)
+	player := fmt.Sprintf("/admin/players/%d", created.UserID)
+
+	present := url.Values{
+		"present_id": {"gift"}, "expire_ts": {"9999999999999"}, "description": {"hello"},
+		"items": {`[{"type":"memory","amount":100}]`},
+	}
+	runRoutes(t, s, []routeCase{
+		{method: "POST", target: "/admin/players", form: url.Values{"user_name": {"alice"}, "password": {"pw"}}, header: admin, status: 400},
+		{method: "POST", target: "/admin/players", form: url.Values{"user_name": {"ALICE"}, "password": {"pw"}}, header: admin, status: 400, contains: []string{"already taken"}},
+		{method: "POST", target: "/admin/players", form: url.Values{"user_name": {"bob"}}, header: admin, status: 400},
+		{method: "GET", target: "/admin/players", header: admin, status: 200, contains: []string{`"name":"player"`, `"name":"alice"`}},
+		{method: "GET", target: "/admin/players", form: url.Values{"query": {created.UserCode}}, header: admin, status: 200, lacks: []string{`"name":"player"`}},
+		{method: "GET", target: "/admin/players", form: url.Values{"limit": {"x"}}, header: admin, status: 400},
+		{method: "GET", target: player, header: admin, status: 200, contains: []string{`"name":"alice"`}},
+		{method: "GET", target: "/admin/players/999", header: admin, status: 404},
+		{method: "POST", target: player, form: url.Values{"ticket": {"30"}, "display_name": {"Alice"}}, header: admin, status: 200, contains: []string{`"affected":1`}},
+		{method: "POST", target: player, form: url.Values{"rating": {"9999"}}, header: admin, status: 400},
+		{method: "POST", target: player + "/purchases", form: url.Values{"type": {"single"}, "id": {"alpha"}}, header: admin, status: 200, contains: []string{`"affected":1`}},
+		{method: "POST", target: player + "/purchases", form: url.Values{"type": {"single"}, "id": {"alpha"}}, header: admin, status: 200, contains: []string{`"affected":0`}},
+		{method: "POST", target: player + "/purchases", form: url.Values{"type": {"world"}, "id": {"x"}}, header: admin, status: 400},
+		{method: "DELETE", target: player + "/purchases/single/alpha", header: admin, status: 200, contains: []string{`"affected":1`}},
+		{method: "POST", target: player + "/characters", form: url.Values{"part_id": {"1"}, "level": {"8"}, "uncapped": {"true"}}, header: admin, status: 200},
+		{method: "POST", target: player + "/characters", form: url.Values{"part_id": {"257"}}, header: admin, status: 400},
+		{method: "POST", target: player + "/characters", form: url.Values{"part_id": {"1"}, "level": {"300"}}, header: admin, status: 400},
+		{method: "GET", target: player + "/characters", header: admin, status: 200, contains: []string{`"level":8`, `"is_uncapped":true`}},
+		{method: "DELETE", target: player + "/characters/1", header: admin, status: 200, contains: []string{`"affected":1`}},
+		{method: "POST", target: player + "/cores", form: url.Values{"core_id": {"core_generic"}, "amount": {"3"}}, header: admin, status: 200},
+		{method: "POST", target: player + "/cores", form: url.Values{"core_id": {"core_generic"}, "amount": {"5"}}, header: admin, status: 200, contains: []string{`"affected":1`}},
+		{method: "DELETE", target: player + "/cores/core_generic", header: admin, status: 200, contains: []string{`"affected":1`}},
+		{method: "POST", target: "/admin/presents", form: present, header: admin, status: 200},
+		{method: "POST", target: "/admin/presents", form: url.Values{"present_id": {"broken"}, "items": {"{"}}, header: admin, status: 400},
+		{method: "GET", target: "/admin/presents", header: admin, status: 200, contains: []string{`"present_id":"gift"`}},
+		{method: "POST", target: player + "/presents", form: url.Values{"present_id": {"gift"}}, header: admin, status: 200, contains: []string{`"affected":1`}},
+		{method: "DELETE", target: player + "/presents/gift", header: admin, status: 200, contains: []string{`"affected":1`}},
+		{method: "DELETE", target: "/admin/presents/gift", header: admin, status: 200},
+		{method: "GET", target: "/admin/game_info", header: admin, status: 200, contains: []string{`"max_stamina":12`}},
+		{method: "POST", target: "/admin/game_info", form: url.Values{"max_stamina": {"20"}}, header: admin, status: 200},
+		{method: "POST", target: "/admin/game_info", form: url.Values{}, header: admin, status: 400},
+		{method: "GET", target: s.cfg().APIRoot + "/game/info", status: 200, contains: []string{`"max_stamina":20`}},
+		{method: "GET", target: "/admin/cache", header: admin, status: 200, contains: []string{`"static"`}},
+		{
+			method: "GET", target: "/admin/audit", form: url.Values{"user_id": {fmt.Sprint(created.UserID)}}, header: admin, status: 200,
+			contains: []string{
+				`"action":"admin.create_player"`, `"action":"admin.update_player"`,
+				// fields in detail are sorted
+				`display_name=\"Alice\" ticket=\"30\"`,
+			},
+		},
+		{method: "GET", target: "/admin/audit", form: url.Values{"user_id": {"x"}}, header: admin, status: 400},
+		{method: "DELETE", target: player, header: admin, status: 200},
+		{method: "GET", target: player, header: admin, status: 404},
+	})
+}
@@ -1,5 +1,18 @@
 package main
 
+import "strings"
+
+// sqlPlaceholders generates comma separated anonymous placeholders for a
+// dynamic IN-list of n values, e.g. `?, ?, ?`. Anonymous placeholders after a
+// numbered one are numbered continuously by SQLite, and by rebindDollar for
+// PostgreSQL, so it's safe to use after `?1` style parameters.
+func sqlPlaceholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
 const sqlStmtQueryLoginInfo = `
 	select
 		user_id, pwdhash from player
@@ -9,12 +22,7 @@ const sqlStmtQueryLoginInfo = `
 
 const sqlStmtToggleUncap = `
 	update part_stats
-	set is_uncapped_override =
-	case when is_uncapped_override = 't' then
-		'f'
-	else
-		't'
-	end
+	set is_uncapped_override = 1 - is_uncapped_override
 	where user_id = ?1 and part_id = ?2
 `
 
@@ -22,25 +30,33 @@ const sqlStmtQueryDLInfo = `
 	select
 		song.song_id,
 		song.checksum as "audio_checksum",
-		ifnull(song.remote_dl, '') as "song_dl",
+		song.remote_dl as "song_dl",
 		cast(chart_info.difficulty as text) as "difficulty",
 		chart_info.checksum as "chart_checksum",
-		ifnull(chart_info.remote_dl, '') as "chart_dl"
+		chart_info.remote_dl as "chart_dl"
 	from
 		%s, song, chart_info
 	where
 		pur.user_id = ?1
 		and song.song_id = chart_info.song_id
 		and %s
-		and (song.remote_dl = 't' or chart_info.remote_dl = 't')
+		and (song.remote_dl = 1 or chart_info.remote_dl = 1)
 		%s
 `
 
+const sqlStmtSongIDInCond = `and song.song_id in (%s)`
+
+const sqlStmtStaticSongs = `select song_id, checksum from song`
+
+const sqlStmtStaticCharts = `
+	select song_id, difficulty, rating, checksum from chart_info
+`
+
 const sqlStmtOwnedChar = `
 	select
-		part_id,
-		ifnull(is_uncapped_override, '') as uncapped_override,
-		ifnull(is_uncapped, '') as uncapped,
+		part_stats.part_id,
+		is_uncapped_override,
+		is_uncapped,
 		overdrive,
 		prog,
 		frag,
@@ -55,22 +71,21 @@ const sqlStmtOwnedChar = `
 		and part_stats.lv = level_exp.lv
 		`
 
-const sqlStmtCharStaticStats = `
-	select 
-		ifnull(v.part_id, -1) as has_voice,
-		ifnull(skill_id, '') as skill,
-		ifnull(skill_id_uncap, '') as skill_uncap,
-		ifnull(skill_requires_uncap, '') skill_requires_uncap,
+const sqlStmtStaticPartners = `
+	select
+		p.part_id,
+		coalesce(v.part_id, -1) as has_voice,
+		coalesce(skill_id, '') as skill,
+		coalesce(skill_id_uncap, '') as skill_uncap,
+		skill_requires_uncap,
 		skill_unlock_level,
 		part_name,
 		char_type
 	from
-		partner p left outer join part_voice v on p.part_id = v.part_id 
-	where
-		p.part_id = ?
+		partner p left outer join part_voice v on p.part_id = v.part_id
 `
 
-const sqlStmtSingleCharCond = `and part_stats.part_id = %d`
+const sqlStmtSingleCharCond = `and part_stats.part_id = ?2`
 
 const sqlStmtChangeChar = `
 	update
@@ -83,12 +98,11 @@ const sqlStmtChangeChar = `
 
 const slqStmtGameInfo = `
 	select
-		cast(strftime('%s', 'now') as decimal),
 		max_stamina,
 		stamina_recover_tick,
 		core_exp,
-		ifnull(world_ranking_enabled, ''),
-		ifnull(is_byd_chapter_unlocked, '')
+		world_ranking_enabled,
+		is_byd_chapter_unlocked
 	from
 		game_info
 `
@@ -102,83 +116,57 @@ const sqlStmtPackInfo = `
 		pack
 `
 
-const sqlStmtPackItem = `
-	select 
-		item_id, item_type, is_available
+const sqlStmtPackItems = `
+	select
+		pack_name, item_id, item_type, is_available
 	from
 		pack_item
-	where
-		pack_name = ?
+	order by
+		pack_name, item_id
 `
 
-const sqlStmtReadBackupData = `select backup_data from data_backup where user_id = ?`
-
-const sqlStmtWriteBackupDate = `update data_backup set backup_data = ?1 where user_id = ?2`
-
-const sqlStmtScoreLookup = `
+const sqlStmtReadBackupData = `
 	select
-		sc.played_date,
-		so.song_id,
-		so.title_local_en,
-		sc.difficulty,
-		c.rating as base_rating,
-		sc.score,
-		sc.shiny_pure,
-		sc.pure,
-		sc.far,
-		sc.lost,
-		sc.rating,
-		sc.health,
-		sc.clear_type
+		version, backup_data
 	from
-		player p, best_score b, score sc, song so, chart_info c
+		data_backup
 	where
-		p.user_code = ?
-		and p.user_id = b.user_id
-		and p.user_id = sc.user_id
-		and sc.played_date = b.played_date
-		and so.song_id = sc.song_id
-		and so.song_id = c.song_id
-		and c.difficulty = sc.difficulty
-		and c.rating * 100 > p.rating - 250
+		user_id = ?1
 	order by
-		sc.rating desc
-`
-
-const sqlStmtGetScoreLookupRating = `
-	with 
-		best as (
-			select ROW_NUMBER () OVER ( 
-				order by rating desc
-			) row_num,
-			rating
-			from  best_score b, score s
-			where b.user_id = ?1
-				and b.user_id = s.user_id
-				and b.played_date = s.played_date
-		),
-		recent as (
-			select rating
-			from  recent_score r, score s
-			where r.user_id = ?1
-				and r.is_recent_10 = 't'
-				and r.user_id = s.user_id
-				and r.played_date = s.played_date
-		)
-	select
-		ifnull(b30, 0), ifnull(r10, 0)
-	from (
-		select ifnull(sum(rating), 0) / ifnull(count(rating), 1) b30
-		from best
-		where row_num <= 30
-	), (
-		select ifnull(sum(rating), 0) / ifnull(count(rating), 1) r10
-		from recent
-	)
+		version desc
+	limit 1
 `
 
-const sqlStmtBaseRating = `
-	select rating from chart_info where song_id = ?1 and difficulty = ?2
+const sqlStmtReadBackupVersion = `
+	select version, backup_data from data_backup where user_id = ?1 and version = ?2
+`
+
+const sqlStmtLatestBackupVersion = `
+	select coalesce(max(version), 0) from data_backup where user_id = ?1
+`
+
+const sqlStmtWriteBackupData = `
+	insert into data_backup(user_id, version, created_at, backup_data)
+	values(?1, ?2, ?3, ?4)
+`
+
+const sqlStmtPruneBackup = `
+	delete from data_backup where user_id = ?1 and version <= ?2
+`
+
+const sqlStmtOldBackups = `select * from old_data_backup`
+
+const sqlStmtCopyOldBackups = `
+	insert into data_backup(user_id, version, created_at, backup_data)
+	select user_id, version, created_at, backup_data from old_data_backup
+`
+
+const sqlStmtDropOldBackups = `drop table old_data_backup`
+
+const sqlStmtSQLiteColumns = `select name, type from pragma_table_info(?1)`
+
+const sqlStmtPlayerByCode = `
+	select user_id, user_name from player where user_code = ?1
 `
 
 const sqlStmtInsertScore = `
@@ -198,6 +186,10 @@ const sqlStmtInsertScore = `
 	) values(?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12)
 `
 
+const sqlStmtScoreExists = `
+	select count(*) from score where user_id = ?1 and played_date = ?2
+`
+
 const sqlStmtLookupBestScore = `
 	select
 		s.score, s.played_date
@@ -216,7 +208,7 @@ const sqlStmtInsertBestScore = `
 `
 
 const sqlStmtReplaceBestScore = `
-	update best_score set played_date = ?1 where played_date = ?2
+	update best_score set played_date = ?1 where user_id = ?2 and played_date = ?3
 `
 
 const sqlStmtLookupRecentScore = `
@@ -233,10 +225,12 @@ const sqlStmtLookupRecentScore = `
 		and r.played_date = s.played_date
 `
 
-const sqlStmtReplaceRecnetScore = `
-	update recent_score
-	set played_date = ?1, is_recent_10 = ?2
-	where user_id = ?3 and played_date = ?4
+const sqlStmtDeleteRecentScore = `
+	delete from recent_score where user_id = ?1 and played_date = ?2
+`
+
+const sqlStmtSetRecent10 = `
+	update recent_score set is_recent_10 = ?1 where user_id = ?2 and played_date = ?3
 `
 
 const sqlStmtInsertRecentScore = `
@@ -244,34 +238,33 @@ const sqlStmtInsertRecentScore = `
 	values(?1, ?2, ?3)
 `
 
-const sqlStmtComputeRating = `
-	with
-		best as (
-			select ROW_NUMBER () OVER ( 
-				order by rating desc
-			) row_num,
-			rating
-			from  best_score b, score s
-			where b.user_id = ?1
-				and b.user_id = s.user_id
-				and b.played_date = s.played_date
-		),
-		recent as (
-			select rating
-			from  recent_score r, score s
-			where r.user_id = ?1
-				and r.is_recent_10 = 't'
-				and r.user_id = s.user_id
-				and r.played_date = s.played_date
-		)
+const sqlStmtBestRatings = `
 	select
-		round((ifnull(b30, 0) + ifnull(r10, 0)) / (ifnull(b30_count, 1) + ifnull(r10_count, 1)) * 100)
-	from (
-		select sum(rating) b30, count(rating) b30_count from best
-		where row_num <= 30
-	), (
-		select sum(rating) r10, count(rating) r10_count from recent
-	)
+		s.rating
+	from
+		best_score b, score s
+	where
+		b.user_id = ?1
+		and b.user_id = s.user_id
+		and b.played_date = s.played_date
+	order by
+		s.rating desc
+	limit 30
+`
+
+const sqlStmtRecent10Ratings = `
+	select
+		s.rating
+	from
+		recent_score r, score s
+	where
+		r.user_id = ?1
+		and r.is_recent_10 = 1
+		and r.user_id = s.user_id
+		and r.played_date = s.played_date
+	order by
+		s.rating desc
+	limit 10
 `
 
 const sqlStmtUpdateRating = `
@@ -282,19 +275,19 @@ const sqlStmtUserInfo = `
 	select
 		user_name,
 		user_code,
-		ifnull(display_name, '') as displayname,
+		coalesce(display_name, '') as displayname,
 		ticket,
-		ifnull(partner, 0) as part_id,
-		ifnull(is_locked_name_duplicated, '') as locked,
-		ifnull(is_skill_sealed, '') as skill_sealed,
-		ifnull(curr_map, '') as curr_map,
+		coalesce(partner, 0) as part_id,
+		is_locked_name_duplicated,
+		is_skill_sealed,
+		coalesce(curr_map, '') as curr_map,
 		prog_boost,
 		stamina,
 		next_fragstam_ts,
 		max_stamina_ts,
-		ifnull(max_stamina_notification, ''),
-		ifnull(is_hide_rating, ''), 
-		ifnull(favorite_partner, 0),
+		max_stamina_notification,
+		is_hide_rating,
+		coalesce(favorite_partner, 0),
 		recent_score_date, max_friend,
 		rating,
 		join_date
@@ -305,9 +298,12 @@ const sqlStmtUserInfo = `
 `
 
 const sqlStmtAprilfools = `
-	select ifnull(is_aprilfools, '') from game_info
+	select is_aprilfools from game_info
 `
 
+// sqlStmtPlayerItems takes column and table name from playerItemTables.
+const sqlStmtPlayerItems = `select %s from %s where user_id = ?1`
+
 const sqlStmtCoreInfo = `
 	select
 		c.internal_id, c.core_name, amount
@@ -329,63 +325,355 @@ const sqlStmtMostRecentScore = `
 		score s, best_score b, score s2
 	where
 		s.user_id = ?1
-		and s.played_date = (select max(played_date) from score)
+		and s.played_date = (select max(played_date) from score where user_id = ?1)
 		and s.song_id = s2.song_id
 		and b.user_id = ?1
 		and b.played_date = s2.played_date
 `
 
+// sqlStmtUserSetting takes column name from settableColumns, all values are
+// passed as parameters.
 const sqlStmtUserSetting = `
-	update player set %s = '%s' where user_id = %d
+	update player set %s = ?1 where user_id = ?2
 `
 
 const sqlStmtFavouritePartner = `
-	update player set favorite_partner = '%d' where user_id = %d
+	update player set favorite_partner = ?1 where user_id = ?2
 `
 
-const sqlStmtMapInfo = `
+const sqlStmtStaticMaps = `
 	select
 		available_from,
 		available_to,
 		beyond_health,
 		chapter,
 		coordinate,
-		ifnull(custom_bg, '') custom_bg,
-		ifnull(is_beyond, '') is_beyond,
-		ifnull(is_legacy, '') is_legacy,
-		ifnull(is_repeatable, '') is_repeatable,
-		world_map.map_id,
-		ifnull(require_id, '') require_id,
-		ifnull(require_type, '') require_type,
-		ifnull(require_value, 1) require_value,
+		coalesce(custom_bg, '') custom_bg,
+		is_beyond,
+		is_legacy,
+		is_repeatable,
+		map_id,
+		coalesce(require_id, '') require_id,
+		coalesce(require_type, '') require_type,
+		coalesce(require_value, 1) require_value,
 		stamina_cost,
-		step_count,
+		step_count
+	from
+		world_map
+`
+
+const sqlStmtMapProgress = `
+	select
+		map_id,
 		curr_capture,
 		curr_position,
-		ifnull(is_locked, '') is_locked
+		is_locked
 	from
-		world_map, player_map_prog
+		player_map_prog
 	where
-		player_map_prog.map_id = world_map.map_id
-		and player_map_prog.user_id = ?1
+		user_id = ?1
 `
 
 const sqlStmtCurrentMap = `
-	select ifnull(curr_map, '') from player where user_id = ?1
+	select coalesce(curr_map, '') from player where user_id = ?1
 `
 
 const sqlStmtMapAffinity = `
-	select part_id, multiplier from map_affinity where map_id = ?1
+	select
+		map_id, part_id, multiplier
+	from
+		map_affinity
+	order by
+		map_id, part_id
 `
 
 const sqlStmtRewards = `
 	select
-		ifnull(reward_id, "") reward_id,
+		map_id,
+		coalesce(reward_id, '') reward_id,
 		item_type,
-		ifnull(amount, 0) amount,
+		coalesce(amount, 0) amount,
 		position
 	from
 		map_reward
+	order by
+		map_id, position, item_type
+`
+
+const sqlStmtCreateSchemaVersion = `
+	create table if not exists schema_version (
+		version integer primary key,
+		name text not null,
+		applied_at bigint not null
+	)
+`
+
+const sqlStmtSchemaVersion = `select coalesce(max(version), 0) from schema_version`
+
+const sqlStmtInsertSchemaVersion = `
+	insert into schema_version(version, name, applied_at) values(?1, ?2, ?3)
+`
+
+const sqlStmtImportSongIDs = `select song_id from song`
+
+const sqlStmtImportPackNames = `select pack_name from pack`
+
+const sqlStmtImportPartIDs = `select cast(part_id as text) from partner`
+
+const sqlStmtImportCoreIDs = `select core_id from core`
+
+// Static data import statement templates, table and column names are filled
+// in from import table definitions, never from imported files.
+const sqlStmtImportSelect = `select %s from %s where %s`
+
+const sqlStmtImportInsert = `insert into %s (%s) values(%s)`
+
+const sqlStmtImportUpdate = `update %s set %s where %s`
+
+const sqlStmtImportDelete = `delete from %s where %s`
+
+const sqlStmtFindPlayer = `
+	select
+		user_id
+	from
+		player
+	where
+		lower(user_name) = lower(?1)
+		or email = ?1
+		or user_code = ?2
+`
+
+const sqlStmtUserCodeExists = `select count(*) from player where user_code = ?1`
+
+const sqlStmtPlayerNameExists = `
+	select
+		count(*)
+	from
+		player
 	where
-		map_id = ?1
+		lower(user_name) = lower(?1)
+		or (coalesce(?2, '') != '' and email = ?2)
+`
+
+// sqlStmtTableColumns takes table name from code, it selects no rows and is
+// used for column names only.
+const sqlStmtTableColumns = `select * from %s where 1 = 0`
+
+const sqlStmtPresentIDs = `select present_id from present`
+
+const sqlStmtPresentMe = `
+	select
+		p.present_id, p.expire_ts, p.description, p.items
+	from
+		present p, player_present pp
+	where
+		pp.user_id = ?1
+		and pp.present_id = p.present_id
+		and p.expire_ts > ?2
+	order by
+		p.expire_ts
+`
+
+const sqlStmtAdminPlayerExists = `select count(*) from player where user_id = ?1`
+
+const sqlStmtAdminListPlayers = `
+	select
+		user_id, user_name, user_code, coalesce(email, ''), rating, ticket, join_date
+	from
+		player
+	where
+		?1 = ''
+		or lower(user_name) like lower(?1)
+		or email like ?1
+		or user_code = ?2
+	order by
+		user_id
+	limit ?3 offset ?4
+`
+
+const sqlStmtAdminDefaultPartners = `
+	insert into part_stats(user_id, part_id, overdrive, prog, frag, lv, exp_val)
+	select cast(?1 as integer), part_id, 55, 55, 55, 1, 0 from partner where part_id in (0, 1)
+`
+
+// sqlStmtAdminUpdatePlayer takes columns from updatableColumns.
+const sqlStmtAdminUpdatePlayer = `update player set %s where user_id = ?`
+
+// sqlStmtAdminDeleteUserRows takes table name from archiveTables.
+const sqlStmtAdminDeleteUserRows = `delete from %s where user_id = ?1`
+
+// sqlStmtAdminAddPurchase and sqlStmtAdminRemovePurchase take table and column
+// from purchaseTables.
+const sqlStmtAdminAddPurchase = `
+	insert into %s(user_id, %s) values(?1, ?2) on conflict do nothing
+`
+
+const sqlStmtAdminRemovePurchase = `delete from %s where user_id = ?1 and %s = ?2`
+
+const sqlStmtAdminUnlockChar = `
+	insert into part_stats(
+		user_id, part_id, lv, is_uncapped, overdrive, prog, frag, exp_val
+	) values(?1, ?2, ?3, ?4, ?5, ?6, ?7, coalesce((select exp_val from level_exp where lv = ?3), 0))
+	on conflict (user_id, part_id) do update set
+		lv = excluded.lv,
+		is_uncapped = excluded.is_uncapped,
+		overdrive = excluded.overdrive,
+		prog = excluded.prog,
+		frag = excluded.frag,
+		exp_val = excluded.exp_val
+`
+
+const sqlStmtAdminRemoveChar = `delete from part_stats where user_id = ?1 and part_id = ?2`
+
+const sqlStmtAdminSetCore = `
+	insert into core_possess_info(user_id, core_id, amount) values(?1, ?2, ?3)
+	on conflict (user_id, core_id) do update set amount = excluded.amount
+`
+
+const sqlStmtAdminRemoveCore = `delete from core_possess_info where user_id = ?1 and core_id = ?2`
+
+const sqlStmtAdminListPresents = `
+	select present_id, expire_ts, description, items from present order by expire_ts
+`
+
+const sqlStmtAdminSavePresent = `
+	insert into present(present_id, expire_ts, description, items)
+	values(?1, ?2, ?3, ?4)
+	on conflict (present_id) do update set
+		expire_ts = excluded.expire_ts,
+		description = excluded.description,
+		items = excluded.items
+`
+
+const sqlStmtAdminDeletePlayerPresents = `delete from player_present where present_id = ?1`
+
+const sqlStmtAdminDeletePresent = `delete from present where present_id = ?1`
+
+const sqlStmtAdminGivePresent = `
+	insert into player_present(user_id, present_id) values(?1, ?2)
+	on conflict do nothing
+`
+
+const sqlStmtAdminTakePresent = `
+	delete from player_present where user_id = ?1 and present_id = ?2
+`
+
+// sqlStmtAdminUpdateGameInfo takes columns from updatableColumns.
+const sqlStmtAdminUpdateGameInfo = `update game_info set %s`
+
+const sqlStmtInsertAudit = `
+	insert into audit_log(created_at, actor, user_id, action, detail, remote_addr, device)
+	values(?1, ?2, ?3, ?4, ?5, ?6, ?7)
+`
+
+const sqlStmtCleanAudit = `delete from audit_log where created_at < ?1`
+
+const sqlStmtQueryAudit = `
+	select
+		log_id, created_at, actor, user_id, action, detail, remote_addr, device
+	from
+		audit_log
+	where
+		(cast(?1 as integer) is null or user_id = ?1)
+		and (?2 = '' or action = ?2 or action like ?2 || '.%')
+		and (cast(?3 as bigint) is null or created_at >= ?3)
+		and (cast(?4 as bigint) is null or created_at < ?4)
+	order by
+		log_id desc
+	limit ?5 offset ?6
+`
+
+const sqlStmtPortalPlayer = `
+	select user_name, user_code, rating, join_date from player where user_id = ?1
+`
+
+const sqlStmtPortalPlayCount = `
+	select count(*), max(played_date) from score where user_id = ?1
+`
+
+const sqlStmtPortalCurrentChar = `
+	select coalesce(partner, 0) from player where user_id = ?1
+`
+
+const sqlStmtPortalPacks = `select pack_name from pack order by pack_name`
+
+// sqlStmtScoreEntryColumns are columns read by queryScoreEntries, statements
+// using them select whether play is in Recent 10 after them.
+const sqlStmtScoreEntryColumns = `
+		s.played_date,
+		s.song_id,
+		coalesce(so.title_local_en, s.song_id) as title,
+		coalesce(so.pack_name, ''),
+		s.difficulty,
+		coalesce(c.rating, 0) as base_rating,
+		s.score,
+		s.shiny_pure,
+		s.pure,
+		s.far,
+		s.lost,
+		s.rating,
+		s.health,
+		s.clear_type,
+`
+
+const sqlStmtPortalRecent = `
+	select` + sqlStmtScoreEntryColumns + `
+		r.is_recent_10
+	from
+		recent_score r
+		join score s on s.user_id = r.user_id and s.played_date = r.played_date
+		left join song so on so.song_id = s.song_id
+		left join chart_info c on c.song_id = s.song_id and c.difficulty = s.difficulty
+	where
+		r.user_id = ?1
+	order by
+		s.rating desc
+`
+
+// sqlStmtPortalBest takes ORDER BY clause from scoreSorts, negative
+// difficulty or clear type and empty pack name disable the filter.
+const sqlStmtPortalBest = `
+	select` + sqlStmtScoreEntryColumns + `
+		0
+	from
+		best_score b
+		join score s on s.user_id = b.user_id and s.played_date = b.played_date
+		left join song so on so.song_id = s.song_id
+		left join chart_info c on c.song_id = s.song_id and c.difficulty = s.difficulty
+	where
+		b.user_id = ?1
+		and (?2 < 0 or s.difficulty = ?2)
+		and (?3 = '' or so.pack_name = ?3)
+		and (?4 < 0 or s.clear_type = ?4)
+	order by
+		%s
+`
+
+const sqlStmtPortalHistory = `
+	select` + sqlStmtScoreEntryColumns + `
+		0
+	from
+		score s
+		left join song so on so.song_id = s.song_id
+		left join chart_info c on c.song_id = s.song_id and c.difficulty = s.difficulty
+	where
+		s.user_id = ?1
+	order by
+		s.played_date desc
+	limit ?2 offset ?3
+`
+
+const sqlStmtBest30 = `
+	select` + sqlStmtScoreEntryColumns + `
+		0
+	from
+		best_score b
+		join score s on s.user_id = b.user_id and s.played_date = b.played_date
+		left join song so on so.song_id = s.song_id
+		left join chart_info c on c.song_id = s.song_id and c.difficulty = s.difficulty
+	where
+		b.user_id = ?1
+	order by
+		s.rating desc
+	limit 30
 `
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// Groups of static game data cached together, each is loaded on first use.
+const (
+	staticGameInfo = "game_info" // game_info, level_exp
+	staticPacks    = "packs"     // pack, pack_item
+	staticPartners = "partners"  // partner, part_voice
+	staticMaps     = "maps"      // world_map, map_affinity, map_reward
+	staticSongs    = "songs"     // song, chart_info
+)
+
+// staticCache keeps game data which only changes when new content is
+// deployed. Invalidating cache bumps its version, groups loaded under an older
+// version are read again on next use, and loads still running while version
+// changes don't get cached.
+type staticCache struct {
+	sync.Mutex
+	version uint64
+	groups  map[string]*staticGroup
+}
+
+type staticGroup struct {
+	version uint64
+	loaded  bool
+	value   interface{}
+	hits    uint64
+	misses  uint64
+}
+
+// StaticCacheStats is usage of a group of cached game data.
+type StaticCacheStats struct {
+	Group   string `json:"group"`
+	Version uint64 `json:"version"`
+	Loaded  bool   `json:"loaded"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+func newStaticCache() *staticCache {
+	c := &staticCache{groups: map[string]*staticGroup{}}
+	for _, name := range []string{staticGameInfo, staticPacks, staticPartners, staticMaps, staticSongs} {
+		c.groups[name] = &staticGroup{}
+	}
+	return c
+}
+
+// get returns cached value of group, calling load to read it when it's not
+// cached under current version.
+func (c *staticCache) get(group string, load func() (interface{}, error)) (interface{}, error) {
+	c.Lock()
+	g := c.groups[group]
+	version := c.version
+	if g.loaded && g.version == version {
+		g.hits++
+		value := g.value
+		c.Unlock()
+		return value, nil
+	}
+	g.misses++
+	c.Unlock()
+
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	if c.version == version {
+		g.value, g.version, g.loaded = value, version, true
+	}
+	c.Unlock()
+	return value, nil
+}
+
+// invalidate drops all cached groups.
+func (c *staticCache) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.version++
+	for _, g := range c.groups {
+		g.value, g.loaded = nil, false
+	}
+}
+
+func (c *staticCache) stats() []StaticCacheStats {
+	c.Lock()
+	defer c.Unlock()
+	stats := []StaticCacheStats{}
+	for name, g := range c.groups {
+		stats = append(stats, StaticCacheStats{
+			Group:   name,
+			Version: c.version,
+			Loaded:  g.loaded && g.version == c.version,
+			Hits:    g.hits,
+			Misses:  g.misses,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Group < stats[j].Group })
+	return stats
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Store is persistence layer of game API. Methods returning a single row
+// return sql.ErrNoRows when it doesn't exist.
+type Store interface {
+	ratingSource
+
+	// Section: Game
+	GameInfo() (*GameInfo, error)
+	IsAprilFools() (bool, error)
+	// Presents lists presents of player which expire after now, in ms.
+	Presents(userID int, now int64) ([]Present, error)
+	// AllPresents lists every present, sorted by expire time.
+	AllPresents() ([]Present, error)
+
+	// Section: Players
+	LoginInfo(user string) (userID int, pwdHash string, err error)
+	// Player reads columns of PLAYER into user info, lists and character
+	// stats are left empty.
+	Player(userID int) (*UserInfo, error)
+	PlayerItems(userID int, item playerItem) ([]string, error)
+	Cores(userID int) ([]CoreInfo, error)
+	MostRecentScore(userID int) (ScoreRecord, error)
+	// FindPlayer looks up user ID of player by user name, email or user code.
+	FindPlayer(user string) (int, error)
+	// PlayerByCode looks up user ID and name of player by user code.
+	PlayerByCode(userCode int64) (int, string, error)
+	PlayerSummary(userID int) (*PlayerSummary, error)
+	// PlayCount counts plays of player and reads time of the last one, which
+	// is 0 when there's none.
+	PlayCount(userID int) (int, int64, error)
+	CurrentPartner(userID int) (int8, error)
+	// SetSetting switches a flag setting, column must be in settableColumns.
+	SetSetting(userID int, column string, isOn bool) error
+	SetFavoritePartner(userID int, partID int) error
+
+	// Section: Characters
+	// Characters lists character stats of player, or of a single character
+	// when partID isn't negative.
+	Characters(userID int, partID int8) ([]CharacterStats, error)
+	SetCharacter(userID int, partID int, skillSealed bool) error
+	ToggleUncap(userID int, partID int) error
+
+	// Section: Scores
+	// ChartRating reads chart constant of a chart.
+	ChartRating(songID string, difficulty int8) (float64, error)
+	// UpdateScores runs fn in a transaction, which is committed if fn returns
+	// nil and rolled back otherwise.
+	UpdateScores(fn func(tx ScoreTx) error) error
+	// Best30 lists best scores of player counted in rating, highest rated
+	// first.
+	Best30(userID int) ([]ScoreEntry, error)
+	// BestScores lists best score of every chart player has played.
+	BestScores(userID int, filter ScoreFilter) ([]ScoreEntry, error)
+	// RecentScores lists Recent 30 plays of player, highest rated first.
+	RecentScores(userID int) ([]ScoreEntry, error)
+	// ScoreHistory lists plays of player, most recent first.
+	ScoreHistory(userID int, limit int, offset int) ([]ScoreEntry, error)
+
+	// Section: Maps
+	// Maps lists maps player has progress on, along with their affinity and
+	// rewards.
+	Maps(userID int) ([]MapInfo, error)
+	CurrentMap(userID int) (string, error)
+
+	// Section: Purchases
+	// Packs lists packs along with items in them.
+	Packs() ([]PackInfo, error)
+	PackNames() ([]string, error)
+	// PurchasedDownloads lists remote downloadable charts of songs purchased
+	// by player, limited to songIDs if it's not empty.
+	PurchasedDownloads(userID int, songIDs []string) ([]dlInfo, error)
+	SongChecksum(songID string) (string, error)
+	ChartChecksum(songID string, difficulty int) (string, error)
+
+	// Section: Backups
+	// Backup reads a backup version of player, or the latest one when
+	// version is 0.
+	Backup(userID int, version int) (int, string, error)
+	// SaveBackup saves data as a new backup version and keeps only latest
+	// history versions, 0 for keeping all. It returns the new version.
+	SaveBackup(userID int, createdAt int64, data string, history int) (int, error)
+
+	// Section: Audit
+	WriteAudit(entry *AuditEntry) error
+	// CleanAudit removes audit log entries created before given time and
+	// returns number of entries removed.
+	CleanAudit(before int64) (int64, error)
+	// QueryAudit lists audit log entries matching filter, newest first.
+	QueryAudit(filter AuditFilter) ([]AuditEntry, error)
+
+	// Section: Admin
+	// Modifying methods return number of rows affected.
+	PlayerExists(userID int) (bool, error)
+	// ListPlayers lists players whose user name or email matches query as a
+	// LIKE pattern, or whose user code is query. Empty query matches everyone.
+	ListPlayers(query string, limit int, offset int) ([]PlayerListing, error)
+	// CreatePlayer creates player owning default partners under a random
+	// user code, empty email is left unset. User name or email already in use
+	// is refused. It returns user ID and user code.
+	CreatePlayer(name string, email string, pwdHash string, joinDate int64) (int, int64, error)
+	// UpdatePlayer sets columns of player, which must be in
+	// updatableColumns["player"].
+	UpdatePlayer(userID int, values map[string]interface{}) (int64, error)
+	// DeletePlayer removes player along with their rows in archiveTables.
+	DeletePlayer(userID int) error
+	// GrantPurchase and RevokePurchase take kind from purchaseTables.
+	GrantPurchase(userID int, kind string, itemID string) (int64, error)
+	RevokePurchase(userID int, kind string, itemID string) (int64, error)
+	// UnlockCharacter gives character to player, or overwrites level,
+	// uncap and stats of it when player already has it.
+	UnlockCharacter(userID int, stats *CharacterStats) (int64, error)
+	RemoveCharacter(userID int, partID int) (int64, error)
+	SetCore(userID int, coreID string, amount int) (int64, error)
+	RemoveCore(userID int, coreID string) (int64, error)
+	// SavePresent creates present or overwrites the one with the same ID.
+	SavePresent(present *Present) (int64, error)
+	// DeletePresent removes present and takes it back from every player.
+	DeletePresent(presentID string) error
+	GivePresent(userID int, presentID string) (int64, error)
+	TakePresent(userID int, presentID string) (int64, error)
+	// UpdateGameInfo sets columns of game info, which must be in
+	// updatableColumns["game_info"].
+	UpdateGameInfo(values map[string]interface{}) (int64, error)
+
+	// Section: Rows
+	// EditRows runs fn in a transaction, which is committed if fn returns nil
+	// and rolled back otherwise.
+	EditRows(fn func(tx RowTx) error) error
+
+	// Section: Static data
+	// InvalidateStatic drops cached game data, so that it's read from
+	// database again on next use.
+	InvalidateStatic()
+	StaticCacheStats() []StaticCacheStats
+
+	// SchemaVersion reads version of schema applied to database.
+	SchemaVersion() (int, error)
+	// Ping checks database can still be reached.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// ScoreTx is a transaction updating score records of players.
+type ScoreTx interface {
+	ratingSource
+
+	InsertScore(userID int, record *ScoreRecord) error
+	ScoreExists(userID int, playedDate int64) (bool, error)
+	// BestScore reads score and play time of best play of a chart.
+	BestScore(userID int, songID string, difficulty int8) (int, int64, error)
+	InsertBestScore(userID int, playedDate int64) error
+	ReplaceBestScore(userID int, oldPlayedDate int64, newPlayedDate int64) error
+	RecentPlays(userID int) ([]recentPlay, error)
+	InsertRecentPlay(userID int, play recentPlay) error
+	DeleteRecentPlay(userID int, playedDate int64) error
+	SetRecent10(userID int, playedDate int64, isR10 bool) error
+	UpdateRating(userID int, rating int) error
+}
+
+// RowTx is a transaction over rows of tables, for static data import and
+// player archives, which copy rows between files and tables as they are.
+// Table names and column names of conditions are put into statements, they
+// must come from code. Columns of inserted rows are checked against table.
+//
+// Conditions map column to value it must equal, a []interface{} value matches
+// any of its elements.
+type RowTx interface {
+	// KnownIDs lists IDs of a kind of static data: song, pack, partner, core
+	// or present.
+	KnownIDs(kind string) (map[string]bool, error)
+	// SelectRows reads columns of rows matching where, nil columns read every
+	// column.
+	SelectRows(table string, columns []string, where map[string]interface{}) ([]map[string]interface{}, error)
+	InsertRow(table string, row map[string]interface{}) error
+	UpdateRows(table string, values map[string]interface{}, where map[string]interface{}) (int64, error)
+	DeleteRows(table string, where map[string]interface{}) (int64, error)
+
+	// PlayerTaken tells whether user name, or email when it's not empty, is
+	// already used by a player.
+	PlayerTaken(name string, email string) (bool, error)
+	// NewUserCode picks a random unused 9 digits user code.
+	NewUserCode() (int64, error)
+	// InsertPlayer inserts row of player, which must have user code, and
+	// returns user ID player gets.
+	InsertPlayer(row map[string]interface{}) (int, error)
+}
+
+// PlayerSummary is player shown in portal header.
+type PlayerSummary struct {
+	UserID   int
+	Name     string
+	UserCode string
+	Rating   float64
+	JoinDate int64
+}
+
+// PlayerListing is a player listed by admin API.
+type PlayerListing struct {
+	UserID   int    `json:"user_id"`
+	Name     string `json:"name"`
+	UserCode string `json:"user_code"`
+	Email    string `json:"email"`
+	Rating   int    `json:"rating"`
+	Ticket   int    `json:"ticket"`
+	JoinDate int64  `json:"join_date"`
+}
+
+// ScoreEntry is a score along with title of song and constant of chart,
+// listed on score lookup, score image and portal pages. IsR10 is only set
+// for Recent 30 plays.
+type ScoreEntry struct {
+	ScoreRecord
+	Title      string
+	PackName   string
+	BaseRating float64
+	IsR10      bool
+}
+
+// ScoreFilter selects best scores listed on portal. Negative difficulty or
+// clear type and empty pack name match everything. Sort is a key of
+// scoreSorts, unknown keys sort by rating.
+type ScoreFilter struct {
+	Sort       string
+	Difficulty int
+	Pack       string
+	ClearType  int
+}
+
+// AuditFilter selects audit log entries, nil fields match everything. Time
+// range is [From, To) in unix seconds.
+type AuditFilter struct {
+	UserID *int
+	Action string
+	From   *int64
+	To     *int64
+	Limit  int
+	Offset int
+}
+
+// invalidError is returned by Store when arguments are refused before any
+// database access, its message is fit to show to clients.
+type invalidError struct {
+	message string
+}
+
+func (e *invalidError) Error() string { return e.message }
+
+func invalidf(format string, args ...interface{}) error {
+	return &invalidError{fmt.Sprintf(format, args...)}
+}
+
+// ratingSource reads ratings counted in player potential.
+type ratingSource interface {
+	BestRatings(userID int) ([]float64, error)
+	Recent10Ratings(userID int) ([]float64, error)
+}
+
+// playerItem is a kind of item list owned by player.
+type playerItem int
+
+const (
+	playerWorldUnlocks playerItem = iota
+	playerWorldSongs
+	playerPacks
+	playerSingles
+)
+
+// storeBackend is a database backend a Store can be opened on. All backends
+// share the statements in sql_stmt.go, which are written in SQL understood by
+// each of them.
+type storeBackend struct {
+	driver string
+	// dataSource turns db option in config into data source name of driver.
+	dataSource func(db string) (string, error)
+	// rebind rewrites placeholders of statements into what driver accepts.
+	rebind func(stmt string) string
+}
+
+var storeBackends = map[string]storeBackend{
+	"sqlite": {
+		driver:     "sqlite3",
+		dataSource: filepath.Abs,
+		rebind:     func(stmt string) string { return stmt },
+	},
+	"postgres": {
+		driver:     "postgres",
+		dataSource: func(db string) (string, error) { return db, nil },
+		rebind:     rebindDollar,
+	},
+}
+
+// storeBackendNames lists names of storage backends for messages.
+func storeBackendNames() string {
+	names := []string{}
+	for name := range storeBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// rebindDollar rewrites `?NNN` and `?` placeholders into `$N` used by
+// PostgreSQL. Anonymous ones are numbered the way SQLite does, one greater
+// than the largest number so far. `?` in string literals, quoted identifiers
+// and comments is left as it is.
+func rebindDollar(stmt string) string {
+	var (
+		b   strings.Builder
+		max int
+	)
+	for i := 0; i < len(stmt); i++ {
+		if end := sqlSkipQuoted(stmt, i); end > i {
+			b.WriteString(stmt[i:end])
+			i = end - 1
+			continue
+		}
+		if stmt[i] != '?' {
+			b.WriteByte(stmt[i])
+			continue
+		}
+		j := i + 1
+		for j < len(stmt) && stmt[j] >= '0' && stmt[j] <= '9' {
+			j++
+		}
+		n := max + 1
+		if j > i+1 {
+			n, _ = strconv.Atoi(stmt[i+1 : j])
+		}
+		if n > max {
+			max = n
+		}
+		fmt.Fprintf(&b, "$%d", n)
+		i = j - 1
+	}
+	return b.String()
+}
+
+// sqlSkipQuoted returns end of string literal, quoted identifier or comment
+// starting at stmt[i], or i when there's none. Unterminated ones run to the
+// end of statement.
+func sqlSkipQuoted(stmt string, i int) int {
+	switch {
+	case stmt[i] == '\'' || stmt[i] == '"':
+		// quotes inside are escaped by doubling them, which reads as two
+		// adjacent quoted parts
+		if end := strings.IndexByte(stmt[i+1:], stmt[i]); end >= 0 {
+			return i + 1 + end + 1
+		}
+		return len(stmt)
+	case strings.HasPrefix(stmt[i:], "--"):
+		if end := strings.IndexByte(stmt[i:], '\n'); end >= 0 {
+			return i + end
+		}
+		return len(stmt)
+	case strings.HasPrefix(stmt[i:], "/*"):
+		if end := strings.Index(stmt[i+2:], "*/"); end >= 0 {
+			return i + 2 + end + 2
+		}
+		return len(stmt)
+	}
+	return i
+}
@@ -0,0 +1,1596 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlBool is a flag column, stored as integer 1 for true and 0 for false.
+// Scanning also accepts booleans and their text forms, NULL scans as false.
+type sqlBool bool
+
+func (b *sqlBool) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*b = false
+	case int64:
+		*b = v != 0
+	case bool:
+		*b = sqlBool(v)
+	case []byte:
+		return b.Scan(string(v))
+	case string:
+		if v == "" {
+			*b = false
+			return nil
+		}
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid flag value `%s`", v)
+		}
+		*b = sqlBool(parsed)
+	default:
+		return fmt.Errorf("can't scan %T into flag", value)
+	}
+	return nil
+}
+
+func (b sqlBool) Value() (driver.Value, error) {
+	if b {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
+
+// playerItemTables maps item lists of player to column and table holding
+// them.
+var playerItemTables = map[playerItem][2]string{
+	playerWorldUnlocks: {"item_name", "world_unlock"},
+	playerWorldSongs:   {"item_name", "world_song_unlock"},
+	playerPacks:        {"pack_name", "pack_purchase_info"},
+	playerSingles:      {"song_id", "single_purchase_info"},
+}
+
+// updatableColumns are columns admin API can set on each table.
+var updatableColumns = map[string]map[string]bool{
+	"player": {
+		"user_name": true, "email": true, "display_name": true, "ticket": true, "pwdhash": true,
+	},
+	"game_info": {
+		"is_aprilfools": true, "world_ranking_enabled": true, "is_byd_chapter_unlocked": true,
+		"max_stamina": true, "stamina_recover_tick": true, "core_exp": true,
+	},
+}
+
+// knownIDStmts maps kind of static data to statement listing their IDs.
+var knownIDStmts = map[string]string{
+	"song":    sqlStmtImportSongIDs,
+	"pack":    sqlStmtImportPackNames,
+	"partner": sqlStmtImportPartIDs,
+	"core":    sqlStmtImportCoreIDs,
+	"present": sqlStmtPresentIDs,
+}
+
+// scoreSorts maps sort key of ScoreFilter to ORDER BY clause of
+// sqlStmtPortalBest.
+var scoreSorts = map[string]string{
+	"rating": "s.rating desc, s.played_date desc",
+	"score":  "s.score desc, s.rating desc",
+	"base":   "coalesce(c.rating, 0) desc, s.rating desc",
+	"date":   "s.played_date desc",
+	"title":  "lower(coalesce(so.title_local_en, s.song_id)), s.difficulty",
+}
+
+// sqlQuerier is implemented by both *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqlConn runs statements of sql_stmt.go on a database or a transaction,
+// rewritten for backend.
+type sqlConn struct {
+	q       sqlQuerier
+	backend storeBackend
+}
+
+func (c sqlConn) exec(stmt string, args ...interface{}) (sql.Result, error) {
+	return c.q.Exec(c.backend.rebind(stmt), args...)
+}
+
+func (c sqlConn) query(stmt string, args ...interface{}) (*sql.Rows, error) {
+	return c.q.Query(c.backend.rebind(stmt), args...)
+}
+
+func (c sqlConn) queryRow(stmt string, args ...interface{}) *sql.Row {
+	return c.q.QueryRow(c.backend.rebind(stmt), args...)
+}
+
+// sqlStore is Store on a database/sql database, it serves every backend in
+// storeBackends.
+type sqlStore struct {
+	sqlConn
+	db     *sql.DB
+	static *staticCache
+}
+
+// openStore connects to database in config and brings its schema up to date.
+// Database behind store is also returned for connection pool metrics.
+func openStore(config *Config) (Store, *sql.DB, error) {
+	backend, ok := storeBackends[config.Storage]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown storage `%s`", config.Storage)
+	}
+	dataSource, err := backend.dataSource(config.DB)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := sql.Open(backend.driver, dataSource)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("error while connecting to database: %w", err)
+	}
+
+	st := &sqlStore{sqlConn{db, backend}, db, newStaticCache()}
+	if _, err := st.migrate(config.Storage); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return st, db, nil
+}
+
+func (st *sqlStore) Close() error {
+	return st.db.Close()
+}
+
+func (st *sqlStore) Ping(ctx context.Context) error {
+	return st.db.PingContext(ctx)
+}
+
+func (st *sqlStore) InvalidateStatic() {
+	st.static.invalidate()
+}
+
+func (st *sqlStore) StaticCacheStats() []StaticCacheStats {
+	return st.static.stats()
+}
+
+// Section: Game
+// ============================================================================
+
+// staticGameInfoData is game info cached along with April Fools switch.
+type staticGameInfoData struct {
+	info       GameInfo
+	aprilFools bool
+}
+
+func (st *sqlStore) GameInfo() (*GameInfo, error) {
+	data, err := st.gameInfoData()
+	if err != nil {
+		return nil, err
+	}
+	info := data.info
+	return &info, nil
+}
+
+func (st *sqlStore) IsAprilFools() (bool, error) {
+	data, err := st.gameInfoData()
+	if err != nil {
+		return false, err
+	}
+	return data.aprilFools, nil
+}
+
+func (st *sqlStore) gameInfoData() (*staticGameInfoData, error) {
+	value, err := st.static.get(staticGameInfo, st.loadGameInfo)
+	if err != nil {
+		return nil, err
+	}
+	return value.(*staticGameInfoData), nil
+}
+
+func (st *sqlStore) loadGameInfo() (interface{}, error) {
+	data := new(staticGameInfoData)
+	info := &data.info
+	err := st.queryRow(slqStmtGameInfo).Scan(
+		&info.MaxStam,
+		&info.StaminaRecoverTick,
+		&info.CoreExp,
+		(*sqlBool)(&info.WorldRankingEnabled),
+		(*sqlBool)(&info.BydUnlocked),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Error occured while querying GAME_INFO: %w", err)
+	}
+	rows, err := st.query(sqlStmtLevelStep)
+	if err != nil {
+		return nil, fmt.Errorf("Error occured while querying table LEVEL_EXP: %w", err)
+	}
+	defer rows.Close()
+
+	levelsteps := []levelStep{}
+	for rows.Next() {
+		step := levelStep{}
+		rows.Scan(&step.Lv, &step.Exp)
+		levelsteps = append(levelsteps, step)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error occured while reading rows from LEVEL_EXP: %w", err)
+	}
+	info.LevelSteps = levelsteps
+
+	var isAprilFools sqlBool
+	if err := st.queryRow(sqlStmtAprilfools).Scan(&isAprilFools); err != nil {
+		return nil, fmt.Errorf("Error occured while reading April Fools info: %w", err)
+	}
+	data.aprilFools = bool(isAprilFools)
+	return data, nil
+}
+
+func (st *sqlStore) Presents(userID int, now int64) ([]Present, error) {
+	return st.queryPresents(sqlStmtPresentMe, userID, now)
+}
+
+func (st *sqlStore) AllPresents() ([]Present, error) {
+	return st.queryPresents(sqlStmtAdminListPresents)
+}
+
+func (st *sqlStore) queryPresents(stmt string, args ...interface{}) ([]Present, error) {
+	rows, err := st.query(stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error occured while querying table PRESENT: %w", err)
+	}
+	defer rows.Close()
+
+	presents := []Present{}
+	var items string
+	for rows.Next() {
+		present := new(Present)
+		rows.Scan(&present.PresentID, &present.ExpireTs, &present.Description, &items)
+		if err := json.Unmarshal([]byte(items), &present.Items); err != nil {
+			return nil, fmt.Errorf("items of present `%s` are broken: %w", present.PresentID, err)
+		}
+		presents = append(presents, *present)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error occured while reading rows queried from PRESENT: %w", err)
+	}
+	return presents, nil
+}
+
+// Section: Players
+// ============================================================================
+
+func (st *sqlStore) LoginInfo(user string) (int, string, error) {
+	var (
+		userID  int
+		pwdHash string
+	)
+	err := st.queryRow(sqlStmtQueryLoginInfo, user).Scan(&userID, &pwdHash)
+	return userID, pwdHash, err
+}
+
+func (st *sqlStore) Player(userID int) (*UserInfo, error) {
+	var (
+		userCode        int64
+		recentScoreDate sql.NullInt64
+	)
+	info := new(UserInfo)
+	err := st.queryRow(sqlStmtUserInfo, userID).Scan(
+		&info.Name,
+		&userCode,
+		&info.DisplaName,
+		&info.Ticket,
+		&info.PartID,
+		(*sqlBool)(&info.IsLockedNameDuplicate),
+		(*sqlBool)(&info.IsSkillSealed),
+		&info.CurrentMap,
+		&info.ProgBoost,
+		&info.Stamina,
+		&info.NextFragstamTs,
+		&info.MaxStaminaTs,
+		(*sqlBool)(&info.Settings.StaminaNotification),
+		(*sqlBool)(&info.Settings.HideRating),
+		&info.Settings.FavoriteCharacter,
+		&recentScoreDate,
+		&info.MaxFriend,
+		&info.Rating,
+		&info.JoinDate,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	info.UserCode = fmt.Sprintf("%09d", userCode)
+	return info, nil
+}
+
+func (st *sqlStore) PlayerItems(userID int, item playerItem) ([]string, error) {
+	table, ok := playerItemTables[item]
+	if !ok {
+		return nil, fmt.Errorf("unknown player item %d", item)
+	}
+	rows, err := st.query(fmt.Sprintf(sqlStmtPlayerItems, table[0], table[1]), userID)
+	if err != nil {
+		return nil, fmt.Errorf("Error occured while querying table %s: %w", table[1], err)
+	}
+	defer rows.Close()
+
+	results := []string{}
+	var itemName string
+	for rows.Next() {
+		rows.Scan(&itemName)
+		results = append(results, itemName)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error occured while querying table %s: %w", table[1], err)
+	}
+	return results, nil
+}
+
+func (st *sqlStore) Cores(userID int) ([]CoreInfo, error) {
+	rows, err := st.query(sqlStmtCoreInfo, userID)
+	if err != nil {
+		return nil, fmt.Errorf("Error occured while querying table CORE_POSSESS_INFO: %w", err)
+	}
+	defer rows.Close()
+
+	coreInfoes := []CoreInfo{}
+	var (
+		coreName   string
+		internalID string
+		amount     int8
+	)
+	for rows.Next() {
+		rows.Scan(&coreName, &internalID, &amount)
+		coreInfoes = append(coreInfoes, CoreInfo{coreName, amount, internalID})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occured while querying core info: %w", err)
+	}
+	return coreInfoes, nil
+}
+
+func (st *sqlStore) MostRecentScore(userID int) (ScoreRecord, error) {
+	record := ScoreRecord{}
+	var modifier sql.NullInt32
+	err := st.queryRow(sqlStmtMostRecentScore, userID).Scan(
+		&record.SongID, &record.Difficulty, &record.Score,
+		&record.Shiny, &record.Pure, &record.Far, &record.Lost,
+		&record.Health, &modifier,
+		&record.ClearType, &record.BestClearType,
+	)
+	if err != nil {
+		return record, fmt.Errorf("error occured while querying most recent score: %w", err)
+	}
+	record.Modifier = int(modifier.Int32)
+	return record, nil
+}
+
+func (st *sqlStore) FindPlayer(user string) (int, error) {
+	var userID int
+	err := st.queryRow(sqlStmtFindPlayer, user, queryUserCode(user)).Scan(&userID)
+	return userID, err
+}
+
+// queryUserCode parses user code in a player query, -1 when it isn't one so
+// that it matches nobody.
+func queryUserCode(query string) int64 {
+	code, err := strconv.ParseInt(query, 10, 64)
+	if err != nil || code <= 0 {
+		return -1
+	}
+	return code
+}
+
+func (st *sqlStore) PlayerByCode(userCode int64) (int, string, error) {
+	var (
+		userID int
+		name   string
+	)
+	err := st.queryRow(sqlStmtPlayerByCode, userCode).Scan(&userID, &name)
+	return userID, name, err
+}
+
+func (st *sqlStore) PlayerSummary(userID int) (*PlayerSummary, error) {
+	player := &PlayerSummary{UserID: userID}
+	var (
+		userCode int64
+		rating   int
+	)
+	err := st.queryRow(sqlStmtPortalPlayer, userID).Scan(
+		&player.Name, &userCode, &rating, &player.JoinDate,
+	)
+	if err != nil {
+		return nil, err
+	}
+	player.UserCode = fmt.Sprintf("%09d", userCode)
+	player.Rating = float64(rating) / 100
+	return player, nil
+}
+
+func (st *sqlStore) PlayCount(userID int) (int, int64, error) {
+	var (
+		plays int
+		last  sql.NullInt64
+	)
+	err := st.queryRow(sqlStmtPortalPlayCount, userID).Scan(&plays, &last)
+	return plays, last.Int64, err
+}
+
+func (st *sqlStore) CurrentPartner(userID int) (int8, error) {
+	var partID int8
+	err := st.queryRow(sqlStmtPortalCurrentChar, userID).Scan(&partID)
+	return partID, err
+}
+
+func (st *sqlStore) SetSetting(userID int, column string, isOn bool) error {
+	if !settableColumns[column] {
+		return fmt.Errorf("column `%s` of PLAYER is not a settable option", column)
+	}
+	_, err := st.exec(fmt.Sprintf(sqlStmtUserSetting, column), sqlBool(isOn), userID)
+	return err
+}
+
+func (st *sqlStore) SetFavoritePartner(userID int, partID int) error {
+	_, err := st.exec(sqlStmtFavouritePartner, partID, userID)
+	return err
+}
+
+// Section: Characters
+// ============================================================================
+
+func (st *sqlStore) Characters(userID int, partID int8) ([]CharacterStats, error) {
+	cond := ""
+	args := []interface{}{userID}
+	if partID >= 0 {
+		cond = sqlStmtSingleCharCond
+		args = append(args, partID)
+	}
+	partners, err := st.partners()
+	if err != nil {
+		return nil, err
+	}
+	statses := []CharacterStats{}
+	rows, err := st.query(sqlStmtOwnedChar+cond, args...)
+	if err != nil {
+		return statses, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		stats := CharacterStats{}
+		rows.Scan(
+			&stats.PartID,
+			(*sqlBool)(&stats.IsUncappedOverride),
+			(*sqlBool)(&stats.IsUncapped),
+			&stats.Overdrive,
+			&stats.Prog,
+			&stats.Frag,
+			&stats.ProgTempest,
+			&stats.Level,
+			&stats.Exp,
+			&stats.LevelExp,
+		)
+
+		partner, ok := partners[stats.PartID]
+		if !ok {
+			continue
+		}
+		stats.Voice = partner.Voice
+		stats.SkillID = partner.SkillID
+		stats.SkillIDUncap = partner.SkillIDUncap
+		stats.SkillRequiresUncap = partner.SkillRequiresUncap
+		stats.SkillUnlockLevel = partner.SkillUnlockLevel
+		stats.PartName = partner.PartName
+		stats.CharType = partner.CharType
+		stats.UncapCores = []string{}
+
+		statses = append(statses, stats)
+	}
+	if err := rows.Err(); err != nil {
+		return statses, fmt.Errorf("Error occured while querying table PART_STATS for single character, userID = %d, partID = %d: %w", userID, partID, err)
+	}
+	return statses, nil
+}
+
+// partners reads static stats of every partner, player stats are left empty.
+func (st *sqlStore) partners() (map[int8]CharacterStats, error) {
+	value, err := st.static.get(staticPartners, func() (interface{}, error) {
+		rows, err := st.query(sqlStmtStaticPartners)
+		if err != nil {
+			return nil, fmt.Errorf("Error occured while querying table PARTNER: %w", err)
+		}
+		defer rows.Close()
+
+		partners := map[int8]CharacterStats{}
+		var hasVoice int
+		for rows.Next() {
+			stats := CharacterStats{}
+			rows.Scan(
+				&stats.PartID,
+				&hasVoice,
+				&stats.SkillID,
+				&stats.SkillIDUncap,
+				(*sqlBool)(&stats.SkillRequiresUncap),
+				&stats.SkillUnlockLevel,
+				&stats.PartName,
+				&stats.CharType,
+			)
+			if hasVoice != -1 {
+				stats.Voice = voiceList
+			}
+			partners[stats.PartID] = stats
+		}
+		return partners, rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(map[int8]CharacterStats), nil
+}
+
+func (st *sqlStore) SetCharacter(userID int, partID int, skillSealed bool) error {
+	_, err := st.exec(sqlStmtChangeChar, partID, sqlBool(skillSealed), userID)
+	return err
+}
+
+func (st *sqlStore) ToggleUncap(userID int, partID int) error {
+	_, err := st.exec(sqlStmtToggleUncap, userID, partID)
+	return err
+}
+
+// Section: Scores
+// ============================================================================
+
+func (st *sqlStore) ChartRating(songID string, difficulty int8) (float64, error) {
+	chart, err := st.chart(songID, int(difficulty))
+	return chart.rating, err
+}
+
+func (st *sqlStore) UpdateScores(fn func(tx ScoreTx) error) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(&sqlScoreTx{sqlConn{tx, st.backend}}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (st *sqlStore) Best30(userID int) ([]ScoreEntry, error) {
+	return st.queryScoreEntries(sqlStmtBest30, userID)
+}
+
+func (st *sqlStore) BestScores(userID int, filter ScoreFilter) ([]ScoreEntry, error) {
+	order, ok := scoreSorts[filter.Sort]
+	if !ok {
+		order = scoreSorts["rating"]
+	}
+	return st.queryScoreEntries(
+		fmt.Sprintf(sqlStmtPortalBest, order),
+		userID, filter.Difficulty, filter.Pack, filter.ClearType,
+	)
+}
+
+func (st *sqlStore) RecentScores(userID int) ([]ScoreEntry, error) {
+	return st.queryScoreEntries(sqlStmtPortalRecent, userID)
+}
+
+func (st *sqlStore) ScoreHistory(userID int, limit int, offset int) ([]ScoreEntry, error) {
+	return st.queryScoreEntries(sqlStmtPortalHistory, userID, limit, offset)
+}
+
+// queryScoreEntries reads score rows, statement must select
+// sqlStmtScoreEntryColumns followed by Recent 10 flag.
+func (st *sqlStore) queryScoreEntries(stmt string, args ...interface{}) ([]ScoreEntry, error) {
+	rows, err := st.query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scores := []ScoreEntry{}
+	for rows.Next() {
+		var score ScoreEntry
+		err := rows.Scan(
+			&score.TimePlayed, &score.SongID, &score.Title, &score.PackName,
+			&score.Difficulty, &score.BaseRating, &score.Score, &score.Shiny,
+			&score.Pure, &score.Far, &score.Lost, &score.Rating, &score.Health,
+			&score.ClearType, (*sqlBool)(&score.IsR10),
+		)
+		if err != nil {
+			return nil, err
+		}
+		scores = append(scores, score)
+	}
+	return scores, rows.Err()
+}
+
+func (c sqlConn) BestRatings(userID int) ([]float64, error) {
+	return c.queryRatings(sqlStmtBestRatings, userID)
+}
+
+func (c sqlConn) Recent10Ratings(userID int) ([]float64, error) {
+	return c.queryRatings(sqlStmtRecent10Ratings, userID)
+}
+
+func (c sqlConn) queryRatings(stmt string, userID int) ([]float64, error) {
+	rows, err := c.query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ratings := []float64{}
+	for rows.Next() {
+		var rating float64
+		if err := rows.Scan(&rating); err != nil {
+			return nil, err
+		}
+		ratings = append(ratings, rating)
+	}
+	return ratings, rows.Err()
+}
+
+// sqlScoreTx is ScoreTx of sqlStore.
+type sqlScoreTx struct {
+	sqlConn
+}
+
+func (tx *sqlScoreTx) InsertScore(userID int, record *ScoreRecord) error {
+	_, err := tx.exec(sqlStmtInsertScore,
+		userID,
+		record.TimePlayed,
+		record.SongID,
+		record.Difficulty,
+		record.Score,
+		record.Shiny,
+		record.Pure,
+		record.Far,
+		record.Lost,
+		record.Rating,
+		record.Health,
+		record.ClearType,
+	)
+	return err
+}
+
+func (tx *sqlScoreTx) ScoreExists(userID int, playedDate int64) (bool, error) {
+	var count int
+	err := tx.queryRow(sqlStmtScoreExists, userID, playedDate).Scan(&count)
+	return count > 0, err
+}
+
+func (tx *sqlScoreTx) BestScore(userID int, songID string, difficulty int8) (int, int64, error) {
+	var (
+		score      int
+		playedDate int64
+	)
+	err := tx.queryRow(sqlStmtLookupBestScore, userID, songID, difficulty).Scan(&score, &playedDate)
+	return score, playedDate, err
+}
+
+func (tx *sqlScoreTx) InsertBestScore(userID int, playedDate int64) error {
+	_, err := tx.exec(sqlStmtInsertBestScore, userID, playedDate)
+	return err
+}
+
+func (tx *sqlScoreTx) ReplaceBestScore(userID int, oldPlayedDate int64, newPlayedDate int64) error {
+	_, err := tx.exec(sqlStmtReplaceBestScore, newPlayedDate, userID, oldPlayedDate)
+	return err
+}
+
+func (tx *sqlScoreTx) RecentPlays(userID int) ([]recentPlay, error) {
+	rows, err := tx.query(sqlStmtLookupRecentScore, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plays := []recentPlay{}
+	for rows.Next() {
+		var play recentPlay
+		if err := rows.Scan(&play.rating, &play.playedDate, &play.chart, (*sqlBool)(&play.isR10)); err != nil {
+			return nil, err
+		}
+		plays = append(plays, play)
+	}
+	return plays, rows.Err()
+}
+
+func (tx *sqlScoreTx) InsertRecentPlay(userID int, play recentPlay) error {
+	_, err := tx.exec(sqlStmtInsertRecentScore, userID, play.playedDate, sqlBool(play.isR10))
+	return err
+}
+
+func (tx *sqlScoreTx) DeleteRecentPlay(userID int, playedDate int64) error {
+	_, err := tx.exec(sqlStmtDeleteRecentScore, userID, playedDate)
+	return err
+}
+
+func (tx *sqlScoreTx) SetRecent10(userID int, playedDate int64, isR10 bool) error {
+	_, err := tx.exec(sqlStmtSetRecent10, sqlBool(isR10), userID, playedDate)
+	return err
+}
+
+func (tx *sqlScoreTx) UpdateRating(userID int, rating int) error {
+	_, err := tx.exec(sqlStmtUpdateRating, rating, userID)
+	return err
+}
+
+// Section: Maps
+// ============================================================================
+
+func (st *sqlStore) Maps(userID int) ([]MapInfo, error) {
+	maps, err := st.worldMaps()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := st.query(sqlStmtMapProgress, userID)
+	if err != nil {
+		return nil, fmt.Errorf("Error occured while querying table PLAYER_MAP_PROG: %w", err)
+	}
+	defer rows.Close()
+
+	infoes := []MapInfo{}
+	var (
+		mapID                string
+		currCapture, currPos int
+		isLocked             sqlBool
+	)
+	for rows.Next() {
+		rows.Scan(&mapID, &currCapture, &currPos, &isLocked)
+		static, ok := maps[mapID]
+		if !ok {
+			continue
+		}
+		info := *static
+		info.CurrCapture = currCapture
+		info.CurrPosition = currPos
+		info.IsLocked = bool(isLocked)
+		infoes = append(infoes, info)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occured while reading map info: %w", err)
+	}
+	return infoes, nil
+}
+
+// worldMaps reads every map along with its affinity and rewards, progress of
+// player is left empty.
+func (st *sqlStore) worldMaps() (map[string]*MapInfo, error) {
+	value, err := st.static.get(staticMaps, func() (interface{}, error) {
+		rows, err := st.query(sqlStmtStaticMaps)
+		if err != nil {
+			return nil, fmt.Errorf("Error occured while querying table WORLD_MAP: %w", err)
+		}
+		defer rows.Close()
+
+		maps := map[string]*MapInfo{}
+		for rows.Next() {
+			info := &MapInfo{}
+			rows.Scan(
+				&info.AvailableFrom,
+				&info.AvailableTo,
+				&info.BeyondHealth,
+				&info.Chapter,
+				&info.Coordinate,
+				&info.CustomBG,
+				(*sqlBool)(&info.IsBeyond),
+				(*sqlBool)(&info.IsLegacy),
+				(*sqlBool)(&info.IsRepeatable),
+				&info.MapID,
+				&info.RequireID,
+				&info.RequireType,
+				&info.RequireValue,
+				&info.StamCost,
+				&info.StepCount,
+			)
+			info.PartAffinity = []int8{}
+			info.AffMultiplier = []float64{}
+			info.Rewards = []Reward{}
+			maps[info.MapID] = info
+		}
+		if err = rows.Err(); err != nil {
+			return nil, fmt.Errorf("error occured while reading map info: %w", err)
+		}
+
+		if err := st.mapAffinity(maps); err != nil {
+			return nil, err
+		}
+		if err := st.mapRewards(maps); err != nil {
+			return nil, err
+		}
+		return maps, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(map[string]*MapInfo), nil
+}
+
+// mapAffinity attaches affinity of maps to their map info.
+func (st *sqlStore) mapAffinity(maps map[string]*MapInfo) error {
+	rows, err := st.query(sqlStmtMapAffinity)
+	if err != nil {
+		return fmt.Errorf("error occured while querying map affinity: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		mapID  string
+		partID int8
+		mul    float64
+	)
+	for rows.Next() {
+		rows.Scan(&mapID, &partID, &mul)
+		if info, ok := maps[mapID]; ok {
+			info.PartAffinity = append(info.PartAffinity, partID)
+			info.AffMultiplier = append(info.AffMultiplier, mul)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("Error occured while reading rows queried from MAP_AFFINITY: %w", err)
+	}
+	return nil
+}
+
+// mapRewards attaches rewards of maps to their map info.
+func (st *sqlStore) mapRewards(maps map[string]*MapInfo) error {
+	rows, err := st.query(sqlStmtRewards)
+	if err != nil {
+		return fmt.Errorf("Error occured while querying table MAP_REWARD: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		mapID    string
+		position int
+		amount   sql.NullInt32
+	)
+	for rows.Next() {
+		item := RewardItem{}
+		rows.Scan(&mapID, &item.ItemID, &item.ItemType, &amount, &position)
+		item.Amount = amount.Int32
+		if info, ok := maps[mapID]; ok {
+			info.Rewards = append(info.Rewards, Reward{
+				Items:    []RewardItem{item},
+				Position: position,
+			})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("Error occured while reading rows queried from table MAP_REWARD: %w", err)
+	}
+	return nil
+}
+
+func (st *sqlStore) CurrentMap(userID int) (string, error) {
+	var currMap string
+	err := st.queryRow(sqlStmtCurrentMap, userID).Scan(&currMap)
+	return currMap, err
+}
+
+// Section: Purchases
+// ============================================================================
+
+func (st *sqlStore) Packs() ([]PackInfo, error) {
+	value, err := st.static.get(staticPacks, st.loadPacks)
+	if err != nil {
+		return nil, err
+	}
+	return append([]PackInfo{}, value.([]PackInfo)...), nil
+}
+
+func (st *sqlStore) loadPacks() (interface{}, error) {
+	rows, err := st.query(sqlStmtPackInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	packs := []PackInfo{}
+	for rows.Next() {
+		info := PackInfo{}
+		rows.Scan(
+			&info.Name,
+			&info.Price,
+			&info.OrigPrice,
+			&info.DiscountFrom,
+			&info.DiscountTo,
+		)
+		packs = append(packs, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	itemRows, err := st.query(sqlStmtPackItems)
+	if err != nil {
+		return nil, fmt.Errorf("Error occured while querying table PACK_ITEM: %w", err)
+	}
+	defer itemRows.Close()
+
+	byName := map[string]*PackInfo{}
+	for i := range packs {
+		byName[packs[i].Name] = &packs[i]
+	}
+	var packName string
+	for itemRows.Next() {
+		item := PackItem{}
+		itemRows.Scan(&packName, &item.ID, &item.ItemType, (*sqlBool)(&item.IsAvailable))
+		if info, ok := byName[packName]; ok {
+			info.Items = append(info.Items, item)
+		}
+	}
+	return packs, itemRows.Err()
+}
+
+func (st *sqlStore) PackNames() ([]string, error) {
+	rows, err := st.query(sqlStmtPortalPacks)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	packs := []string{}
+	for rows.Next() {
+		var pack string
+		if err := rows.Scan(&pack); err != nil {
+			return nil, err
+		}
+		packs = append(packs, pack)
+	}
+	return packs, rows.Err()
+}
+
+func (st *sqlStore) PurchasedDownloads(userID int, songIDs []string) ([]dlInfo, error) {
+	songIDCondition := ""
+	args := []interface{}{userID}
+	if len(songIDs) > 0 {
+		songIDCondition = fmt.Sprintf(sqlStmtSongIDInCond, sqlPlaceholders(len(songIDs)))
+		for _, songID := range songIDs {
+			args = append(args, songID)
+		}
+	}
+
+	infoes := []dlInfo{}
+	for _, purchase := range []struct{ table, condition string }{
+		{"pack_purchase_info pur", "pur.pack_name = song.pack_name"},
+		{"single_purchase_info pur", "pur.song_id = song.song_id"},
+	} {
+		stmt := fmt.Sprintf(sqlStmtQueryDLInfo, purchase.table, purchase.condition, songIDCondition)
+		rows, err := st.query(stmt, args...)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Error occured while querying table %v for download list: %w",
+				purchase.table, err,
+			)
+		}
+		for rows.Next() {
+			info := dlInfo{}
+			rows.Scan(
+				&info.songID, &info.audioChecksum, (*sqlBool)(&info.songDL),
+				&info.difficulty, &info.chartChecksum, (*sqlBool)(&info.chartDL),
+			)
+			infoes = append(infoes, info)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, fmt.Errorf(
+				"Error occured while reading quiried dl info rows from %v: %w",
+				purchase.table, err,
+			)
+		}
+	}
+	return infoes, nil
+}
+
+func (st *sqlStore) SongChecksum(songID string) (string, error) {
+	songs, err := st.songs()
+	if err != nil {
+		return "", err
+	}
+	song, ok := songs[songID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return song.checksum, nil
+}
+
+func (st *sqlStore) ChartChecksum(songID string, difficulty int) (string, error) {
+	chart, err := st.chart(songID, difficulty)
+	return chart.checksum, err
+}
+
+// staticSong is a cached song along with its charts.
+type staticSong struct {
+	checksum string
+	charts   map[int]staticChart
+}
+
+type staticChart struct {
+	rating   float64
+	checksum string
+}
+
+func (st *sqlStore) chart(songID string, difficulty int) (staticChart, error) {
+	songs, err := st.songs()
+	if err != nil {
+		return staticChart{}, err
+	}
+	song, ok := songs[songID]
+	if !ok {
+		return staticChart{}, sql.ErrNoRows
+	}
+	chart, ok := song.charts[difficulty]
+	if !ok {
+		return staticChart{}, sql.ErrNoRows
+	}
+	return chart, nil
+}
+
+// songs reads every song and chart, keyed by song ID.
+func (st *sqlStore) songs() (map[string]*staticSong, error) {
+	value, err := st.static.get(staticSongs, func() (interface{}, error) {
+		rows, err := st.query(sqlStmtStaticSongs)
+		if err != nil {
+			return nil, fmt.Errorf("Error occured while querying table SONG: %w", err)
+		}
+		defer rows.Close()
+
+		songs := map[string]*staticSong{}
+		var songID string
+		for rows.Next() {
+			song := &staticSong{charts: map[int]staticChart{}}
+			rows.Scan(&songID, &song.checksum)
+			songs[songID] = song
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		chartRows, err := st.query(sqlStmtStaticCharts)
+		if err != nil {
+			return nil, fmt.Errorf("Error occured while querying table CHART_INFO: %w", err)
+		}
+		defer chartRows.Close()
+
+		var difficulty int
+		for chartRows.Next() {
+			chart := staticChart{}
+			chartRows.Scan(&songID, &difficulty, &chart.rating, &chart.checksum)
+			if song, ok := songs[songID]; ok {
+				song.charts[difficulty] = chart
+			}
+		}
+		return songs, chartRows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(map[string]*staticSong), nil
+}
+
+// Section: Backups
+// ============================================================================
+
+func (st *sqlStore) Backup(userID int, version int) (int, string, error) {
+	var row *sql.Row
+	if version == 0 {
+		row = st.queryRow(sqlStmtReadBackupData, userID)
+	} else {
+		row = st.queryRow(sqlStmtReadBackupVersion, userID, version)
+	}
+	var data string
+	err := row.Scan(&version, &data)
+	return version, data, err
+}
+
+func (st *sqlStore) SaveBackup(userID int, createdAt int64, data string, history int) (int, error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	c := sqlConn{tx, st.backend}
+
+	var version int
+	if err = c.queryRow(sqlStmtLatestBackupVersion, userID).Scan(&version); err != nil {
+		return 0, fmt.Errorf("error occured while querying latest backup version of user %d: %w", userID, err)
+	}
+	version++
+	if _, err = c.exec(sqlStmtWriteBackupData, userID, version, createdAt, data); err != nil {
+		return 0, fmt.Errorf("error occured while inserting backup of user %d: %w", userID, err)
+	}
+	if history > 0 {
+		if _, err = c.exec(sqlStmtPruneBackup, userID, version-history); err != nil {
+			return 0, fmt.Errorf("error occured while pruning old backups of user %d: %w", userID, err)
+		}
+	}
+	return version, tx.Commit()
+}
+
+// Section: Audit
+// ============================================================================
+
+func (st *sqlStore) WriteAudit(entry *AuditEntry) error {
+	_, err := st.exec(
+		sqlStmtInsertAudit, entry.CreatedAt, entry.Actor, entry.UserID,
+		entry.Action, entry.Detail, entry.RemoteAddr, entry.Device,
+	)
+	return err
+}
+
+func (st *sqlStore) CleanAudit(before int64) (int64, error) {
+	result, err := st.exec(sqlStmtCleanAudit, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (st *sqlStore) QueryAudit(filter AuditFilter) ([]AuditEntry, error) {
+	rows, err := st.query(
+		sqlStmtQueryAudit, filter.UserID, filter.Action, filter.From, filter.To,
+		filter.Limit, filter.Offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		entry := AuditEntry{}
+		err := rows.Scan(
+			&entry.LogID, &entry.CreatedAt, &entry.Actor, &entry.UserID,
+			&entry.Action, &entry.Detail, &entry.RemoteAddr, &entry.Device,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// Section: Admin
+// ============================================================================
+
+// rowsAffected returns number of rows affected by a statement.
+func rowsAffected(result sql.Result, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (st *sqlStore) PlayerExists(userID int) (bool, error) {
+	var count int
+	err := st.queryRow(sqlStmtAdminPlayerExists, userID).Scan(&count)
+	return count > 0, err
+}
+
+func (st *sqlStore) ListPlayers(query string, limit int, offset int) ([]PlayerListing, error) {
+	rows, err := st.query(sqlStmtAdminListPlayers, query, queryUserCode(query), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	players := []PlayerListing{}
+	for rows.Next() {
+		var (
+			player   PlayerListing
+			userCode int64
+		)
+		err := rows.Scan(
+			&player.UserID, &player.Name, &userCode, &player.Email,
+			&player.Rating, &player.Ticket, &player.JoinDate,
+		)
+		if err != nil {
+			return nil, err
+		}
+		player.UserCode = fmt.Sprintf("%09d", userCode)
+		players = append(players, player)
+	}
+	return players, rows.Err()
+}
+
+func (st *sqlStore) CreatePlayer(name string, email string, pwdHash string, joinDate int64) (int, int64, error) {
+	var (
+		userID   int
+		userCode int64
+	)
+	err := st.editRows(func(tx *sqlRowTx) error {
+		if taken, err := tx.PlayerTaken(name, email); err != nil {
+			return err
+		} else if taken {
+			return invalidf("user name or email is already taken")
+		}
+
+		var err error
+		if userCode, err = tx.NewUserCode(); err != nil {
+			return err
+		}
+		player := map[string]interface{}{
+			"user_name": name, "pwdhash": pwdHash, "user_code": userCode, "join_date": joinDate,
+		}
+		if email != "" {
+			player["email"] = email
+		}
+		if userID, err = tx.InsertPlayer(player); err != nil {
+			return err
+		}
+		_, err = tx.exec(sqlStmtAdminDefaultPartners, userID)
+		return err
+	})
+	return userID, userCode, err
+}
+
+func (st *sqlStore) UpdatePlayer(userID int, values map[string]interface{}) (int64, error) {
+	sets, args, err := updateSets("player", values)
+	if err != nil {
+		return 0, err
+	}
+	return rowsAffected(st.exec(fmt.Sprintf(sqlStmtAdminUpdatePlayer, sets), append(args, userID)...))
+}
+
+func (st *sqlStore) UpdateGameInfo(values map[string]interface{}) (int64, error) {
+	sets, args, err := updateSets("game_info", values)
+	if err != nil {
+		return 0, err
+	}
+	return rowsAffected(st.exec(fmt.Sprintf(sqlStmtAdminUpdateGameInfo, sets), args...))
+}
+
+// updateSets turns values into SET clause of an update statement on table,
+// columns must be in updatableColumns.
+func updateSets(table string, values map[string]interface{}) (string, []interface{}, error) {
+	if len(values) == 0 {
+		return "", nil, invalidf("nothing to update")
+	}
+	columns := make([]string, 0, len(values))
+	for column := range values {
+		if !updatableColumns[table][column] {
+			return "", nil, invalidf("column `%s` of %s can't be updated", column, strings.ToUpper(table))
+		}
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	sets := make([]string, len(columns))
+	args := make([]interface{}, len(columns))
+	for i, column := range columns {
+		sets[i] = column + " = ?"
+		args[i] = values[column]
+	}
+	return strings.Join(sets, ", "), args, nil
+}
+
+func (st *sqlStore) DeletePlayer(userID int) error {
+	return st.editRows(func(tx *sqlRowTx) error {
+		// remove rows in reverse order of archiveTables so that referenced
+		// rows go last.
+		for i := len(archiveTables) - 1; i >= 0; i-- {
+			if _, err := tx.exec(fmt.Sprintf(sqlStmtAdminDeleteUserRows, archiveTables[i]), userID); err != nil {
+				return err
+			}
+		}
+		_, err := tx.exec(fmt.Sprintf(sqlStmtAdminDeleteUserRows, "player"), userID)
+		return err
+	})
+}
+
+func (st *sqlStore) GrantPurchase(userID int, kind string, itemID string) (int64, error) {
+	return st.execPurchase(sqlStmtAdminAddPurchase, userID, kind, itemID)
+}
+
+func (st *sqlStore) RevokePurchase(userID int, kind string, itemID string) (int64, error) {
+	return st.execPurchase(sqlStmtAdminRemovePurchase, userID, kind, itemID)
+}
+
+func (st *sqlStore) execPurchase(stmt string, userID int, kind string, itemID string) (int64, error) {
+	target, ok := purchaseTables[kind]
+	if !ok {
+		return 0, invalidf("unknown purchase type `%s`", kind)
+	}
+	return rowsAffected(st.exec(fmt.Sprintf(stmt, target.table, target.column), userID, itemID))
+}
+
+func (st *sqlStore) UnlockCharacter(userID int, stats *CharacterStats) (int64, error) {
+	return rowsAffected(st.exec(
+		sqlStmtAdminUnlockChar, userID, stats.PartID, stats.Level, sqlBool(stats.IsUncapped),
+		stats.Overdrive, stats.Prog, stats.Frag,
+	))
+}
+
+func (st *sqlStore) RemoveCharacter(userID int, partID int) (int64, error) {
+	return rowsAffected(st.exec(sqlStmtAdminRemoveChar, userID, partID))
+}
+
+func (st *sqlStore) SetCore(userID int, coreID string, amount int) (int64, error) {
+	return rowsAffected(st.exec(sqlStmtAdminSetCore, userID, coreID, amount))
+}
+
+func (st *sqlStore) RemoveCore(userID int, coreID string) (int64, error) {
+	return rowsAffected(st.exec(sqlStmtAdminRemoveCore, userID, coreID))
+}
+
+func (st *sqlStore) SavePresent(present *Present) (int64, error) {
+	items, err := json.Marshal(present.Items)
+	if err != nil {
+		return 0, err
+	}
+	return rowsAffected(st.exec(
+		sqlStmtAdminSavePresent, present.PresentID, present.ExpireTs, present.Description, string(items),
+	))
+}
+
+func (st *sqlStore) DeletePresent(presentID string) error {
+	return st.editRows(func(tx *sqlRowTx) error {
+		if _, err := tx.exec(sqlStmtAdminDeletePlayerPresents, presentID); err != nil {
+			return err
+		}
+		_, err := tx.exec(sqlStmtAdminDeletePresent, presentID)
+		return err
+	})
+}
+
+func (st *sqlStore) GivePresent(userID int, presentID string) (int64, error) {
+	return rowsAffected(st.exec(sqlStmtAdminGivePresent, userID, presentID))
+}
+
+func (st *sqlStore) TakePresent(userID int, presentID string) (int64, error) {
+	return rowsAffected(st.exec(sqlStmtAdminTakePresent, userID, presentID))
+}
+
+// Section: Rows
+// ============================================================================
+
+func (st *sqlStore) EditRows(fn func(tx RowTx) error) error {
+	return st.editRows(func(tx *sqlRowTx) error { return fn(tx) })
+}
+
+func (st *sqlStore) editRows(fn func(tx *sqlRowTx) error) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(&sqlRowTx{sqlConn{tx, st.backend}, map[string]map[string]bool{}}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqlRowTx is RowTx of sqlStore.
+type sqlRowTx struct {
+	sqlConn
+	// columns caches column names of tables rows are inserted into
+	columns map[string]map[string]bool
+}
+
+func (tx *sqlRowTx) KnownIDs(kind string) (map[string]bool, error) {
+	stmt, ok := knownIDStmts[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown kind of static data `%s`", kind)
+	}
+	rows, err := tx.query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := map[string]bool{}
+	var id string
+	for rows.Next() {
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+func (tx *sqlRowTx) SelectRows(table string, columns []string, where map[string]interface{}) ([]map[string]interface{}, error) {
+	selected := "*"
+	if columns != nil {
+		selected = strings.Join(columns, ", ")
+	}
+	cond, args := rowCondition(where)
+	rows, err := tx.query(fmt.Sprintf(sqlStmtImportSelect, selected, table, cond), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	results := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(names))
+		ptrs := make([]interface{}, len(names))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := map[string]interface{}{}
+		for i, name := range names {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row[name] = values[i]
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+func (tx *sqlRowTx) InsertRow(table string, row map[string]interface{}) error {
+	columns, err := tx.checkColumns(table, row)
+	if err != nil {
+		return err
+	}
+	args := make([]interface{}, len(columns))
+	for i, column := range columns {
+		args[i] = row[column]
+	}
+	stmt := fmt.Sprintf(sqlStmtImportInsert, table, strings.Join(columns, ", "), sqlPlaceholders(len(columns)))
+	_, err = tx.exec(stmt, args...)
+	return err
+}
+
+func (tx *sqlRowTx) UpdateRows(table string, values map[string]interface{}, where map[string]interface{}) (int64, error) {
+	columns, err := tx.checkColumns(table, values)
+	if err != nil {
+		return 0, err
+	}
+	if len(columns) == 0 {
+		return 0, nil
+	}
+	sets := make([]string, len(columns))
+	args := make([]interface{}, len(columns))
+	for i, column := range columns {
+		sets[i] = column + " = ?"
+		args[i] = values[column]
+	}
+	cond, condArgs := rowCondition(where)
+	stmt := fmt.Sprintf(sqlStmtImportUpdate, table, strings.Join(sets, ", "), cond)
+	return rowsAffected(tx.exec(stmt, append(args, condArgs...)...))
+}
+
+func (tx *sqlRowTx) DeleteRows(table string, where map[string]interface{}) (int64, error) {
+	cond, args := rowCondition(where)
+	return rowsAffected(tx.exec(fmt.Sprintf(sqlStmtImportDelete, table, cond), args...))
+}
+
+func (tx *sqlRowTx) PlayerTaken(name string, email string) (bool, error) {
+	var count int
+	err := tx.queryRow(sqlStmtPlayerNameExists, name, email).Scan(&count)
+	return count > 0, err
+}
+
+func (tx *sqlRowTx) NewUserCode() (int64, error) {
+	for i := 0; i < 100; i++ {
+		code := rand.Int63n(900_000_000) + 100_000_000
+		var count int
+		if err := tx.queryRow(sqlStmtUserCodeExists, code).Scan(&count); err != nil {
+			return 0, err
+		} else if count == 0 {
+			return code, nil
+		}
+	}
+	return 0, errors.New("can't find an unused user code")
+}
+
+func (tx *sqlRowTx) InsertPlayer(row map[string]interface{}) (int, error) {
+	userCode, ok := row["user_code"]
+	if !ok || userCode == nil {
+		return 0, errors.New("player has no user code")
+	}
+	if err := tx.InsertRow("player", row); err != nil {
+		return 0, err
+	}
+	// user code is unique, reading user ID back with it works on every
+	// backend, unlike LastInsertId
+	var (
+		userID int
+		name   string
+	)
+	err := tx.queryRow(sqlStmtPlayerByCode, userCode).Scan(&userID, &name)
+	return userID, err
+}
+
+// checkColumns makes sure every column of row exists in table, since column
+// names may come from files. Columns are returned in sorted order.
+func (tx *sqlRowTx) checkColumns(table string, row map[string]interface{}) ([]string, error) {
+	known, ok := tx.columns[table]
+	if !ok {
+		rows, err := tx.query(fmt.Sprintf(sqlStmtTableColumns, table))
+		if err != nil {
+			return nil, err
+		}
+		names, err := rows.Columns()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		known = map[string]bool{}
+		for _, name := range names {
+			known[name] = true
+		}
+		tx.columns[table] = known
+	}
+
+	columns := make([]string, 0, len(row))
+	unknown := []string{}
+	for column := range row {
+		if known[column] {
+			columns = append(columns, column)
+		} else {
+			unknown = append(unknown, strconv.Quote(column))
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown column(s) %s of %s", strings.Join(unknown, ", "), strings.ToUpper(table))
+	}
+	sort.Strings(columns)
+	return columns, nil
+}
+
+// rowCondition turns conditions of RowTx into WHERE clause and its args,
+// columns are sorted so that statements are the same for the same columns.
+func rowCondition(where map[string]interface{}) (string, []interface{}) {
+	if len(where) == 0 {
+		return "1 = 1", nil
+	}
+	columns := make([]string, 0, len(where))
+	for column := range where {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	conds := make([]string, len(columns))
+	args := []interface{}{}
+	for i, column := range columns {
+		values, ok := where[column].([]interface{})
+		switch {
+		case !ok:
+			conds[i] = column + " = ?"
+			args = append(args, where[column])
+		case len(values) == 0:
+			conds[i] = "1 = 0"
+		default:
+			conds[i] = fmt.Sprintf("%s in (%s)", column, sqlPlaceholders(len(values)))
+			args = append(args, values...)
+		}
+	}
+	return strings.Join(conds, " and "), args
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Store tests run on a fresh SQLite database, and also on PostgreSQL when
+// ZRC_TEST_POSTGRES holds a connection string, e.g.
+//
+//	ZRC_TEST_POSTGRES="host=localhost dbname=zrc_test sslmode=disable" go test
+//
+// Each PostgreSQL run gets its own schema, which is dropped afterwards.
+const testPostgresEnv = "ZRC_TEST_POSTGRES"
+
+// forEachStore runs fn on a freshly migrated store of every backend available.
+func forEachStore(t *testing.T, fn func(t *testing.T, st Store)) {
+	t.Run("sqlite", func(t *testing.T) {
+		config := defaultConfig()
+		config.DB = filepath.Join(t.TempDir(), "zrc.db")
+		fn(t, openTestStore(t, config))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv(testPostgresEnv)
+		if dsn == "" {
+			t.Skipf("%s is not set", testPostgresEnv)
+		}
+		config := defaultConfig()
+		config.Storage = "postgres"
+		config.DB = testPostgresSchema(t, dsn)
+		fn(t, openTestStore(t, config))
+	})
+}
+
+func openTestStore(t *testing.T, config *Config) Store {
+	t.Helper()
+	st, _, err := openStore(config)
+	if err != nil {
+		t.Fatalf("openStore: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+// testPostgresSchema creates an empty schema and returns dsn with it as
+// search path.
+func testPostgresSchema(t *testing.T, dsn string) string {
+	t.Helper()
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("opening PostgreSQL: %v", err)
+	}
+	schema := fmt.Sprintf("zrc_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec("create schema " + schema); err != nil {
+		db.Close()
+		t.Fatalf("creating schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec("drop schema " + schema + " cascade"); err != nil {
+			t.Errorf("dropping schema %s: %v", schema, err)
+		}
+		db.Close()
+	})
+
+	switch {
+	case !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://"):
+		return dsn + " search_path=" + schema
+	case strings.Contains(dsn, "?"):
+		return dsn + "&search_path=" + schema
+	default:
+		return dsn + "?search_path=" + schema
+	}
+}
+
+// seedStore inserts a few packs, songs, charts and a core.
+func seedStore(t testing.TB, st Store) {
+	t.Helper()
+	err := st.EditRows(func(tx RowTx) error {
+		rows := []struct {
+			table string
+			row   map[string]interface{}
+		}{
+			{"pack", map[string]interface{}{"pack_name": "base"}},
+			{"pack", map[string]interface{}{"pack_name": "extra", "price": 500}},
+			{"song", map[string]interface{}{"song_id": "alpha", "title_local_en": "Alpha", "pack_name": "base"}},
+			{"song", map[string]interface{}{"song_id": "beta", "title_local_en": "beta", "pack_name": "extra", "remote_dl": 1}},
+			{"song", map[string]interface{}{"song_id": "gamma", "title_local_en": "Gamma's ?", "pack_name": "extra"}},
+			{"chart_info", map[string]interface{}{"song_id": "alpha", "difficulty": 2, "rating": 9.5}},
+			{"chart_info", map[string]interface{}{"song_id": "beta", "difficulty": 2, "rating": 10.7, "remote_dl": 1}},
+			{"chart_info", map[string]interface{}{"song_id": "gamma", "difficulty": 3, "rating": 11.0}},
+			{"pack_item", map[string]interface{}{"pack_name": "extra", "item_id": "beta", "item_type": "single", "is_available": 1}},
+			{"core", map[string]interface{}{"core_id": "core_generic", "internal_id": "1", "core_name": "Generic"}},
+		}
+		for _, r := range rows {
+			if err := tx.InsertRow(r.table, r.row); err != nil {
+				return fmt.Errorf("%s: %w", r.table, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("seeding store: %v", err)
+	}
+}
+
+func TestRebindDollar(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"select 1", "select 1"},
+		{"where a = ? and b = ?", "where a = $1 and b = $2"},
+		{"where a = ?2 and b = ?1 or c = ?2", "where a = $2 and b = $1 or c = $2"},
+		{"values(?3, ?)", "values($3, $4)"},
+		{"where a = '?' and b = ?", "where a = '?' and b = $1"},
+		{"where a = 'it''s ?' and b = ?1", "where a = 'it''s ?' and b = $1"},
+		{`select "col?" from t where a = ?`, `select "col?" from t where a = $1`},
+		{"select ? -- why ?\nfrom t where a = ?", "select $1 -- why ?\nfrom t where a = $2"},
+		{"select /* ?1 */ ?", "select /* ?1 */ $1"},
+		{"where a = 'unterminated ?", "where a = 'unterminated ?"},
+	}
+	for _, c := range cases {
+		if got := rebindDollar(c.in); got != c.want {
+			t.Errorf("rebindDollar(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestStoreRows(t *testing.T) {
+	forEachStore(t, func(t *testing.T, st Store) {
+		seedStore(t, st)
+
+		err := st.EditRows(func(tx RowTx) error {
+			songs, err := tx.KnownIDs("song")
+			if err != nil {
+				return err
+			}
+			if want := map[string]bool{"alpha": true, "beta": true, "gamma": true}; !reflect.DeepEqual(songs, want) {
+				t.Errorf("KnownIDs(song) = %v, want %v", songs, want)
+			}
+			if _, err := tx.KnownIDs("nothing"); err == nil {
+				t.Error("KnownIDs accepted unknown kind")
+			}
+
+			rows, err := tx.SelectRows("song", []string{"song_id"}, map[string]interface{}{
+				"pack_name": []interface{}{"extra", "missing"},
+			})
+			if err != nil {
+				return err
+			}
+			if len(rows) != 2 {
+				t.Errorf("SelectRows with IN condition got %d rows, want 2", len(rows))
+			}
+			rows, err = tx.SelectRows("song", nil, map[string]interface{}{"song_id": []interface{}{}})
+			if err != nil {
+				return err
+			} else if len(rows) != 0 {
+				t.Errorf("SelectRows with empty IN condition got %d rows, want 0", len(rows))
+			}
+
+			n, err := tx.UpdateRows("song", map[string]interface{}{"checksum": "abc"}, map[string]interface{}{"pack_name": "extra"})
+			if err != nil {
+				return err
+			} else if n != 2 {
+				t.Errorf("UpdateRows affected %d rows, want 2", n)
+			}
+			rows, err = tx.SelectRows("song", nil, map[string]interface{}{"song_id": "beta"})
+			if err != nil {
+				return err
+			}
+			if len(rows) != 1 || rows[0]["checksum"] != "abc" || rows[0]["title_local_en"] != "beta" {
+				t.Errorf("SelectRows(song beta) = %v", rows)
+			}
+
+			err = tx.InsertRow("song", map[string]interface{}{"song_id": "x", "title) values('y');--": "z"})
+			if err == nil || !strings.Contains(err.Error(), "unknown column") {
+				t.Errorf("InsertRow with unknown column returned %v", err)
+			}
+
+			n, err = tx.DeleteRows("pack_item", map[string]interface{}{"pack_name": "extra", "item_id": "beta"})
+			if err != nil {
+				return err
+			} else if n != 1 {
+				t.Errorf("DeleteRows affected %d rows, want 1", n)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// rows written before fn fails are rolled back
+		errFail := fmt.Errorf("fail")
+		err = st.EditRows(func(tx RowTx) error {
+			if err := tx.InsertRow("pack", map[string]interface{}{"pack_name": "rolled_back"}); err != nil {
+				return err
+			}
+			return errFail
+		})
+		if err != errFail {
+			t.Fatalf("EditRows returned %v, want %v", err, errFail)
+		}
+		names, err := st.PackNames()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"base", "extra"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("PackNames() = %v, want %v", names, want)
+		}
+	})
+}
+
+func TestStorePlayers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, st Store) {
+		userID, userCode, err := st.CreatePlayer("alice", "alice@example.com", "hash", 1000)
+		if err != nil {
+			t.Fatalf("CreatePlayer: %v", err)
+		}
+		if userID == 1 || userCode < 100_000_000 || userCode > 999_999_999 {
+			t.Errorf("CreatePlayer returned user ID %d, user code %d", userID, userCode)
+		}
+		if _, _, err := st.CreatePlayer("alice", "", "", 0); err == nil {
+			t.Error("CreatePlayer accepted a taken user name")
+		}
+		bobID, _, err := st.CreatePlayer("bob", "", "", 2000)
+		if err != nil {
+			t.Fatalf("CreatePlayer without email: %v", err)
+		}
+
+		code := fmt.Sprintf("%09d", userCode)
+		for _, user := range []string{"alice", "alice@example.com", code} {
+			if got, err := st.FindPlayer(user); err != nil || got != userID {
+				t.Errorf("FindPlayer(%q) = %d, %v, want %d", user, got, err, userID)
+			}
+		}
+		if _, err := st.FindPlayer("nobody"); err != sql.ErrNoRows {
+			t.Errorf("FindPlayer(nobody) returned %v, want sql.ErrNoRows", err)
+		}
+		if got, name, err := st.PlayerByCode(userCode); err != nil || got != userID || name != "alice" {
+			t.Errorf("PlayerByCode = %d, %q, %v", got, name, err)
+		}
+
+		chars, err := st.Characters(userID, -1)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(chars) != 2 {
+			t.Errorf("new player has %d characters, want the 2 default ones", len(chars))
+		}
+
+		cases := []struct {
+			query string
+			want  []string
+		}{
+			{"", []string{"player", "alice", "bob"}},
+			{"%li%", []string{"alice"}},
+			{"ALICE", []string{"alice"}},
+			{code, []string{"alice"}},
+			{"no one", nil},
+		}
+		for _, c := range cases {
+			players, err := st.ListPlayers(c.query, 50, 0)
+			if err != nil {
+				t.Fatalf("ListPlayers(%q): %v", c.query, err)
+			}
+			var names []string
+			for _, p := range players {
+				names = append(names, p.Name)
+			}
+			if !reflect.DeepEqual(names, c.want) {
+				t.Errorf("ListPlayers(%q) = %v, want %v", c.query, names, c.want)
+			}
+		}
+		if players, err := st.ListPlayers("", 1, 1); err != nil || len(players) != 1 || players[0].Name != "alice" {
+			t.Errorf("ListPlayers with limit and offset = %v, %v", players, err)
+		}
+
+		n, err := st.UpdatePlayer(userID, map[string]interface{}{"display_name": "Alice", "ticket": 30})
+		if err != nil || n != 1 {
+			t.Errorf("UpdatePlayer = %d, %v", n, err)
+		}
+		if _, err := st.UpdatePlayer(userID, map[string]interface{}{"rating": 9999}); err == nil {
+			t.Error("UpdatePlayer accepted column not in updatableColumns")
+		}
+		summary, err := st.PlayerSummary(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.Name != "alice" || summary.UserCode != code || summary.JoinDate != 1000 {
+			t.Errorf("PlayerSummary = %+v", summary)
+		}
+
+		if err := st.DeletePlayer(bobID); err != nil {
+			t.Fatalf("DeletePlayer: %v", err)
+		}
+		if exists, err := st.PlayerExists(bobID); err != nil || exists {
+			t.Errorf("PlayerExists after delete = %v, %v", exists, err)
+		}
+		if exists, err := st.PlayerExists(userID); err != nil || !exists {
+			t.Errorf("PlayerExists = %v, %v", exists, err)
+		}
+	})
+}
+
+func TestStoreAdminItems(t *testing.T) {
+	forEachStore(t, func(t *testing.T, st Store) {
+		seedStore(t, st)
+		userID, _, err := st.CreatePlayer("alice", "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// each modifying call is made twice, the second one must not fail on
+		// rows already there
+		expectAffected := func(what string, want int64) func(int64, error) {
+			return func(n int64, err error) {
+				t.Helper()
+				if err != nil {
+					t.Errorf("%s: %v", what, err)
+				} else if n != want {
+					t.Errorf("%s affected %d rows, want %d", what, n, want)
+				}
+			}
+		}
+
+		expectAffected("GrantPurchase", 1)(st.GrantPurchase(userID, "pack", "extra"))
+		expectAffected("GrantPurchase again", 0)(st.GrantPurchase(userID, "pack", "extra"))
+		expectAffected("GrantPurchase single", 1)(st.GrantPurchase(userID, "single", "alpha"))
+		if _, err := st.GrantPurchase(userID, "world", "x"); err == nil {
+			t.Error("GrantPurchase accepted unknown kind")
+		}
+		if packs, err := st.PlayerItems(userID, playerPacks); err != nil || !reflect.DeepEqual(packs, []string{"extra"}) {
+			t.Errorf("PlayerItems(packs) = %v, %v", packs, err)
+		}
+		expectAffected("RevokePurchase", 1)(st.RevokePurchase(userID, "pack", "extra"))
+		expectAffected("RevokePurchase again", 0)(st.RevokePurchase(userID, "pack", "extra"))
+
+		stats := &CharacterStats{PartID: 1, Level: 5, Overdrive: 60, Prog: 60, Frag: 60}
+		expectAffected("UnlockCharacter", 1)(st.UnlockCharacter(userID, stats))
+		stats.Level, stats.IsUncapped = 7, true
+		expectAffected("UnlockCharacter again", 1)(st.UnlockCharacter(userID, stats))
+		chars, err := st.Characters(userID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chars) != 1 || chars[0].Level != 7 || !chars[0].IsUncapped {
+			t.Errorf("Characters after unlock = %+v", chars)
+		}
+		expectAffected("RemoveCharacter", 1)(st.RemoveCharacter(userID, 1))
+
+		expectAffected("SetCore", 1)(st.SetCore(userID, "core_generic", 3))
+		expectAffected("SetCore again", 1)(st.SetCore(userID, "core_generic", 5))
+		cores, err := st.Cores(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cores) != 1 || cores[0].Amount != 5 {
+			t.Errorf("Cores = %+v", cores)
+		}
+		expectAffected("RemoveCore", 1)(st.RemoveCore(userID, "core_generic"))
+
+		present := &Present{PresentID: "gift", ExpireTs: 5000, Description: "first"}
+		expectAffected("SavePresent", 1)(st.SavePresent(present))
+		present.Description = "second"
+		present.Items = []RewardItem{{ItemType: "memory", Amount: 100}}
+		expectAffected("SavePresent again", 1)(st.SavePresent(present))
+		expectAffected("GivePresent", 1)(st.GivePresent(userID, "gift"))
+		expectAffected("GivePresent again", 0)(st.GivePresent(userID, "gift"))
+		presents, err := st.Presents(userID, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(presents) != 1 || !reflect.DeepEqual(presents[0], *present) {
+			t.Errorf("Presents = %+v, want %+v", presents, *present)
+		}
+		if presents, err := st.Presents(userID, 6000); err != nil || len(presents) != 0 {
+			t.Errorf("Presents after expiry = %+v, %v", presents, err)
+		}
+		if err := st.DeletePresent("gift"); err != nil {
+			t.Fatalf("DeletePresent: %v", err)
+		}
+		if presents, err := st.AllPresents(); err != nil || len(presents) != 0 {
+			t.Errorf("AllPresents after delete = %+v, %v", presents, err)
+		}
+
+		expectAffected("UpdateGameInfo", 1)(st.UpdateGameInfo(map[string]interface{}{"max_stamina": 20, "is_aprilfools": sqlBool(true)}))
+		if _, err := st.UpdateGameInfo(map[string]interface{}{"max_stamina) = 1;--": 1}); err == nil {
+			t.Error("UpdateGameInfo accepted column not in updatableColumns")
+		}
+		st.InvalidateStatic()
+		info, err := st.GameInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		aprilFools, err := st.IsAprilFools()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.MaxStam != 20 || !aprilFools {
+			t.Errorf("game info after update = %+v, April Fools %v", info, aprilFools)
+		}
+	})
+}
+
+func TestStoreScores(t *testing.T) {
+	forEachStore(t, func(t *testing.T, st Store) {
+		seedStore(t, st)
+		userID, _, err := st.CreatePlayer("alice", "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plays := []ScoreRecord{
+			{SongID: "alpha", Difficulty: 2, Score: 9_800_000, Rating: 10.5, TimePlayed: 100, ClearType: 1},
+			{SongID: "beta", Difficulty: 2, Score: 9_500_000, Rating: 10.7, TimePlayed: 200, ClearType: 2},
+			{SongID: "gamma", Difficulty: 3, Score: 9_000_000, Rating: 10.0, TimePlayed: 300, ClearType: 1},
+		}
+		err = st.UpdateScores(func(tx ScoreTx) error {
+			for i := range plays {
+				play := &plays[i]
+				if err := tx.InsertScore(userID, play); err != nil {
+					return err
+				}
+				if err := tx.InsertBestScore(userID, play.TimePlayed); err != nil {
+					return err
+				}
+				recent := recentPlay{playedDate: play.TimePlayed, isR10: i > 0}
+				if err := tx.InsertRecentPlay(userID, recent); err != nil {
+					return err
+				}
+			}
+			return tx.UpdateRating(userID, 1234)
+		})
+		if err != nil {
+			t.Fatalf("UpdateScores: %v", err)
+		}
+
+		songsOf := func(scores []ScoreEntry) []string {
+			songs := []string{}
+			for _, s := range scores {
+				songs = append(songs, s.SongID)
+			}
+			return songs
+		}
+
+		best, err := st.Best30(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := songsOf(best), []string{"beta", "alpha", "gamma"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Best30 = %v, want %v", got, want)
+		}
+		if best[0].Title != "beta" || best[0].PackName != "extra" || best[0].BaseRating != 10.7 {
+			t.Errorf("Best30 entry = %+v", best[0])
+		}
+
+		filters := []struct {
+			filter ScoreFilter
+			want   []string
+		}{
+			{ScoreFilter{Sort: "rating", Difficulty: -1, ClearType: -1}, []string{"beta", "alpha", "gamma"}},
+			{ScoreFilter{Sort: "score", Difficulty: -1, ClearType: -1}, []string{"alpha", "beta", "gamma"}},
+			{ScoreFilter{Sort: "base", Difficulty: -1, ClearType: -1}, []string{"gamma", "beta", "alpha"}},
+			{ScoreFilter{Sort: "date", Difficulty: -1, ClearType: -1}, []string{"gamma", "beta", "alpha"}},
+			{ScoreFilter{Sort: "title", Difficulty: -1, ClearType: -1}, []string{"alpha", "beta", "gamma"}},
+			{ScoreFilter{Sort: "unknown", Difficulty: 2, ClearType: -1}, []string{"beta", "alpha"}},
+			{ScoreFilter{Sort: "rating", Difficulty: -1, Pack: "extra", ClearType: 1}, []string{"gamma"}},
+		}
+		for _, f := range filters {
+			scores, err := st.BestScores(userID, f.filter)
+			if err != nil {
+				t.Fatalf("BestScores(%+v): %v", f.filter, err)
+			}
+			if got := songsOf(scores); !reflect.DeepEqual(got, f.want) {
+				t.Errorf("BestScores(%+v) = %v, want %v", f.filter, got, f.want)
+			}
+		}
+
+		recent, err := st.RecentScores(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r10 := map[string]bool{}
+		for _, s := range recent {
+			r10[s.SongID] = s.IsR10
+		}
+		if want := map[string]bool{"alpha": false, "beta": true, "gamma": true}; !reflect.DeepEqual(r10, want) {
+			t.Errorf("RecentScores R10 flags = %v, want %v", r10, want)
+		}
+		if ratings, err := st.Recent10Ratings(userID); err != nil || len(ratings) != 2 {
+			t.Errorf("Recent10Ratings = %v, %v", ratings, err)
+		}
+
+		history, err := st.ScoreHistory(userID, 2, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := songsOf(history), []string{"beta", "alpha"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("ScoreHistory(2, 1) = %v, want %v", got, want)
+		}
+
+		count, last, err := st.PlayCount(userID)
+		if err != nil || count != 3 || last != 300 {
+			t.Errorf("PlayCount = %d, %d, %v", count, last, err)
+		}
+		summary, err := st.PlayerSummary(userID)
+		if err != nil || summary.Rating != 12.34 {
+			t.Errorf("PlayerSummary = %+v, %v", summary, err)
+		}
+
+		downloads, err := st.PurchasedDownloads(userID, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(downloads) != 0 {
+			t.Errorf("PurchasedDownloads before purchase = %+v", downloads)
+		}
+		if _, err := st.GrantPurchase(userID, "pack", "extra"); err != nil {
+			t.Fatal(err)
+		}
+		downloads, err = st.PurchasedDownloads(userID, []string{"beta", "x') or ('1' = '1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(downloads) != 1 || downloads[0].songID != "beta" {
+			t.Errorf("PurchasedDownloads(beta) = %+v", downloads)
+		}
+
+		if err := st.DeletePlayer(userID); err != nil {
+			t.Fatalf("DeletePlayer with scores: %v", err)
+		}
+	})
+}
+
+func TestStoreChart(t *testing.T) {
+	forEachStore(t, func(t *testing.T, st Store) {
+		seedStore(t, st)
+		if rating, err := st.ChartRating("alpha", 2); err != nil || rating != 9.5 {
+			t.Errorf("ChartRating(alpha, 2) = %v, %v", rating, err)
+		}
+		cases := []struct {
+			songID     string
+			difficulty int
+		}{
+			{"unknown", 2},
+			{"alpha", 3},
+		}
+		for _, c := range cases {
+			if _, err := st.ChartRating(c.songID, int8(c.difficulty)); err != sql.ErrNoRows {
+				t.Errorf("ChartRating(%s, %d) returned %v, want sql.ErrNoRows", c.songID, c.difficulty, err)
+			}
+			if _, err := st.ChartChecksum(c.songID, c.difficulty); err != sql.ErrNoRows {
+				t.Errorf("ChartChecksum(%s, %d) returned %v, want sql.ErrNoRows", c.songID, c.difficulty, err)
+			}
+		}
+	})
+}
+
+func TestStoreAudit(t *testing.T) {
+	forEachStore(t, func(t *testing.T, st Store) {
+		userID := int64(1)
+		entries := []AuditEntry{
+			{CreatedAt: 100, Actor: "player", UserID: &userID, Action: "login"},
+			{CreatedAt: 200, Actor: "admin", UserID: &userID, Action: "player.update", Detail: `{"ticket":1}`},
+			{CreatedAt: 300, Actor: "admin", Action: "game_info.update"},
+		}
+		for i := range entries {
+			if err := st.WriteAudit(&entries[i]); err != nil {
+				t.Fatalf("WriteAudit: %v", err)
+			}
+		}
+
+		one, from, to := 1, int64(150), int64(300)
+		cases := []struct {
+			filter AuditFilter
+			want   []string
+		}{
+			{AuditFilter{Limit: 10}, []string{"game_info.update", "player.update", "login"}},
+			{AuditFilter{UserID: &one, Limit: 10}, []string{"player.update", "login"}},
+			{AuditFilter{Action: "login", Limit: 10}, []string{"login"}},
+			{AuditFilter{From: &from, Limit: 10}, []string{"game_info.update", "player.update"}},
+			{AuditFilter{From: &from, To: &to, Limit: 10}, []string{"player.update"}},
+			{AuditFilter{Limit: 1, Offset: 1}, []string{"player.update"}},
+		}
+		for _, c := range cases {
+			got, err := st.QueryAudit(c.filter)
+			if err != nil {
+				t.Fatalf("QueryAudit(%+v): %v", c.filter, err)
+			}
+			actions := []string{}
+			for _, e := range got {
+				actions = append(actions, e.Action)
+			}
+			if !reflect.DeepEqual(actions, c.want) {
+				t.Errorf("QueryAudit(%+v) = %v, want %v", c.filter, actions, c.want)
+			}
+		}
+
+		if n, err := st.CleanAudit(250); err != nil || n != 2 {
+			t.Errorf("CleanAudit = %d, %v", n, err)
+		}
+	})
+}
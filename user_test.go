@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSettableColumns(t *testing.T) {
+	if len(settableColumns) != len(SettingMap) {
+		t.Errorf("settableColumns has %d columns, SettingMap has %d options", len(settableColumns), len(SettingMap))
+	}
+	for option, column := range SettingMap {
+		if !settableColumns[column] {
+			t.Errorf("column %s of option %s is not settable", column, option)
+		}
+	}
+}
+
+// TestSetSettingWhitelist makes sure only columns in settableColumns can be
+// set, since column name is put into statement.
+func TestSetSettingWhitelist(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	for _, column := range []string{
+		"rating", "pwdhash", "user_name",
+		"is_hide_rating = 1, rating",
+		"is_hide_rating = 1 where 1 = 1; drop table player; --",
+	} {
+		if err := s.store.SetSetting(1, column, true); err == nil {
+			t.Errorf("SetSetting accepted column %q", column)
+		}
+	}
+	for column := range settableColumns {
+		if column == "favorite_partner" {
+			continue
+		}
+		if err := s.store.SetSetting(1, column, true); err != nil {
+			t.Errorf("SetSetting(%s): %v", column, err)
+		}
+	}
+
+	// unknown options are ignored by setting handler
+	api := s.cfg().APIRoot
+	for _, option := range []string{"rating", "pwdhash", "is_hide_rating%3D1,rating"} {
+		serve(s, "POST", api+"/user/me/setting/"+option, url.Values{"value": {"1"}}, nil)
+	}
+	info, err := s.store.Player(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Rating != 0 {
+		t.Errorf("rating changed to %d through setting request", info.Rating)
+	}
+	if _, ok, err := s.checkPassword("player", testPassword); err != nil || !ok {
+		t.Errorf("password changed through setting request: %v", err)
+	}
+	if !info.Settings.HideRating || !info.Settings.StaminaNotification {
+		t.Errorf("settings are %+v, want both on", info.Settings)
+	}
+}